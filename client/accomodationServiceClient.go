@@ -1,21 +1,73 @@
 package client
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 
+	"github.com/windbnb/user-service/model"
 	"github.com/windbnb/user-service/util"
 )
 
-func DeleteAccomodationForHost(hostId uint) error {
+// AccommodationsDeleteScope lets a service delete the accommodations of a
+// host.
+const AccommodationsDeleteScope = "accommodations:delete"
+
+// AccommodationsEventsScope lets a service deliver events to the
+// accommodation service.
+const AccommodationsEventsScope = "accommodations:events"
+
+// DeleteAccomodationForHost calls the accommodation service with a service
+// token that carries AccommodationsDeleteScope. Any answer but a 2xx is a
+// failure, the cron job deletes the accommodations again.
+func DeleteAccomodationForHost(hostId uint, serviceToken string) error {
 	client := &http.Client{}
 	accomodationUrl, _ := util.GetAccommodationServicePathRoundRobin()
 	req, _ := http.NewRequest("DELETE", accomodationUrl.Next().Host+"/api/accomodation/delete-all/"+strconv.FormatUint(uint64(hostId), 10), nil)
 
-	_, err := client.Do(req)
+	req.Header.Set("Authorization", "Bearer "+serviceToken)
+
+	response, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("accomodation %w", ErrServiceUnreachable)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.New("accomodation service did not delete the accommodations")
+	}
+
+	return nil
+}
+
+// PublishEvent delivers an event to the accommodation service with a service
+// token that carries AccommodationsEventsScope. Any answer but a 2xx is a
+// failed delivery, the event is delivered again and the accommodation service
+// recognises it by its id.
+func PublishEvent(event model.EventEnvelope, serviceToken string) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.New("failed to encode event")
+	}
+
+	client := &http.Client{}
+	accomodationUrl, _ := util.GetAccommodationServicePathRoundRobin()
+	req, _ := http.NewRequest("POST", accomodationUrl.Next().Host+"/api/accomodation/events", bytes.NewReader(body))
+
+	req.Header.Set("Authorization", "Bearer "+serviceToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	response, err := client.Do(req)
 	if err != nil {
-		return errors.New("accomodation service unreachable")
+		return fmt.Errorf("accomodation %w", ErrServiceUnreachable)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.New("accomodation service rejected the event")
 	}
 
 	return nil
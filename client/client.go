@@ -0,0 +1,7 @@
+package client
+
+import "errors"
+
+// ErrServiceUnreachable is wrapped by the clients when the other service does
+// not answer at all, callers answer with a 504 instead of a 400.
+var ErrServiceUnreachable = errors.New("service unreachable")
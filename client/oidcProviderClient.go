@@ -0,0 +1,73 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/windbnb/user-service/model"
+)
+
+var oidcProviderClient = &http.Client{Timeout: 10 * time.Second}
+
+func getJSON(url string, target interface{}) error {
+	response, err := oidcProviderClient.Get(url)
+	if err != nil {
+		return errors.New("identity provider unreachable")
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return errors.New("identity provider answered with " + response.Status)
+	}
+
+	return json.NewDecoder(response.Body).Decode(target)
+}
+
+// FetchOpenIDConfiguration reads the discovery document of an issuer.
+func FetchOpenIDConfiguration(issuer string) (model.OpenIDConfiguration, error) {
+	var configuration model.OpenIDConfiguration
+	err := getJSON(strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &configuration)
+	if err != nil {
+		return model.OpenIDConfiguration{}, err
+	}
+
+	return configuration, nil
+}
+
+func FetchJSONWebKeySet(jwksURI string) (model.JSONWebKeySet, error) {
+	var jwks model.JSONWebKeySet
+	err := getJSON(jwksURI, &jwks)
+	if err != nil {
+		return model.JSONWebKeySet{}, err
+	}
+
+	return jwks, nil
+}
+
+// ExchangeAuthorizationCode redeems a code at the token endpoint of an
+// identity provider, authenticating with client_secret_post.
+func ExchangeAuthorizationCode(tokenEndpoint string, form url.Values) (model.OAuthTokenResponse, error) {
+	response, err := oidcProviderClient.PostForm(tokenEndpoint, form)
+	if err != nil {
+		return model.OAuthTokenResponse{}, errors.New("identity provider unreachable")
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var errorResponse model.OAuthErrorResponse
+		json.NewDecoder(response.Body).Decode(&errorResponse)
+		return model.OAuthTokenResponse{}, errors.New("identity provider rejected the code: " + errorResponse.Error)
+	}
+
+	var tokenResponse model.OAuthTokenResponse
+	err = json.NewDecoder(response.Body).Decode(&tokenResponse)
+	if err != nil {
+		return model.OAuthTokenResponse{}, errors.New("failed to parse identity provider token response")
+	}
+
+	return tokenResponse, nil
+}
@@ -3,6 +3,7 @@ package client
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 
@@ -10,7 +11,13 @@ import (
 	"github.com/windbnb/user-service/util"
 )
 
-func CheckReservations(userId uint, role string, tokenString string) error {
+// ReservationsReadScope lets a service list the reservations of any user.
+const ReservationsReadScope = "reservations:read"
+
+// CheckReservations calls the reservation service with a service token that
+// carries ReservationsReadScope. Any answer but a 2xx is a failure, the
+// account is not deleted when its reservations cannot be listed.
+func CheckReservations(userId uint, role string, serviceToken string) error {
 	if role != "owner" && role != "guest" {
 		return errors.New("invalid role specified")
 	}
@@ -19,14 +26,18 @@ func CheckReservations(userId uint, role string, tokenString string) error {
 	reservationUrl, _ := util.GetReservationServicePathRoundRobin()
 	req, _ := http.NewRequest("GET", reservationUrl.Next().Host+"/api/reservationRequest/"+role+"/"+strconv.FormatUint(uint64(userId), 10), nil)
 
-	req.Header.Set("Authorization", tokenString)
+	req.Header.Set("Authorization", "Bearer "+serviceToken)
 
 	response, err := client.Do(req)
 	if err != nil {
-		return errors.New("reservation service unreachable")
+		return fmt.Errorf("reservation %w", ErrServiceUnreachable)
 	}
 	defer response.Body.Close()
 
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.New("reservation service did not list the reservations")
+	}
+
 	var reservations []model.ReservationRequestDto
 	err = json.NewDecoder(response.Body).Decode(&reservations)
 	if err != nil {
@@ -1,15 +1,17 @@
 package cronUtil
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/robfig/cron/v3"
-	"github.com/windbnb/user-service/client"
 	model "github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/service"
 )
 
-func ConfigureCronJobs(db *gorm.DB) {
+func ConfigureCronJobs(db *gorm.DB, userService *service.UserService) {
 	cronHandler := cron.New()
 	cronHandler.AddFunc("@hourly", func() {
 		var userDeletionRequests []model.UserDeletionEvent
@@ -18,10 +20,41 @@ func ConfigureCronJobs(db *gorm.DB) {
 		for _, userDeletionRequest := range userDeletionRequests {
 			userId := userDeletionRequest.UserId
 			fmt.Println(userId)
-			err := client.DeleteAccomodationForHost(uint(userDeletionRequest.UserId))
+			err := userService.DeleteAccomodationForHost(uint(userDeletionRequest.UserId))
 			if err == nil {
 				db.Delete(userDeletionRequest)
 			}
 		}
 	})
+
+	cronHandler.AddFunc("@every 1m", func() {
+		userService.DeliverOutboxEvents(context.Background())
+	})
+
+	cronHandler.AddFunc("@hourly", func() {
+		db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&model.RevokedToken{})
+		db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&model.PasswordResetToken{})
+		db.Unscoped().Where("revert_expires_at < ?", time.Now()).Delete(&model.EmailChange{})
+		// Expired codes are kept for a day to recognise a replayed code.
+		db.Unscoped().Where("expires_at < ?", time.Now().Add(-24*time.Hour)).Delete(&model.AuthorizationCode{})
+		db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&model.FederatedLoginState{})
+		db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&model.PhoneVerification{})
+	})
+
+	cronHandler.AddFunc("@daily", func() {
+		deletedUsers := db.Unscoped().Model(&model.User{}).Where("deleted_at IS NOT NULL").Select("id").QueryExpr()
+		db.Unscoped().Where("user_id IN (?)", deletedUsers).Delete(&model.RefreshToken{})
+		db.Unscoped().Where("user_id IN (?)", deletedUsers).Delete(&model.Session{})
+		db.Unscoped().Where("user_id IN (?)", deletedUsers).Delete(&model.PasswordHistory{})
+		db.Unscoped().Where("user_id IN (?)", deletedUsers).Delete(&model.UserIdentity{})
+		db.Unscoped().Where("user_id IN (?)", deletedUsers).Delete(&model.PhoneVerification{})
+
+		// Delivered events are kept for a week to look into deliveries.
+		db.Unscoped().Where("delivered_at < ?", time.Now().Add(-7*24*time.Hour)).Delete(&model.OutboxEvent{})
+
+		staleBefore := time.Now().Add(-24 * time.Hour)
+		db.Unscoped().Where("last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)", staleBefore, time.Now()).Delete(&model.LoginThrottle{})
+	})
+
+	cronHandler.Start()
 }
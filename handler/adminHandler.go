@@ -0,0 +1,351 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/service"
+	"github.com/windbnb/user-service/tracer"
+)
+
+// authenticateAdmin checks the X-Admin-Token header against ADMIN_API_TOKEN.
+// The static token is disabled when none is configured.
+func (handler *Handler) authenticateAdmin(r *http.Request) error {
+	adminToken, adminTokenFound := os.LookupEnv("ADMIN_API_TOKEN")
+	if !adminTokenFound || adminToken == "" {
+		return errors.New("admin operations are disabled")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(adminToken)) != 1 {
+		return errors.New("Unauthorised")
+	}
+
+	return nil
+}
+
+// RequirePermissions guards a route with the permissions it declares in the
+// router. The caller needs a first party token whose scope has all of them,
+// or the static admin token, which is kept for automation and for assigning
+// the first admin.
+func (handler *Handler) RequirePermissions(next func(http.ResponseWriter, *http.Request), permissions ...string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		span := tracer.StartSpanFromRequest("requirePermissionsHandler", handler.Tracer, r)
+		defer span.Finish()
+
+		if r.Header.Get("X-Admin-Token") != "" {
+			if err := handler.authenticateAdmin(r); err != nil {
+				tracer.LogError(span, err)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+				return
+			}
+
+			next(w, r)
+			return
+		}
+
+		tokenString, err := bearerToken(r)
+		if err == nil {
+			ctx := tracer.ContextWithSpan(context.Background(), span)
+			_, err = handler.Service.AuthorisePermissions(tokenString, permissions, ctx)
+		}
+
+		if errors.Is(err, service.ErrPermissionDenied) {
+			tracer.LogError(span, err)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, strings.Join(permissions, " ")))
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusForbidden, Code: "insufficient_scope"})
+			return
+		}
+
+		if err != nil {
+			tracer.LogError(span, err)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(model.ErrorResponse{Message: "Unauthorised", StatusCode: http.StatusUnauthorized})
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func (handler *Handler) ListSigningKeys(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("listSigningKeysHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling signing key listing at %s\n", r.URL.Path)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	json.NewEncoder(w).Encode(handler.Service.ListSigningKeys(ctx))
+}
+
+func (handler *Handler) RotateSigningKey(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("rotateSigningKeyHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling signing key rotation at %s\n", r.URL.Path)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	var rotateRequest model.RotateSigningKeyRequest
+	json.NewDecoder(r.Body).Decode(&rotateRequest)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	key, err := handler.Service.RotateSigningKey(rotateRequest.Algorithm, ctx)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(key)
+}
+
+func (handler *Handler) RetireSigningKey(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("retireSigningKeyHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling signing key retirement at %s\n", r.URL.Path)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.Service.RetireSigningKey(params["kid"], ctx)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *Handler) SuspendUser(w http.ResponseWriter, r *http.Request) {
+	handler.setUserSuspended(w, r, true)
+}
+
+func (handler *Handler) UnsuspendUser(w http.ResponseWriter, r *http.Request) {
+	handler.setUserSuspended(w, r, false)
+}
+
+func (handler *Handler) setUserSuspended(w http.ResponseWriter, r *http.Request, suspended bool) {
+	span := tracer.StartSpanFromRequest("suspendUserHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling user suspension at %s\n", r.URL.Path)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	user, err := handler.Service.SuspendUser(userId, suspended, ctx)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	json.NewEncoder(w).Encode(user.ToAccountDTO())
+}
+
+func (handler *Handler) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("unlockUserHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling user unlock at %s\n", r.URL.Path)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.Service.UnlockUser(userId, ctx)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *Handler) ListOAuthClients(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("listOAuthClientsHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling oauth client listing at %s\n", r.URL.Path)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	json.NewEncoder(w).Encode(handler.Service.ListOAuthClients(ctx))
+}
+
+func (handler *Handler) RegisterOAuthClient(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("registerOAuthClientHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling oauth client registration at %s\n", r.URL.Path)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	var registerRequest model.RegisterOAuthClientRequest
+	json.NewDecoder(r.Body).Decode(&registerRequest)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	client, err := handler.Service.RegisterOAuthClient(registerRequest, ctx)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(client)
+}
+
+func (handler *Handler) DeleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("deleteOAuthClientHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling oauth client deletion at %s\n", r.URL.Path)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.Service.DeleteOAuthClient(params["clientId"], ctx)
+
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusNotFound})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *Handler) ListUsers(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("listUsersHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling user listing at %s\n", r.URL.Path)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	listRequest := model.UserListRequest{
+		Role:        query.Get("role"),
+		CreatedFrom: query.Get("createdFrom"),
+		CreatedTo:   query.Get("createdTo"),
+		Verified:    query.Get("verified"),
+		Suspended:   query.Get("suspended"),
+		Search:      query.Get("q"),
+		Sort:        query.Get("sort"),
+		Cursor:      query.Get("cursor"),
+		Limit:       query.Get("limit"),
+	}
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	users, err := handler.Service.ListUsers(listRequest, ctx)
+
+	if err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(users)
+}
+
+func (handler *Handler) ListRoles(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("listRolesHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling role listing at %s\n", r.URL.Path)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	json.NewEncoder(w).Encode(handler.Service.ListRoles(ctx))
+}
+
+func (handler *Handler) AddUserRole(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("addUserRoleHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling role grant at %s\n", r.URL.Path)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	var roleRequest model.RoleRequest
+	json.NewDecoder(r.Body).Decode(&roleRequest)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	user, err := handler.Service.AddRole(userId, roleRequest.Role, ctx)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user.ToAccountDTO())
+}
+
+func (handler *Handler) RemoveUserRole(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("removeUserRoleHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling role removal at %s\n", r.URL.Path)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.Service.RemoveRole(userId, model.UserRole(params["role"]), ctx)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/windbnb/user-service/tracer"
+)
+
+// Keys stay published for verification until they are retired, so verifiers
+// may cache the key set for a few minutes and refetch on an unknown kid.
+const discoveryMaxAge = 300
+
+func (handler *Handler) JWKS(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("jwksHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling jwks at %s\n", r.URL.Path)),
+	)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	writeCacheableJSON(w, r, handler.Service.JWKS(ctx))
+}
+
+func (handler *Handler) OpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("openIDConfigurationHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling openid configuration at %s\n", r.URL.Path)),
+	)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	writeCacheableJSON(w, r, handler.Service.OpenIDConfiguration(ctx))
+}
+
+// writeCacheableJSON sets Cache-Control and an ETag derived from the body and
+// answers conditional requests with 304 Not Modified.
+func writeCacheableJSON(w http.ResponseWriter, r *http.Request, body interface{}) {
+	content, err := json.Marshal(body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	hash := sha256.Sum256(content)
+	etag := `"` + hex.EncodeToString(hash[:16]) + `"`
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, must-revalidate", discoveryMaxAge))
+	w.Header().Set("ETag", etag)
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+)
+
+func (handler *Handler) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("confirmEmailChangeHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling email change confirmation at %s\n", r.URL.Path)),
+	)
+
+	var tokenRequest model.EmailChangeTokenRequest
+	json.NewDecoder(r.Body).Decode(&tokenRequest)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	user, err := handler.Service.ConfirmEmailChange(tokenRequest.Token, ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		tracer.LogError(span, err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	json.NewEncoder(w).Encode(user.ToAccountDTO())
+}
+
+func (handler *Handler) RevertEmailChange(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("revertEmailChangeHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling email change revert at %s\n", r.URL.Path)),
+	)
+
+	var tokenRequest model.EmailChangeTokenRequest
+	json.NewDecoder(r.Body).Decode(&tokenRequest)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	user, err := handler.Service.RevertEmailChange(tokenRequest.Token, ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		tracer.LogError(span, err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	json.NewEncoder(w).Encode(user.ToAccountDTO())
+}
@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+)
+
+func (handler *Handler) StartFederatedLogin(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("startFederatedLoginHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling federated login start at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	startResponse, err := handler.Service.StartFederatedLogin(params["provider"], ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err != nil {
+		tracer.LogError(span, err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	json.NewEncoder(w).Encode(startResponse)
+}
+
+func (handler *Handler) CompleteFederatedLogin(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("completeFederatedLoginHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling federated login callback at %s\n", r.URL.Path)),
+	)
+
+	var callbackRequest model.FederatedLoginCallbackRequest
+	json.NewDecoder(r.Body).Decode(&callbackRequest)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	loginResponse, err := handler.Service.CompleteFederatedLogin(callbackRequest.State, callbackRequest.Code, clientInfo(r), ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		tracer.LogError(span, err)
+		writeLoginError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(loginResponse)
+}
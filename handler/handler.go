@@ -6,15 +6,18 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/opentracing/opentracing-go"
+	"github.com/windbnb/user-service/client"
 	"github.com/windbnb/user-service/model"
 	"github.com/windbnb/user-service/service"
 	"github.com/windbnb/user-service/tracer"
+	"github.com/windbnb/user-service/util"
 )
 
 type Handler struct {
@@ -42,9 +45,94 @@ func (handler *Handler) Login(w http.ResponseWriter, r *http.Request) {
 	json.NewDecoder(r.Body).Decode(&credentials)
 
 	ctx := tracer.ContextWithSpan(context.Background(), span)
-	token, err := handler.Service.Login(credentials, ctx)
+	loginResponse, err := handler.Service.Login(credentials, clientInfo(r), ctx)
 
 	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		tracer.LogError(span, err)
+		writeLoginError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(loginResponse)
+}
+
+func (handler *Handler) StepUp(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("stepUpHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling re-authentication at %s\n", r.URL.Path)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	tokenString, err := bearerToken(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	var stepUpRequest model.StepUpRequest
+	json.NewDecoder(r.Body).Decode(&stepUpRequest)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	loginResponse, err := handler.Service.StepUp(tokenString, stepUpRequest, clientInfo(r), ctx)
+
+	if err != nil {
+		tracer.LogError(span, err)
+		writeLoginError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(loginResponse)
+}
+
+func (handler *Handler) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("refreshTokenHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling token refresh at %s\n", r.URL.Path)),
+	)
+
+	var refreshRequest model.RefreshTokenRequest
+	json.NewDecoder(r.Body).Decode(&refreshRequest)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	loginResponse, err := handler.Service.RefreshToken(refreshRequest.RefreshToken, ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		tracer.LogError(span, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	json.NewEncoder(w).Encode(loginResponse)
+}
+
+func (handler *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("logoutHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling logout at %s\n", r.URL.Path)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	tokenString, err := bearerToken(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	var logoutRequest model.LogoutRequest
+	json.NewDecoder(r.Body).Decode(&logoutRequest)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err = handler.Service.Logout(tokenString, logoutRequest.RefreshToken, ctx)
+
 	if err != nil {
 		tracer.LogError(span, err)
 		w.WriteHeader(http.StatusUnauthorized)
@@ -52,7 +140,7 @@ func (handler *Handler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	json.NewEncoder(w).Encode(model.LoginResponse{Token: token})
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (handler *Handler) Register(w http.ResponseWriter, r *http.Request) {
@@ -70,13 +158,12 @@ func (handler *Handler) Register(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
+		writeBadRequest(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(createdUser.ToDTO())
+	json.NewEncoder(w).Encode(createdUser.ToAccountDTO())
 }
 
 func (handler *Handler) EditUser(w http.ResponseWriter, r *http.Request) {
@@ -102,6 +189,10 @@ func (handler *Handler) EditUser(w http.ResponseWriter, r *http.Request) {
 	json.NewDecoder(r.Body).Decode(&userDTO)
 
 	ctx = tracer.ContextWithSpan(context.Background(), span)
+	if handler.Service.RequestsEmailChange(userDTO, userId, ctx) && !handler.requireStepUp(w, r, service.STEP_UP_CHANGE_EMAIL, ctx) {
+		return
+	}
+
 	editedUser, err := handler.Service.EditUser(userDTO, userId, ctx)
 
 	if err != nil {
@@ -111,26 +202,26 @@ func (handler *Handler) EditUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(editedUser.ToDTO())
+	json.NewEncoder(w).Encode(editedUser.ToAccountDTO())
 }
 
-func (handler *Handler) AuthoriseGuest(w http.ResponseWriter, r *http.Request) {
-	span := tracer.StartSpanFromRequest("authoriseGuestHandler", handler.Tracer, r)
-	defer span.Finish()
-	span.LogFields(
-		tracer.LogString("handler", fmt.Sprintf("handling guest authorisation at %s\n", r.URL.Path)),
-	)
-
-	authHeader := r.Header.Values("Authorization")
-	if authHeader == nil {
+// authoriseRole answers the role specific authorise routes with the user DTO
+// other services expect, on top of token introspection.
+func (handler *Handler) authoriseRole(w http.ResponseWriter, r *http.Request, role model.UserRole, ctx context.Context) {
+	tokenString, err := bearerToken(r)
+	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	tokenString := strings.Split(authHeader[0], " ")[1]
-  
-	ctx := tracer.ContextWithSpan(context.Background(), span)
-	user, err := handler.Service.AuthenticateUser(tokenString, model.GUEST, true, ctx)
+	user, err := handler.Service.AuthoriseRole(tokenString, role, ctx)
+
+	if errors.Is(err, service.ErrEmailNotVerified) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusForbidden})
+		return
+	}
 
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
@@ -141,6 +232,17 @@ func (handler *Handler) AuthoriseGuest(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(user.ToDTO())
 }
 
+func (handler *Handler) AuthoriseGuest(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("authoriseGuestHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling guest authorisation at %s\n", r.URL.Path)),
+	)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	handler.authoriseRole(w, r, model.GUEST, ctx)
+}
+
 func (handler *Handler) AuthoriseHost(w http.ResponseWriter, r *http.Request) {
 	span := tracer.StartSpanFromRequest("authoriseHostHandler", handler.Tracer, r)
 	defer span.Finish()
@@ -148,24 +250,8 @@ func (handler *Handler) AuthoriseHost(w http.ResponseWriter, r *http.Request) {
 		tracer.LogString("handler", fmt.Sprintf("handling host authorisation at %s\n", r.URL.Path)),
 	)
 
-	authHeader := r.Header.Values("Authorization")
-	if authHeader == nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	tokenString := strings.Split(authHeader[0], " ")[1]
-
 	ctx := tracer.ContextWithSpan(context.Background(), span)
-	user, err := handler.Service.AuthenticateUser(tokenString, model.HOST, true, ctx)
-
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user.ToDTO())
+	handler.authoriseRole(w, r, model.HOST, ctx)
 }
 
 func (handler *Handler) FindUser(w http.ResponseWriter, r *http.Request) {
@@ -188,9 +274,34 @@ func (handler *Handler) FindUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if handler.canReadAccount(r, userId, ctx) {
+		json.NewEncoder(w).Encode(user.ToAccountDTO())
+		return
+	}
+
 	json.NewEncoder(w).Encode(user.ToDTO())
 }
 
+// canReadAccount tells whether the caller may see the account state of the
+// user: the owner, callers with user:read:any and the static admin token.
+func (handler *Handler) canReadAccount(r *http.Request, userId uint64, ctx context.Context) bool {
+	if r.Header.Get("X-Admin-Token") != "" {
+		return handler.authenticateAdmin(r) == nil
+	}
+
+	if handler.authenticateAnyUser(r, userId, ctx) == nil {
+		return true
+	}
+
+	tokenString, err := bearerToken(r)
+	if err != nil {
+		return false
+	}
+
+	_, err = handler.Service.AuthorisePermissions(tokenString, []string{model.PERMISSION_USER_READ_ANY}, ctx)
+	return err == nil
+}
+
 func (handler *Handler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	span := tracer.StartSpanFromRequest("deleteUserHandler", handler.Tracer, r)
 	defer span.Finish()
@@ -210,12 +321,15 @@ func (handler *Handler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tokenString := r.Header.Get("Authorization")
-	err = handler.Service.DeleteUser(userId, tokenString, ctx)
+	if !handler.requireStepUp(w, r, service.STEP_UP_DELETE_ACCOUNT, ctx) {
+		return
+	}
+
+	err = handler.Service.DeleteUser(userId, ctx)
 
 	if err != nil {
 		status := http.StatusBadRequest
-		if strings.Contains(err.Error(), "unreachable") {
+		if errors.Is(err, client.ErrServiceUnreachable) {
 			status = http.StatusGatewayTimeout
 		}
 		w.WriteHeader(status)
@@ -226,15 +340,117 @@ func (handler *Handler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// clientInfo describes the caller for session listings and the login
+// throttle. X-Forwarded-For is only trusted from TRUSTED_PROXIES.
+func clientInfo(r *http.Request) model.ClientInfo {
+	ip := util.ClientIP(r.RemoteAddr, r.Header.Values("X-Forwarded-For"))
+
+	userAgent := r.Header.Get("User-Agent")
+	device := r.Header.Get("X-Device-Name")
+	if device == "" {
+		device = util.DeviceFromUserAgent(userAgent)
+	}
+
+	return model.ClientInfo{UserAgent: userAgent, IP: ip, Device: device}
+}
+
+// writeLoginError answers throttled attempts with 429 and a Retry-After
+// header in whole seconds and unverified accounts with 403, every other
+// failure is a plain 401.
+func writeLoginError(w http.ResponseWriter, err error) {
+	if errors.Is(err, service.ErrEmailNotVerified) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusForbidden})
+		return
+	}
+
+	var tooManyAttempts *service.TooManyAttemptsError
+	if errors.As(err, &tooManyAttempts) {
+		retryAfter := int(math.Ceil(tooManyAttempts.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusTooManyRequests})
+		return
+	}
+
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+}
+
+// requireStepUp answers 401 with the step_up_required code when the token
+// is too old for the operation. The frontend then asks for the credentials,
+// calls /api/users/reauthenticate and retries with the token it returns.
+func (handler *Handler) requireStepUp(w http.ResponseWriter, r *http.Request, operation service.SensitiveOperation, ctx context.Context) bool {
+	tokenString, _ := bearerToken(r)
+	err := handler.Service.RequireStepUp(tokenString, operation, ctx)
+	if err == nil {
+		return true
+	}
+
+	var stepUpRequired *service.StepUpRequiredError
+	if errors.As(err, &stepUpRequired) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_user_authentication", error_description="%s", max_age=%d`,
+			err.Error(), int(stepUpRequired.MaxAge.Seconds())))
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized, Code: "step_up_required"})
+		return false
+	}
+
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+	return false
+}
+
+// writeBadRequest answers with 400 and lists the broken field rules when the
+// error carries them.
+func writeBadRequest(w http.ResponseWriter, err error) {
+	errorResponse := model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest}
+
+	var validationErr *service.ValidationError
+	if errors.As(err, &validationErr) {
+		errorResponse.Errors = validationErr.Errors
+	}
+
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(errorResponse)
+}
+
+func bearerToken(r *http.Request) (string, error) {
+	authHeader := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(authHeader) != 2 || !strings.EqualFold(authHeader[0], "Bearer") || authHeader[1] == "" {
+		return "", errors.New("Unauthorised")
+	}
+
+	return authHeader[1], nil
+}
+
 func (handler *Handler) authenticateAnyUser(r *http.Request, userId uint64, ctx context.Context) error {
-	authHeader := r.Header.Values("Authorization")
-	if authHeader == nil {
+	tokenString, err := bearerToken(r)
+	if err != nil {
+		return err
+	}
+
+	user, err := handler.Service.AuthenticateUser(tokenString, model.HOST, false, ctx)
+	if err != nil {
 		return errors.New("Unauthorised")
 	}
 
-	tokenString := strings.Split(authHeader[0], " ")[1]
+	if user.ID != uint(userId) {
+		return errors.New("cannot edit or delete another user")
+	}
+
+	return nil
+}
 
-	user, err := handler.Service.AuthenticateUser(tokenString, model.HOST, false, ctx)
+// authenticatePasswordChange is authenticateAnyUser that also accepts the
+// restricted token issued for an expired password.
+func (handler *Handler) authenticatePasswordChange(r *http.Request, userId uint64, ctx context.Context) error {
+	tokenString, err := bearerToken(r)
+	if err != nil {
+		return err
+	}
+
+	user, err := handler.Service.AuthenticatePasswordChange(tokenString, ctx)
 	if err != nil {
 		return errors.New("Unauthorised")
 	}
@@ -257,7 +473,7 @@ func (handler *Handler) ChangePassword(w http.ResponseWriter, r *http.Request) {
 	userId, _ := strconv.ParseUint(params["id"], 10, 32)
 
 	ctx := tracer.ContextWithSpan(context.Background(), span)
-	err := handler.authenticateAnyUser(r, userId, ctx)
+	err := handler.authenticatePasswordChange(r, userId, ctx)
 	w.Header().Set("Content-Type", "application/json")
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
@@ -265,12 +481,45 @@ func (handler *Handler) ChangePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !handler.requireStepUp(w, r, service.STEP_UP_CHANGE_PASSWORD, ctx) {
+		return
+	}
+
 	var changePasswordDTO model.ChangePasswordDTO
 	json.NewDecoder(r.Body).Decode(&changePasswordDTO)
 
 	ctx = tracer.ContextWithSpan(context.Background(), span)
 	err = handler.Service.ChangePassword(changePasswordDTO, userId, ctx)
 
+	if err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *Handler) LogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("logoutEverywhereHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling logout everywhere at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	err = handler.Service.LogoutEverywhere(userId, ctx)
+
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
@@ -279,3 +528,65 @@ func (handler *Handler) ChangePassword(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+func (handler *Handler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("listSessionsHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling session listing at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	tokenString, _ := bearerToken(r)
+	sessions, err := handler.Service.ListSessions(userId, tokenString, ctx)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func (handler *Handler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("revokeSessionHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling session revocation at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+	sessionId, _ := strconv.ParseUint(params["sessionId"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	err = handler.Service.RevokeSession(userId, sessionId, ctx)
+
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusNotFound})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
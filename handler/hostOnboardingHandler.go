@@ -0,0 +1,225 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+)
+
+func (handler *Handler) HostOnboardingStatus(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("hostOnboardingStatusHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling host onboarding status at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	onboarding, err := handler.Service.HostOnboardingStatus(userId, ctx)
+
+	if err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(onboarding)
+}
+
+func (handler *Handler) StartHostOnboarding(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("startHostOnboardingHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling host onboarding start at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	onboarding, err := handler.Service.StartHostOnboarding(userId, ctx)
+
+	if err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(onboarding)
+}
+
+func (handler *Handler) UpdateHostProfile(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("updateHostProfileHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling host profile update at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	var profileRequest model.HostProfileRequest
+	json.NewDecoder(r.Body).Decode(&profileRequest)
+
+	onboarding, err := handler.Service.UpdateHostProfile(userId, profileRequest, ctx)
+
+	if err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(onboarding)
+}
+
+func (handler *Handler) AcceptHostTerms(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("acceptHostTermsHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling host terms acceptance at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	var termsRequest model.HostTermsRequest
+	json.NewDecoder(r.Body).Decode(&termsRequest)
+
+	onboarding, err := handler.Service.AcceptHostTerms(userId, termsRequest.Version, ctx)
+
+	if err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(onboarding)
+}
+
+func (handler *Handler) SendPhoneCode(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("sendPhoneCodeHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling phone code sending at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	err = handler.Service.SendPhoneCode(userId, ctx)
+
+	if err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *Handler) VerifyPhone(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("verifyPhoneHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling phone verification at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	var codeRequest model.PhoneCodeRequest
+	json.NewDecoder(r.Body).Decode(&codeRequest)
+
+	onboarding, err := handler.Service.VerifyPhone(userId, codeRequest.Code, ctx)
+
+	if err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(onboarding)
+}
+
+func (handler *Handler) CompleteHostOnboarding(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("completeHostOnboardingHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling host onboarding completion at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	user, err := handler.Service.CompleteHostOnboarding(userId, ctx)
+
+	if err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(user.ToAccountDTO())
+}
@@ -0,0 +1,204 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+)
+
+func (handler *Handler) ListIdentities(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("listIdentitiesHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling identity listing at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	json.NewEncoder(w).Encode(handler.Service.ListIdentities(userId, ctx))
+}
+
+func (handler *Handler) LinkPasswordIdentity(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("linkPasswordIdentityHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling password identity linking at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	var linkRequest model.LinkIdentityRequest
+	json.NewDecoder(r.Body).Decode(&linkRequest)
+
+	tokenString, _ := bearerToken(r)
+	identity, err := handler.Service.LinkPasswordIdentity(userId, tokenString, linkRequest.NewPassword, ctx)
+
+	if err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(identity)
+}
+
+func (handler *Handler) LinkMagicLinkIdentity(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("linkMagicLinkIdentityHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling magic link identity linking at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	var linkRequest model.LinkIdentityRequest
+	json.NewDecoder(r.Body).Decode(&linkRequest)
+
+	tokenString, _ := bearerToken(r)
+	identity, err := handler.Service.LinkMagicLinkIdentity(userId, tokenString, linkRequest.Password, ctx)
+
+	// Failed re-authentication counts as a failed login, including throttling.
+	if err != nil {
+		writeLoginError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(identity)
+}
+
+func (handler *Handler) StartIdentityLink(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("startIdentityLinkHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling identity link start at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	var linkRequest model.LinkIdentityRequest
+	json.NewDecoder(r.Body).Decode(&linkRequest)
+
+	tokenString, _ := bearerToken(r)
+	startResponse, err := handler.Service.StartIdentityLink(userId, tokenString, params["provider"], linkRequest.Password, ctx)
+
+	// Failed re-authentication counts as a failed login, including throttling.
+	if err != nil {
+		writeLoginError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(startResponse)
+}
+
+func (handler *Handler) CompleteIdentityLink(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("completeIdentityLinkHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling identity link callback at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	var callbackRequest model.FederatedLoginCallbackRequest
+	json.NewDecoder(r.Body).Decode(&callbackRequest)
+
+	identity, err := handler.Service.CompleteIdentityLink(userId, callbackRequest.State, callbackRequest.Code, ctx)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(identity)
+}
+
+func (handler *Handler) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("unlinkIdentityHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling identity unlinking at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+	identityId, _ := strconv.ParseUint(params["identityId"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	err = handler.Service.UnlinkIdentity(userId, identityId, ctx)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
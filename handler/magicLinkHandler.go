@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/service"
+	"github.com/windbnb/user-service/tracer"
+)
+
+func (handler *Handler) RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("requestMagicLinkHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling magic link request at %s\n", r.URL.Path)),
+	)
+
+	var magicLinkRequest model.MagicLinkRequest
+	json.NewDecoder(r.Body).Decode(&magicLinkRequest)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.Service.RequestMagicLink(magicLinkRequest.Email, clientInfo(r), ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		tracer.LogError(span, err)
+		var tooManyAttempts *service.TooManyAttemptsError
+		if errors.As(err, &tooManyAttempts) {
+			writeLoginError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusInternalServerError})
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (handler *Handler) ConsumeMagicLink(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("consumeMagicLinkHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling magic link login at %s\n", r.URL.Path)),
+	)
+
+	var consumeRequest model.ConsumeMagicLinkRequest
+	json.NewDecoder(r.Body).Decode(&consumeRequest)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	loginResponse, err := handler.Service.ConsumeMagicLink(consumeRequest.Token, clientInfo(r), ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		tracer.LogError(span, err)
+		writeLoginError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(loginResponse)
+}
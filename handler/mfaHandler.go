@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/service"
+	"github.com/windbnb/user-service/tracer"
+)
+
+func (handler *Handler) CompleteMfaLogin(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("completeMfaLoginHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling mfa login at %s\n", r.URL.Path)),
+	)
+
+	var mfaRequest model.MfaLoginRequest
+	json.NewDecoder(r.Body).Decode(&mfaRequest)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	loginResponse, err := handler.Service.CompleteMfaLogin(mfaRequest.ChallengeToken, mfaRequest.Code, clientInfo(r), ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		tracer.LogError(span, err)
+		writeLoginError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(loginResponse)
+}
+
+func (handler *Handler) EnrollTotp(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("enrollTotpHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling totp enrollment at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	if !handler.requireStepUp(w, r, service.STEP_UP_MANAGE_2FA, ctx) {
+		return
+	}
+
+	enrollment, err := handler.Service.EnrollTotp(userId, ctx)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(enrollment)
+}
+
+func (handler *Handler) ConfirmTotp(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("confirmTotpHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling totp confirmation at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	var codeRequest model.TotpCodeRequest
+	json.NewDecoder(r.Body).Decode(&codeRequest)
+
+	err = handler.Service.ConfirmTotp(userId, codeRequest.Code, clientInfo(r), ctx)
+
+	if err != nil {
+		var tooManyAttempts *service.TooManyAttemptsError
+		if errors.As(err, &tooManyAttempts) {
+			writeLoginError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *Handler) DisableTotp(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("disableTotpHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling totp removal at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	if !handler.requireStepUp(w, r, service.STEP_UP_MANAGE_2FA, ctx) {
+		return
+	}
+
+	var codeRequest model.TotpCodeRequest
+	json.NewDecoder(r.Body).Decode(&codeRequest)
+
+	err = handler.Service.DisableTotp(userId, codeRequest.Code, clientInfo(r), ctx)
+
+	if err != nil {
+		var tooManyAttempts *service.TooManyAttemptsError
+		if errors.As(err, &tooManyAttempts) {
+			writeLoginError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,272 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/service"
+	"github.com/windbnb/user-service/tracer"
+)
+
+var consentPage = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in to {{.ClientName}}</title></head>
+<body>
+<h1>{{.ClientName}} wants to access your windbnb account</h1>
+<p>Requested access: {{.Scope}}</p>
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form method="post">
+{{range $name, $value := .Hidden}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}<label>Email <input type="email" name="email" value="{{.Email}}" required></label>
+<label>Password <input type="password" name="password" required></label>
+<label>Verification code, if enabled <input type="text" name="code" autocomplete="one-time-code"></label>
+<button type="submit" name="decision" value="approve">Allow</button>
+<button type="submit" name="decision" value="deny" formnovalidate>Deny</button>
+</form>
+</body>
+</html>
+`))
+
+type consentPageData struct {
+	ClientName string
+	Scope      string
+	Email      string
+	Error      string
+	Hidden     map[string]string
+}
+
+func authorizationRequest(r *http.Request) model.AuthorizationRequest {
+	return model.AuthorizationRequest{
+		ResponseType:        r.FormValue("response_type"),
+		ClientId:            r.FormValue("client_id"),
+		RedirectURI:         r.FormValue("redirect_uri"),
+		Scope:               r.FormValue("scope"),
+		State:               r.FormValue("state"),
+		Nonce:               r.FormValue("nonce"),
+		CodeChallenge:       r.FormValue("code_challenge"),
+		CodeChallengeMethod: r.FormValue("code_challenge_method"),
+	}
+}
+
+func renderConsentPage(w http.ResponseWriter, status int, client model.OAuthClient, request model.AuthorizationRequest, email string, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(status)
+
+	consentPage.Execute(w, consentPageData{
+		ClientName: client.Name,
+		Scope:      request.Scope,
+		Email:      email,
+		Error:      message,
+		Hidden: map[string]string{
+			"response_type":         request.ResponseType,
+			"client_id":             request.ClientId,
+			"redirect_uri":          request.RedirectURI,
+			"scope":                 request.Scope,
+			"state":                 request.State,
+			"nonce":                 request.Nonce,
+			"code_challenge":        request.CodeChallenge,
+			"code_challenge_method": request.CodeChallengeMethod,
+		},
+	})
+}
+
+// handleAuthorizationError redirects errors the client may learn about and
+// answers with a plain 400 when the redirect URI cannot be trusted.
+func handleAuthorizationError(w http.ResponseWriter, r *http.Request, request model.AuthorizationRequest, err error) {
+	var oauthErr *service.OAuthError
+	if errors.As(err, &oauthErr) {
+		http.Redirect(w, r, service.AuthorizationErrorRedirect(request, oauthErr), http.StatusFound)
+		return
+	}
+
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+func (handler *Handler) AuthorizePage(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("authorizePageHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling authorization page at %s\n", r.URL.Path)),
+	)
+
+	request := authorizationRequest(r)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	client, err := handler.Service.ValidateAuthorizationRequest(request, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		handleAuthorizationError(w, r, request, err)
+		return
+	}
+
+	renderConsentPage(w, http.StatusOK, client, request, "", "")
+}
+
+func (handler *Handler) Authorize(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("authorizeHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling authorization at %s\n", r.URL.Path)),
+	)
+
+	request := authorizationRequest(r)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	client, err := handler.Service.ValidateAuthorizationRequest(request, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		handleAuthorizationError(w, r, request, err)
+		return
+	}
+
+	if r.PostFormValue("decision") != "approve" {
+		http.Redirect(w, r, service.AuthorizationErrorRedirect(request, &service.OAuthError{Code: "access_denied", Description: "the user denied the request"}), http.StatusFound)
+		return
+	}
+
+	credentials := model.Credentials{Email: r.PostFormValue("email"), Password: r.PostFormValue("password")}
+	redirectURL, err := handler.Service.Authorize(request, credentials, r.PostFormValue("code"), clientInfo(r), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		renderConsentPage(w, http.StatusUnauthorized, client, request, credentials.Email, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, redirectURL, http.StatusFound)
+}
+
+func writeOAuthError(w http.ResponseWriter, err error) {
+	oauthErr := &service.OAuthError{Code: "server_error", Description: err.Error()}
+	errors.As(err, &oauthErr)
+
+	status := http.StatusBadRequest
+	switch oauthErr.Code {
+	case "invalid_client":
+		w.Header().Set("WWW-Authenticate", `Basic realm="windbnb"`)
+		status = http.StatusUnauthorized
+	case "server_error":
+		status = http.StatusInternalServerError
+	}
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(model.OAuthErrorResponse{Error: oauthErr.Code, ErrorDescription: oauthErr.Description})
+}
+
+// clientCertificateThumbprint is the base64url SHA-256 of the TLS client
+// certificate, empty when the client did not present one.
+func clientCertificateThumbprint(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (handler *Handler) Token(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("tokenHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling token request at %s\n", r.URL.Path)),
+	)
+
+	tokenRequest := model.TokenRequest{
+		GrantType:                   r.PostFormValue("grant_type"),
+		Code:                        r.PostFormValue("code"),
+		RedirectURI:                 r.PostFormValue("redirect_uri"),
+		CodeVerifier:                r.PostFormValue("code_verifier"),
+		RefreshToken:                r.PostFormValue("refresh_token"),
+		Scope:                       r.PostFormValue("scope"),
+		ClientId:                    r.PostFormValue("client_id"),
+		ClientSecret:                r.PostFormValue("client_secret"),
+		ClientCertificateThumbprint: clientCertificateThumbprint(r),
+	}
+	if clientId, clientSecret, ok := r.BasicAuth(); ok {
+		tokenRequest.ClientId, tokenRequest.ClientSecret = clientId, clientSecret
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	tokenResponse, err := handler.Service.Token(tokenRequest, clientInfo(r), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		writeOAuthError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(tokenResponse)
+}
+
+func (handler *Handler) Introspect(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("introspectHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling token introspection at %s\n", r.URL.Path)),
+	)
+
+	introspectionRequest := model.IntrospectionRequest{
+		Token:                       r.PostFormValue("token"),
+		TokenTypeHint:               r.PostFormValue("token_type_hint"),
+		ClientId:                    r.PostFormValue("client_id"),
+		ClientSecret:                r.PostFormValue("client_secret"),
+		ClientCertificateThumbprint: clientCertificateThumbprint(r),
+	}
+	if clientId, clientSecret, ok := r.BasicAuth(); ok {
+		introspectionRequest.ClientId, introspectionRequest.ClientSecret = clientId, clientSecret
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	introspection, err := handler.Service.Introspect(introspectionRequest, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		writeOAuthError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(introspection)
+}
+
+func (handler *Handler) UserInfo(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("userInfoHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling userinfo at %s\n", r.URL.Path)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	tokenString, err := bearerToken(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	userInfo, err := handler.Service.UserInfo(tokenString, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		description := strings.ReplaceAll(err.Error(), `"`, "'")
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description="%s"`, description))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	json.NewEncoder(w).Encode(userInfo)
+}
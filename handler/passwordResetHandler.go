@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/service"
+	"github.com/windbnb/user-service/tracer"
+)
+
+func (handler *Handler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("forgotPasswordHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling forgotten password at %s\n", r.URL.Path)),
+	)
+
+	var forgotRequest model.ForgotPasswordRequest
+	json.NewDecoder(r.Body).Decode(&forgotRequest)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.Service.ForgotPassword(forgotRequest.Email, clientInfo(r), ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		tracer.LogError(span, err)
+		var tooManyAttempts *service.TooManyAttemptsError
+		if errors.As(err, &tooManyAttempts) {
+			writeLoginError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusInternalServerError})
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (handler *Handler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("resetPasswordHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling password reset at %s\n", r.URL.Path)),
+	)
+
+	var resetRequest model.ResetPasswordRequest
+	json.NewDecoder(r.Body).Decode(&resetRequest)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.Service.ResetPassword(resetRequest.Token, resetRequest.NewPassword, ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		tracer.LogError(span, err)
+		writeBadRequest(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+)
+
+func (handler *Handler) ListUserRoles(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("listUserRolesHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling user role listing at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	tokenString, _ := bearerToken(r)
+	roles, err := handler.Service.UserRoles(tokenString, ctx)
+
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	json.NewEncoder(w).Encode(roles)
+}
+
+func (handler *Handler) AddOwnRole(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("addOwnRoleHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling role addition at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	var roleRequest model.RoleRequest
+	json.NewDecoder(r.Body).Decode(&roleRequest)
+
+	user, err := handler.Service.AddOwnRole(userId, roleRequest.Role, ctx)
+
+	if err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user.ToAccountDTO())
+}
+
+func (handler *Handler) SwitchRole(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("switchRoleHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling role switch at %s\n", r.URL.Path)),
+	)
+
+	params := mux.Vars(r)
+	userId, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.authenticateAnyUser(r, userId, ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	var roleRequest model.RoleRequest
+	json.NewDecoder(r.Body).Decode(&roleRequest)
+
+	tokenString, _ := bearerToken(r)
+	loginResponse, err := handler.Service.SwitchRole(tokenString, roleRequest.Role, ctx)
+
+	if err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(loginResponse)
+}
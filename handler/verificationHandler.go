@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/service"
+	"github.com/windbnb/user-service/tracer"
+)
+
+func (handler *Handler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("verifyEmailHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling email verification at %s\n", r.URL.Path)),
+	)
+
+	var verifyRequest model.VerifyEmailRequest
+	json.NewDecoder(r.Body).Decode(&verifyRequest)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.Service.VerifyEmail(verifyRequest.Token, ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		tracer.LogError(span, err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *Handler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	span := tracer.StartSpanFromRequest("resendVerificationHandler", handler.Tracer, r)
+	defer span.Finish()
+	span.LogFields(
+		tracer.LogString("handler", fmt.Sprintf("handling verification resend at %s\n", r.URL.Path)),
+	)
+
+	var resendRequest model.ResendVerificationRequest
+	json.NewDecoder(r.Body).Decode(&resendRequest)
+
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	err := handler.Service.ResendVerification(resendRequest.Email, clientInfo(r), ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		tracer.LogError(span, err)
+		var tooManyAttempts *service.TooManyAttemptsError
+		if errors.As(err, &tooManyAttempts) {
+			writeLoginError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Message: err.Error(), StatusCode: http.StatusInternalServerError})
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
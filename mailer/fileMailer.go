@@ -0,0 +1,37 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileMailer writes every message as an .eml file instead of sending it,
+// it stands in for a mail server during local development.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (mailer *FileMailer) Send(message Message) error {
+	if strings.ContainsAny(message.To+message.Subject, "\r\n") {
+		return errors.New("invalid message header")
+	}
+
+	if err := os.MkdirAll(mailer.Dir, 0700); err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+
+	name := time.Now().UTC().Format("20060102T150405.000000000") + "-" + hex.EncodeToString(suffix) + ".eml"
+
+	return os.WriteFile(filepath.Join(mailer.Dir, name), formatMessage(mailer.From, message), 0600)
+}
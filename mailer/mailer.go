@@ -0,0 +1,58 @@
+package mailer
+
+import (
+	"os"
+	"strings"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional email such as password reset links.
+type Mailer interface {
+	Send(message Message) error
+}
+
+// NewMailer picks the transport from MAILER_TRANSPORT. "smtp" relays through
+// SMTP_HOST, anything else writes messages to MAIL_OUTBOX_DIR so that local
+// setups work without a mail server.
+func NewMailer() Mailer {
+	from, fromFound := os.LookupEnv("MAIL_FROM")
+	if !fromFound {
+		from = "no-reply@windbnb.com"
+	}
+
+	transport, _ := os.LookupEnv("MAILER_TRANSPORT")
+	if strings.ToLower(transport) == "smtp" {
+		return &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+	}
+
+	outboxDir, outboxDirFound := os.LookupEnv("MAIL_OUTBOX_DIR")
+	if !outboxDirFound {
+		outboxDir = "mail"
+	}
+
+	return &FileMailer{Dir: outboxDir, From: from}
+}
+
+func formatMessage(from string, message Message) []byte {
+	var builder strings.Builder
+	builder.WriteString("From: " + from + "\r\n")
+	builder.WriteString("To: " + message.To + "\r\n")
+	builder.WriteString("Subject: " + message.Subject + "\r\n")
+	builder.WriteString("MIME-Version: 1.0\r\n")
+	builder.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	builder.WriteString("\r\n")
+	builder.WriteString(strings.ReplaceAll(message.Body, "\n", "\r\n"))
+
+	return []byte(builder.String())
+}
@@ -0,0 +1,38 @@
+package mailer
+
+import (
+	"errors"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (mailer *SMTPMailer) Send(message Message) error {
+	if mailer.Host == "" {
+		return errors.New("smtp host is not configured")
+	}
+
+	if strings.ContainsAny(message.To+message.Subject, "\r\n") {
+		return errors.New("invalid message header")
+	}
+
+	port := mailer.Port
+	if port == "" {
+		port = "25"
+	}
+
+	var auth smtp.Auth
+	if mailer.Username != "" {
+		auth = smtp.PlainAuth("", mailer.Username, mailer.Password, mailer.Host)
+	}
+
+	return smtp.SendMail(net.JoinHostPort(mailer.Host, port), auth, mailer.From, []string{message.To}, formatMessage(mailer.From, message))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"log"
 	"net/http"
 	"os"
@@ -13,30 +14,44 @@ import (
 	"github.com/rs/cors"
 	"github.com/windbnb/user-service/cronUtil"
 	handler "github.com/windbnb/user-service/handler"
+	"github.com/windbnb/user-service/mailer"
 	repository "github.com/windbnb/user-service/repository"
 	router "github.com/windbnb/user-service/router"
 	service "github.com/windbnb/user-service/service"
+	"github.com/windbnb/user-service/sms"
 	"github.com/windbnb/user-service/tracer"
 	util "github.com/windbnb/user-service/util"
 )
 
 func main() {
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 
 	db := util.ConnectToDatabase()
-	service.InitJWTKey()
+	keyRing, err := service.LoadKeyRing()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	repo := &repository.Repository{Db: db}
+
+	userService := &service.UserService{
+		Keys:           keyRing,
+		Revocations:    service.NewRevocationStore(repo),
+		Hasher:         util.NewPasswordHasher(),
+		Mailer:         mailer.NewMailer(),
+		PasswordPolicy: util.NewPasswordPolicy(),
+		SMS:            sms.NewSender(),
+		Repo:           repo}
 
 	tracer, closer := tracer.Init("user-service")
 	opentracing.SetGlobalTracer(tracer)
 	router := router.ConfigureRouter(&handler.Handler{
-		Tracer: tracer,
-		Closer: closer,
-		Service: &service.UserService{
-			Repo: &repository.Repository{
-				Db: db}}})
+		Tracer:  tracer,
+		Closer:  closer,
+		Service: userService})
 
-	cronUtil.ConfigureCronJobs(db)
+	cronUtil.ConfigureCronJobs(db, userService)
 
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:3005"},
@@ -53,9 +68,23 @@ func main() {
 
 	srv := &http.Server{Addr: servicePath, Handler: c.Handler(router)}
 
+	// With a certificate the service serves TLS and asks for client
+	// certificates. They are not checked against a CA, service clients are
+	// identified by the certificate thumbprint registered for them.
+	certFile, certFileFound := os.LookupEnv("TLS_CERT_FILE")
+	keyFile, keyFileFound := os.LookupEnv("TLS_KEY_FILE")
+	useTLS := certFileFound && keyFileFound
+	if useTLS {
+		srv.TLSConfig = &tls.Config{ClientAuth: tls.RequestClientCert}
+	}
+
 	go func() {
 		log.Println("server starting")
-		if err := srv.ListenAndServe(); err != nil {
+		serve := srv.ListenAndServe
+		if useTLS {
+			serve = func() error { return srv.ListenAndServeTLS(certFile, keyFile) }
+		}
+		if err := serve(); err != nil {
 			if err != http.ErrServerClosed {
 				log.Fatal(err)
 			}
@@ -64,8 +64,32 @@ var (
 		},
 		[]string{"visitor"})
 
+	loginFailuresCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "login_failures_total",
+			Help: "Counter for failed login attempts by login method.",
+		},
+		[]string{"method"})
+
+	loginThrottledCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "login_throttled_total",
+			Help: "Counter for login attempts rejected because of backoff or lockout.",
+		},
+		[]string{"method"})
+
+	loginLockoutsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "login_lockouts_total",
+			Help: "Counter for temporary lockouts by scope (account or ip).",
+		},
+		[]string{"scope"})
+
 	// Add all metrics that will be resisted
 	metricsList = []prometheus.Collector{
+		loginFailuresCounter,
+		loginThrottledCounter,
+		loginLockoutsCounter,
 		httpHits,
 		httpHitsSuccess,
 		httpHitsFailed,
@@ -117,3 +141,15 @@ func MetricProxy(f func(http.ResponseWriter, *http.Request)) func(http.ResponseW
 		}
 	}
 }
+
+func LoginFailed(method string) {
+	loginFailuresCounter.WithLabelValues(method).Inc()
+}
+
+func LoginThrottled(method string) {
+	loginThrottledCounter.WithLabelValues(method).Inc()
+}
+
+func LoginLockedOut(scope string) {
+	loginLockoutsCounter.WithLabelValues(scope).Inc()
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -39,25 +40,93 @@ type UserResponseDTO struct {
 	ReservationStatusChangedNotification bool     `json:"reservationStatusChangedNotification"`
 }
 
+// AccountDTO is the user as the account owner and admins see it, with the
+// state of the account that UserResponseDTO keeps from everybody else.
+type AccountDTO struct {
+	UserResponseDTO
+	Suspended        bool   `json:"suspended"`
+	TwoFactorEnabled bool   `json:"twoFactorEnabled"`
+	Verified         bool   `json:"verified"`
+	PendingEmail     string `json:"pendingEmail,omitempty"`
+	Phone            string `json:"phone,omitempty"`
+	PhoneVerified    bool   `json:"phoneVerified"`
+}
+
 type Credentials struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
 }
 
 type Claims struct {
-	Email string   `json:"email"`
-	Role  UserRole `json:"role"`
-	Id    uint     `json:"id"`
+	Email         string   `json:"email"`
+	Role          UserRole `json:"role"`
+	Id            uint     `json:"id"`
+	TokenVersion  uint     `json:"ver"`
+	SessionId     uint     `json:"sid"`
+	EmailVerified bool     `json:"email_verified"`
+	ClientId      string   `json:"client_id,omitempty"`
+	Scope         string   `json:"scope,omitempty"`
+	Purpose       string   `json:"purpose,omitempty"`
+	// AuthTime is when the user last proved who they are, refreshing the
+	// access token keeps it.
+	AuthTime int64 `json:"auth_time,omitempty"`
 	jwt.StandardClaims
 }
 
 type ErrorResponse struct {
-	Message    string `json:"message"`
-	StatusCode int    `json:"statusCode"`
+	Message    string       `json:"message"`
+	StatusCode int          `json:"statusCode"`
+	Code       string       `json:"code,omitempty"`
+	Errors     []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError describes one rule a request field broke. Code is stable for
+// clients to translate, Message is a readable English fallback.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
+type LoginStatus string
+
+const (
+	LOGIN_SUCCESS      LoginStatus = "success"
+	LOGIN_MFA_REQUIRED LoginStatus = "mfa_required"
+	// LOGIN_PASSWORD_CHANGE_REQUIRED comes with a restricted token that is
+	// only accepted by the change-password endpoint.
+	LOGIN_PASSWORD_CHANGE_REQUIRED LoginStatus = "password_change_required"
+)
+
 type LoginResponse struct {
-	Token string `json:"token"`
+	Status         LoginStatus `json:"status"`
+	Token          string      `json:"token,omitempty"`
+	RefreshToken   string      `json:"refreshToken,omitempty"`
+	ExpiresIn      int64       `json:"expiresIn,omitempty"`
+	ChallengeToken string      `json:"challengeToken,omitempty"`
+}
+
+type MfaLoginRequest struct {
+	ChallengeToken string `json:"challengeToken"`
+	Code           string `json:"code"`
+}
+
+type TotpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type TotpEnrollmentResponse struct {
+	Secret        string   `json:"secret"`
+	OtpauthURI    string   `json:"otpauthUri"`
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refreshToken"`
 }
 
 type CreateUserRequest struct {
@@ -97,3 +166,343 @@ type ChangePasswordDTO struct {
 	OldPassword string `json:"oldPassword"`
 	NewPassword string `json:"newPassword"`
 }
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+type EmailChangeTokenRequest struct {
+	Token string `json:"token"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type MagicLinkRequest struct {
+	Email string `json:"email"`
+}
+
+type ConsumeMagicLinkRequest struct {
+	Token string `json:"token"`
+}
+
+// StepUpRequest confirms the identity of a signed in user again. Code is only
+// needed when two factor authentication is enabled.
+type StepUpRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+type OAuthClientDTO struct {
+	ClientId              string    `json:"clientId"`
+	ClientSecret          string    `json:"clientSecret,omitempty"`
+	Name                  string    `json:"name"`
+	RedirectURIs          []string  `json:"redirectUris"`
+	Scopes                []string  `json:"scopes"`
+	Public                bool      `json:"public"`
+	Service               bool      `json:"service"`
+	CertificateThumbprint string    `json:"certificateThumbprint,omitempty"`
+	CreatedAt             time.Time `json:"createdAt"`
+}
+
+type RegisterOAuthClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirectUris"`
+	Scopes       []string `json:"scopes"`
+	Public       bool     `json:"public"`
+	// Service registers another windbnb service for the client_credentials
+	// grant. It authenticates with the certificate whose SHA-256 thumbprint
+	// is given, or with a secret when there is none.
+	Service               bool   `json:"service"`
+	CertificateThumbprint string `json:"certificateThumbprint"`
+}
+
+// AuthorizationRequest holds the query of an authorization code request.
+type AuthorizationRequest struct {
+	ResponseType        string
+	ClientId            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// TokenRequest holds the form of a token endpoint request.
+type TokenRequest struct {
+	GrantType    string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+	RefreshToken string
+	Scope        string
+	ClientId     string
+	ClientSecret string
+	// ClientCertificateThumbprint is set when the client presented a TLS
+	// certificate.
+	ClientCertificateThumbprint string
+}
+
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IdToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// IntrospectionRequest holds the form of a token introspection request.
+type IntrospectionRequest struct {
+	Token                       string
+	TokenTypeHint               string
+	ClientId                    string
+	ClientSecret                string
+	ClientCertificateThumbprint string
+}
+
+// IntrospectionResponse follows RFC 7662, an inactive token only carries
+// active set to false. Role, sid and email_verified are windbnb extensions.
+type IntrospectionResponse struct {
+	Active        bool     `json:"active"`
+	Scope         string   `json:"scope,omitempty"`
+	ClientId      string   `json:"client_id,omitempty"`
+	TokenType     string   `json:"token_type,omitempty"`
+	Exp           int64    `json:"exp,omitempty"`
+	Iat           int64    `json:"iat,omitempty"`
+	Sub           string   `json:"sub,omitempty"`
+	Iss           string   `json:"iss,omitempty"`
+	Jti           string   `json:"jti,omitempty"`
+	Role          UserRole `json:"role,omitempty"`
+	SessionId     uint     `json:"sid,omitempty"`
+	EmailVerified bool     `json:"email_verified,omitempty"`
+	AuthTime      int64    `json:"auth_time,omitempty"`
+}
+
+type OAuthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// IdTokenClaims are the access token claims plus the OpenID Connect ones,
+// iss, sub, aud, exp and iat live in the standard claims.
+type IdTokenClaims struct {
+	Claims
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// UserInfoResponse is the OpenID Connect userinfo document. Only sub is
+// always present, the other claims depend on the granted scopes.
+type UserInfoResponse struct {
+	Sub               string `json:"sub"`
+	Name              string `json:"name,omitempty"`
+	GivenName         string `json:"given_name,omitempty"`
+	FamilyName        string `json:"family_name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Email             string `json:"email,omitempty"`
+	EmailVerified     *bool  `json:"email_verified,omitempty"`
+}
+
+type RotateSigningKeyRequest struct {
+	Algorithm string `json:"algorithm"`
+}
+
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	JwksURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	IntrospectionEndpointAuthMethods  []string `json:"introspection_endpoint_auth_methods_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IdTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// ClientInfo describes the device a login request came from.
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+	Device    string
+}
+
+type SessionDTO struct {
+	Id         uint      `json:"id"`
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	Current    bool      `json:"current"`
+}
+
+type FederatedLoginStartResponse struct {
+	AuthorizationURL string `json:"authorizationUrl"`
+}
+
+type FederatedLoginCallbackRequest struct {
+	State string `json:"state"`
+	Code  string `json:"code"`
+}
+
+type UserIdentityDTO struct {
+	Id         uint       `json:"id"`
+	Provider   string     `json:"provider"`
+	Email      string     `json:"email,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// LinkIdentityRequest re-authenticates the user before an identity is
+// linked. Password is the current password, NewPassword the one to link.
+type LinkIdentityRequest struct {
+	Password    string `json:"password"`
+	NewPassword string `json:"newPassword"`
+}
+
+type RoleDTO struct {
+	Name        UserRole `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Permissions []string `json:"permissions"`
+}
+
+type RoleRequest struct {
+	Role UserRole `json:"role"`
+}
+
+// UserRolesResponse lists the roles of a user, Active is the role of the
+// session asking.
+type UserRolesResponse struct {
+	Active UserRole   `json:"active"`
+	Roles  []UserRole `json:"roles"`
+}
+
+// HostOnboardingResponse is the state of host onboarding, Missing lists the
+// requirements still open. TermsVersion is the version of the host terms to
+// accept.
+type HostOnboardingResponse struct {
+	State        HostOnboardingState `json:"state"`
+	Missing      []string            `json:"missing"`
+	TermsVersion string              `json:"termsVersion"`
+}
+
+// HostProfileRequest fills in the profile fields a host needs.
+type HostProfileRequest struct {
+	Name    string `json:"name"`
+	Surname string `json:"surname"`
+	Address string `json:"address"`
+	Phone   string `json:"phone"`
+}
+
+type HostTermsRequest struct {
+	Version string `json:"version"`
+}
+
+type PhoneCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// HostOnboardedEvent is the data of the host.onboarded event.
+type HostOnboardedEvent struct {
+	UserId      uint      `json:"userId"`
+	Email       string    `json:"email"`
+	Name        string    `json:"name"`
+	Surname     string    `json:"surname"`
+	Address     string    `json:"address"`
+	Phone       string    `json:"phone"`
+	OnboardedAt time.Time `json:"onboardedAt"`
+}
+
+// EventEnvelope is how outbox events are delivered. Id identifies the event
+// across redeliveries.
+type EventEnvelope struct {
+	Id         uint            `json:"id"`
+	Type       string          `json:"type"`
+	OccurredAt time.Time       `json:"occurredAt"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// UserListRequest holds the query parameters of the admin user listing as
+// they were sent.
+type UserListRequest struct {
+	Role        string
+	CreatedFrom string
+	CreatedTo   string
+	Verified    string
+	Suspended   string
+	Search      string
+	Sort        string
+	Cursor      string
+	Limit       string
+}
+
+// UserCursor is the position after the last user of a page: the value of the
+// sort field and the id, which breaks ties.
+type UserCursor struct {
+	Sort  string `json:"sort"`
+	Value string `json:"value"`
+	Id    uint   `json:"id"`
+}
+
+// UserQuery filters, sorts and pages users. Nil and empty fields do not
+// filter. SortField is a column of the users table, a page starts after the
+// user with AfterId and AfterValue in that column when AfterId is set.
+type UserQuery struct {
+	Role        UserRole
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	Verified    *bool
+	Suspended   *bool
+	Search      string
+	SortField   string
+	Descending  bool
+	AfterValue  interface{}
+	AfterId     uint
+	Limit       int
+}
+
+type AdminUserDTO struct {
+	AccountDTO
+	Roles     []UserRole `json:"roles"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// UserListResponse is one page of users, NextCursor is empty on the last
+// page.
+type UserListResponse struct {
+	Users      []AdminUserDTO `json:"users"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
@@ -1,6 +1,9 @@
 package model
 
 import (
+	"strings"
+	"time"
+
 	"github.com/jinzhu/gorm"
 )
 
@@ -9,8 +12,56 @@ type UserRole string
 const (
 	HOST  UserRole = "HOST"
 	GUEST UserRole = "GUEST"
+	// Staff roles are never picked at registration, an admin assigns them.
+	ADMIN   UserRole = "ADMIN"
+	SUPPORT UserRole = "SUPPORT"
+)
+
+// Permissions granted through roles. They are put into the scope claim of
+// first party access tokens and checked per route.
+const (
+	PERMISSION_USER_READ_ANY       = "user:read:any"
+	PERMISSION_USER_SUSPEND        = "user:suspend"
+	PERMISSION_USER_UNLOCK         = "user:unlock"
+	PERMISSION_USER_ASSIGN_ROLE    = "user:role:assign"
+	PERMISSION_OAUTH_CLIENT_MANAGE = "oauth_client:manage"
+	PERMISSION_SIGNING_KEY_MANAGE  = "signing_key:manage"
+)
+
+// HostOnboardingState is how far a guest got on the way to becoming a host.
+// It only moves forward, NOT_STARTED to IN_PROGRESS to COMPLETED.
+type HostOnboardingState string
+
+const (
+	HOST_ONBOARDING_NOT_STARTED HostOnboardingState = "NOT_STARTED"
+	HOST_ONBOARDING_IN_PROGRESS HostOnboardingState = "IN_PROGRESS"
+	HOST_ONBOARDING_COMPLETED   HostOnboardingState = "COMPLETED"
+)
+
+// Requirements of host onboarding, listed while they are missing.
+const (
+	HOST_REQUIREMENT_PROFILE        = "PROFILE"
+	HOST_REQUIREMENT_TERMS          = "HOST_TERMS"
+	HOST_REQUIREMENT_EMAIL_VERIFIED = "EMAIL_VERIFIED"
+	HOST_REQUIREMENT_PHONE_VERIFIED = "PHONE_VERIFIED"
 )
 
+// Types of the events in the outbox.
+const (
+	EVENT_HOST_ONBOARDED = "host.onboarded"
+)
+
+// Identity providers that are not external OpenID Connect issuers, those use
+// their configured name.
+const (
+	PASSWORD_IDENTITY   = "password"
+	MAGIC_LINK_IDENTITY = "magic_link"
+)
+
+// EmailIdentityProviders are keyed by the email address and follow it when
+// the user changes their email.
+var EmailIdentityProviders = []string{PASSWORD_IDENTITY, MAGIC_LINK_IDENTITY}
+
 type User struct {
 	gorm.Model
 	Email string `gorm:"not null;default:null;unique_index"`
@@ -18,13 +69,32 @@ type User struct {
 	Password string `gorm:"not null;default:null"`
 	Name string `gorm:"not null;default:null"`
 	Surname string `gorm:"not null;default:null"`
-	Address string `gorm:"not null;default:null"`
+	// Address is empty for accounts provisioned by an identity provider
+	// until the user fills it in.
+	Address string `gorm:"not null;default:''"`
+	// Role is the role new sessions start in, RoleAssignment holds every role
+	// of the user.
 	Role UserRole `gorm:"not null;default:null"`
 	ReservationRequestNotification bool `gorm:"not null;default:false"`
 	ReservationCanceledNotification bool `gorm:"not null;default:false"`
 	SelfReviewNotification bool `gorm:"not null;default:false"`
 	AccomodationReviewNotification bool `gorm:"not null;default:false"`
 	ReservationStatusChangedNotification bool `gorm:"not null;default:false"`
+	TokenVersion uint `gorm:"not null;default:0"`
+	Suspended bool `gorm:"not null;default:false"`
+	TotpSecret string
+	TotpEnabled bool `gorm:"not null;default:false"`
+	TotpLastStep int64 `gorm:"not null;default:0"`
+	Verified bool `gorm:"not null;default:false"`
+	VerificationSentAt *time.Time
+	PendingEmail string
+	PasswordChangedAt *time.Time
+	// Phone is in E.164 form, changing it clears PhoneVerified.
+	Phone string `gorm:"not null;default:''"`
+	PhoneVerified bool `gorm:"not null;default:false"`
+	HostOnboarding HostOnboardingState `gorm:"not null;default:'NOT_STARTED'"`
+	HostTermsVersion string
+	HostTermsAcceptedAt *time.Time
 }
 
 func (user *User) ToDTO() UserResponseDTO {
@@ -36,7 +106,249 @@ func (user *User) ToDTO() UserResponseDTO {
 							ReservationStatusChangedNotification: user.ReservationStatusChangedNotification}
 }
 
+// NotificationColumns are the notification preferences of a user, updates
+// of them write only these columns.
+var NotificationColumns = []string{"reservation_request_notification", "reservation_canceled_notification", "self_review_notification",
+	"accomodation_review_notification", "reservation_status_changed_notification"}
+
+// ToAccountDTO is only for the account owner and admins, anybody else gets
+// ToDTO.
+func (user *User) ToAccountDTO() AccountDTO {
+	return AccountDTO{UserResponseDTO: user.ToDTO(),
+							Suspended: user.Suspended,
+							TwoFactorEnabled: user.TotpEnabled,
+							Verified: user.Verified,
+							PendingEmail: user.PendingEmail,
+							Phone: user.Phone,
+							PhoneVerified: user.PhoneVerified}
+}
+
 type UserDeletionEvent struct {
 	gorm.Model
 	UserId uint64 `gorm:"not null;default:null"`
 }
+
+type RefreshToken struct {
+	gorm.Model
+	UserId uint `gorm:"not null;index"`
+	SessionId uint `gorm:"not null;index"`
+	FamilyId string `gorm:"not null;index"`
+	TokenHash string `gorm:"not null;unique_index"`
+	ExpiresAt time.Time `gorm:"not null"`
+	RotatedAt *time.Time
+	RevokedAt *time.Time
+}
+
+type RevokedToken struct {
+	gorm.Model
+	Jti string `gorm:"not null;unique_index"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+type Session struct {
+	gorm.Model
+	UserId uint `gorm:"not null;index"`
+	Device string
+	UserAgent string
+	IP string
+	ClientId string `gorm:"not null;default:''"`
+	Scope string
+	// Role is the active role of the session, switching roles changes it.
+	Role UserRole
+	LastSeenAt time.Time `gorm:"not null"`
+	RevokedAt *time.Time
+}
+
+func (session *Session) ToDTO(currentSessionId uint) SessionDTO {
+	return SessionDTO{Id: session.ID, Device: session.Device, UserAgent: session.UserAgent, IP: session.IP,
+		CreatedAt: session.CreatedAt, LastSeenAt: session.LastSeenAt, Current: session.ID == currentSessionId}
+}
+
+type RecoveryCode struct {
+	gorm.Model
+	UserId uint `gorm:"not null;index"`
+	CodeHash string `gorm:"not null"`
+	UsedAt *time.Time
+}
+
+// PasswordResetToken stores only the hash of the emailed token.
+type PasswordResetToken struct {
+	gorm.Model
+	UserId uint `gorm:"not null;index"`
+	TokenHash string `gorm:"not null;unique_index"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt *time.Time
+}
+
+// EmailChange is a requested switch to NewEmail. The confirm token is mailed
+// to the new address, the revert token to the old one.
+type EmailChange struct {
+	gorm.Model
+	UserId uint `gorm:"not null;index"`
+	OldEmail string `gorm:"not null"`
+	NewEmail string `gorm:"not null"`
+	ConfirmTokenHash string `gorm:"not null;unique_index"`
+	RevertTokenHash string `gorm:"not null;unique_index"`
+	ExpiresAt time.Time `gorm:"not null"`
+	RevertExpiresAt time.Time `gorm:"not null"`
+	ConfirmedAt *time.Time
+	RevertedAt *time.Time
+}
+
+// PhoneVerification is a code texted to Phone, only its hash is stored.
+// Attempts counts the codes tried against it.
+type PhoneVerification struct {
+	gorm.Model
+	UserId uint `gorm:"not null;index"`
+	Phone string `gorm:"not null"`
+	CodeHash string `gorm:"not null"`
+	Attempts int `gorm:"not null;default:0"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt *time.Time
+}
+
+// PasswordHistory keeps hashes of passwords a user had before, to block
+// their reuse.
+type PasswordHistory struct {
+	gorm.Model
+	UserId uint `gorm:"not null;index"`
+	PasswordHash string `gorm:"not null"`
+}
+
+// OAuthClient is a registered OAuth 2.1 client. Public clients, such as the
+// mobile app, have no secret and rely on PKCE alone. RedirectURIs and Scopes
+// are space separated.
+type OAuthClient struct {
+	gorm.Model
+	ClientId string `gorm:"not null;unique_index"`
+	ClientSecretHash string
+	Name string `gorm:"not null"`
+	RedirectURIs string `gorm:"not null"`
+	Scopes string `gorm:"not null"`
+	Public bool `gorm:"not null;default:false"`
+	// Service clients are other windbnb services, they only use the
+	// client_credentials grant and never act for a user.
+	Service bool `gorm:"not null;default:false"`
+	// CertificateThumbprint pins the TLS client certificate of a client that
+	// authenticates with mTLS instead of a secret.
+	CertificateThumbprint string
+}
+
+// TableName keeps gorm from naming the table o_auth_clients.
+func (OAuthClient) TableName() string {
+	return "oauth_clients"
+}
+
+func (client *OAuthClient) ToDTO() OAuthClientDTO {
+	return OAuthClientDTO{ClientId: client.ClientId, Name: client.Name, RedirectURIs: strings.Fields(client.RedirectURIs),
+		Scopes: strings.Fields(client.Scopes), Public: client.Public, Service: client.Service,
+		CertificateThumbprint: client.CertificateThumbprint, CreatedAt: client.CreatedAt}
+}
+
+// AuthorizationCode is a single use code of the authorization code flow,
+// bound to the client, redirect URI and PKCE challenge it was issued for.
+type AuthorizationCode struct {
+	gorm.Model
+	CodeHash string `gorm:"not null;unique_index"`
+	ClientId string `gorm:"not null"`
+	UserId uint `gorm:"not null"`
+	RedirectURI string `gorm:"not null"`
+	Scope string
+	Nonce string
+	CodeChallenge string `gorm:"not null"`
+	AuthTime time.Time `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt *time.Time
+	SessionId uint
+}
+
+// UserIdentity is one way of signing in to an account: the password or a
+// magic link, keyed by the lower case email, or an external provider, keyed
+// by its subject.
+type UserIdentity struct {
+	gorm.Model
+	UserId uint `gorm:"not null;index"`
+	Provider string `gorm:"not null;unique_index:idx_user_identity_provider_subject"`
+	Subject string `gorm:"not null;unique_index:idx_user_identity_provider_subject"`
+	Email string
+	LastUsedAt *time.Time
+}
+
+func (identity *UserIdentity) ToDTO() UserIdentityDTO {
+	return UserIdentityDTO{Id: identity.ID, Provider: identity.Provider, Email: identity.Email, CreatedAt: identity.CreatedAt, LastUsedAt: identity.LastUsedAt}
+}
+
+// IdentitySubject is the subject of email keyed identities.
+func IdentitySubject(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// EmailIdentity is the identity of the given email keyed provider for user.
+func EmailIdentity(provider string, user User) UserIdentity {
+	return UserIdentity{UserId: user.ID, Provider: provider, Subject: IdentitySubject(user.Email), Email: user.Email}
+}
+
+// FederatedLoginState remembers an authorization request sent to an external
+// identity provider until its callback. The state is stored hashed, the
+// nonce and PKCE verifier never leave the server.
+type FederatedLoginState struct {
+	gorm.Model
+	StateHash string `gorm:"not null;unique_index"`
+	Provider string `gorm:"not null"`
+	Nonce string `gorm:"not null"`
+	CodeVerifier string `gorm:"not null"`
+	// LinkUserId is set when the login links a provider to a signed in user.
+	LinkUserId uint
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+// LoginThrottle counts recent failed logins for an account ("account:<email>")
+// or a source address ("ip:<address>").
+type LoginThrottle struct {
+	gorm.Model
+	ThrottleKey string `gorm:"not null;unique_index"`
+	Failures int `gorm:"not null;default:0"`
+	LastFailureAt time.Time `gorm:"not null"`
+	LockedUntil *time.Time
+}
+
+// Role is a role users can hold. Only roles stored here can be assigned.
+type Role struct {
+	gorm.Model
+	Name UserRole `gorm:"not null;unique_index"`
+	Description string
+	Permissions []Permission `gorm:"many2many:role_permissions"`
+}
+
+// RoleAssignment is a role held by a user.
+type RoleAssignment struct {
+	gorm.Model
+	UserId uint `gorm:"not null;unique_index:idx_role_assignment_user_role"`
+	Role UserRole `gorm:"not null;unique_index:idx_role_assignment_user_role"`
+}
+
+type Permission struct {
+	gorm.Model
+	Name string `gorm:"not null;unique_index"`
+	Description string
+}
+
+func (role *Role) ToDTO() RoleDTO {
+	permissions := []string{}
+	for _, permission := range role.Permissions {
+		permissions = append(permissions, permission.Name)
+	}
+
+	return RoleDTO{Name: role.Name, Description: role.Description, Permissions: permissions}
+}
+
+// OutboxEvent is an event for other services. It is written in the
+// transaction of the change it announces and a cron job delivers it until
+// delivery succeeds. Payload is the JSON of the event data.
+type OutboxEvent struct {
+	gorm.Model
+	Type string `gorm:"not null"`
+	Payload string `gorm:"not null"`
+	Attempts int `gorm:"not null;default:0"`
+	DeliveredAt *time.Time `gorm:"index"`
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/windbnb/user-service/model"
@@ -11,26 +13,93 @@ import (
 )
 
 type IRepository interface {
-	CheckCredentials(email, password string, ctx context.Context) (model.User, error)
-	CreateUser(user model.User, ctx context.Context) (model.User, error)
+	FindUserByEmail(email string, ctx context.Context) (model.User, error)
+	CreateUser(user model.User, identities []model.UserIdentity, ctx context.Context) (model.User, error)
 	FindUserById(id uint64, ctx context.Context) (model.User, error)
-	SaveUser(user model.User, ctx context.Context) (model.User, error)
+	UpdateUser(user model.User, columns []string, ctx context.Context) (model.User, error)
 	SaveUserDeletionEvent(userId uint64, ctx context.Context)
 	DeleteUser(userId uint64, ctx context.Context) error
 	FindUserByUsername(username string, ctx context.Context) model.User
+	CreateRefreshToken(refreshToken model.RefreshToken, ctx context.Context) (model.RefreshToken, error)
+	FindRefreshTokenByHash(tokenHash string, ctx context.Context) (model.RefreshToken, error)
+	MarkRefreshTokenRotated(id uint, ctx context.Context) (bool, error)
+	RevokeRefreshTokenFamily(familyId string, ctx context.Context) error
+	RevokeRefreshTokensForUser(userId uint, ctx context.Context) error
+	IncrementTokenVersion(userId uint, ctx context.Context) error
+	CreateSession(session model.Session, ctx context.Context) (model.Session, error)
+	FindSessionById(id uint, ctx context.Context) (model.Session, error)
+	FindActiveSessionsByUser(userId uint, ctx context.Context) []model.Session
+	TouchSession(id uint, lastSeenAt time.Time, ctx context.Context) error
+	RevokeSession(id uint, ctx context.Context) error
+	RevokeSessionsForUser(userId uint, ctx context.Context) error
+	UpdateTotpLastStep(userId uint, step int64, ctx context.Context) (bool, error)
+	ReplaceRecoveryCodes(userId uint, recoveryCodes []model.RecoveryCode, ctx context.Context) error
+	FindUnusedRecoveryCodes(userId uint, ctx context.Context) []model.RecoveryCode
+	MarkRecoveryCodeUsed(id uint, ctx context.Context) (bool, error)
+	FindLoginThrottle(throttleKey string, ctx context.Context) model.LoginThrottle
+	RecordLoginFailure(throttleKey string, window time.Duration, ctx context.Context) (model.LoginThrottle, error)
+	LockLoginThrottle(throttleKey string, lockedUntil time.Time, ctx context.Context) error
+	DeleteLoginThrottle(throttleKey string, ctx context.Context) error
+	ReserveVerificationEmail(userId uint, sentBefore time.Time, ctx context.Context) (bool, error)
+	MarkUserVerified(userId uint, email string, ctx context.Context) error
+	CreateEmailChange(emailChange model.EmailChange, ctx context.Context) (model.EmailChange, error)
+	FindEmailChangeByConfirmHash(tokenHash string, ctx context.Context) (model.EmailChange, error)
+	FindEmailChangeByRevertHash(tokenHash string, ctx context.Context) (model.EmailChange, error)
+	MarkEmailChangeConfirmed(id uint, ctx context.Context) (bool, error)
+	MarkEmailChangeReverted(id uint, ctx context.Context) (bool, error)
+	AddPasswordHistory(userId uint, passwordHash string, keep int, ctx context.Context) error
+	FindPasswordHistory(userId uint, limit int, ctx context.Context) []model.PasswordHistory
+	CreateOAuthClient(client model.OAuthClient, ctx context.Context) (model.OAuthClient, error)
+	FindOAuthClient(clientId string, ctx context.Context) (model.OAuthClient, error)
+	FindOAuthClients(ctx context.Context) []model.OAuthClient
+	DeleteOAuthClient(clientId string, ctx context.Context) error
+	CreateAuthorizationCode(code model.AuthorizationCode, ctx context.Context) (model.AuthorizationCode, error)
+	FindAuthorizationCodeByHash(codeHash string, ctx context.Context) (model.AuthorizationCode, error)
+	MarkAuthorizationCodeUsed(id uint, sessionId uint, ctx context.Context) (bool, error)
+	CreateFederatedLoginState(state model.FederatedLoginState, ctx context.Context) (model.FederatedLoginState, error)
+	FindFederatedLoginStateByHash(stateHash string, ctx context.Context) (model.FederatedLoginState, error)
+	DeleteFederatedLoginState(id uint, ctx context.Context) (bool, error)
+	FindUserByIdentity(provider string, subject string, ctx context.Context) (model.User, model.UserIdentity, error)
+	FindUserIdentities(userId uint, ctx context.Context) []model.UserIdentity
+	CreateUserIdentity(identity model.UserIdentity, ctx context.Context) (model.UserIdentity, error)
+	TouchUserIdentity(id uint, lastUsedAt time.Time, ctx context.Context) error
+	UpdateUserIdentity(userId uint, provider string, subject string, email string, ctx context.Context) error
+	DeleteUserIdentity(userId uint, identityId uint, ctx context.Context) (bool, error)
+	CreatePasswordResetToken(resetToken model.PasswordResetToken, ctx context.Context) (model.PasswordResetToken, error)
+	FindPasswordResetTokenByHash(tokenHash string, ctx context.Context) (model.PasswordResetToken, error)
+	MarkPasswordResetTokenUsed(id uint, ctx context.Context) (bool, error)
+	InvalidatePasswordResetTokens(userId uint, ctx context.Context) error
+	CreateRevokedToken(revokedToken model.RevokedToken, ctx context.Context) error
+	FindRevokedToken(jti string, ctx context.Context) (model.RevokedToken, error)
+	FindRole(name model.UserRole, ctx context.Context) (model.Role, error)
+	FindRoles(ctx context.Context) []model.Role
+	FindUserRoles(userId uint, ctx context.Context) []model.UserRole
+	AddUserRole(user model.User, role model.UserRole, ctx context.Context) (model.User, error)
+	RemoveUserRole(userId uint, role model.UserRole, ctx context.Context) (bool, error)
+	UpdateSessionRole(sessionId uint, role model.UserRole, ctx context.Context) error
+	CreatePhoneVerification(verification model.PhoneVerification, ctx context.Context) (model.PhoneVerification, error)
+	FindPhoneVerification(userId uint, ctx context.Context) (model.PhoneVerification, error)
+	RecordPhoneVerificationAttempt(id uint, maxAttempts int, ctx context.Context) (bool, error)
+	MarkPhoneVerified(verification model.PhoneVerification, ctx context.Context) (bool, error)
+	CompleteHostOnboarding(user model.User, event model.OutboxEvent, ctx context.Context) (model.User, error)
+	FindPendingOutboxEvents(limit int, ctx context.Context) []model.OutboxEvent
+	MarkOutboxEventDelivered(id uint, ctx context.Context) error
+	RecordOutboxEventAttempt(id uint, ctx context.Context) error
+	FindUsers(query model.UserQuery, ctx context.Context) ([]model.User, error)
+	FindRolesOfUsers(userIds []uint, ctx context.Context) map[uint][]model.UserRole
 }
 
 type Repository struct {
 	Db *gorm.DB
 }
 
-func (r *Repository) CheckCredentials(email string, password string, ctx context.Context) (model.User, error) {
-	span := tracer.StartSpanFromContext(ctx, "checkCredentialsRepository")
+func (r *Repository) FindUserByEmail(email string, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "findUserByEmailRepository")
 	defer span.Finish()
 
 	var user model.User
 
-	r.Db.Table("users").Where("email = ? AND password = ?", email, password).First(&user)
+	r.Db.Where("email = ?", email).First(&user)
 
 	if user.ID == 0 {
 		err := errors.New("user does not exist")
@@ -41,15 +110,37 @@ func (r *Repository) CheckCredentials(email string, password string, ctx context
 	return user, nil
 }
 
-func (r *Repository) CreateUser(user model.User, ctx context.Context) (model.User, error) {
+// CreateUser creates the user together with its first login identities.
+func (r *Repository) CreateUser(user model.User, identities []model.UserIdentity, ctx context.Context) (model.User, error) {
 	span := tracer.StartSpanFromContext(ctx, "createUserRepository")
 	defer span.Finish()
 
-	createdUser := r.Db.Create(&user)
+	tx := r.Db.Begin()
 
-	if createdUser.Error != nil {
-		tracer.LogError(span, createdUser.Error)
-		return user, createdUser.Error
+	if err := tx.Create(&user).Error; err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return user, err
+	}
+
+	for _, identity := range identities {
+		identity.UserId = user.ID
+		if err := tx.Create(&identity).Error; err != nil {
+			tx.Rollback()
+			tracer.LogError(span, err)
+			return user, err
+		}
+	}
+
+	if err := tx.Create(&model.RoleAssignment{UserId: user.ID, Role: user.Role}).Error; err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return user, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		tracer.LogError(span, err)
+		return user, err
 	}
 
 	return user, nil
@@ -72,15 +163,18 @@ func (r *Repository) FindUserById(id uint64, ctx context.Context) (model.User, e
 	return user, nil
 }
 
-func (r *Repository) SaveUser(user model.User, ctx context.Context) (model.User, error) {
-	span := tracer.StartSpanFromContext(ctx, "saveUserRepository")
+// UpdateUser writes only the given columns of the user. The user is a copy
+// read a while ago, writing all of it would undo whatever changed since, like
+// a token_version bumped by a password change.
+func (r *Repository) UpdateUser(user model.User, columns []string, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "updateUserRepository")
 	defer span.Finish()
 
-	createdUser := r.Db.Save(&user)
+	updatedUser := r.Db.Select(append([]string{"updated_at"}, columns...)).Save(&user)
 
-	if createdUser.Error != nil {
-		tracer.LogError(span, createdUser.Error)
-		return user, createdUser.Error
+	if updatedUser.Error != nil {
+		tracer.LogError(span, updatedUser.Error)
+		return user, updatedUser.Error
 	}
 
 	return user, nil
@@ -119,3 +213,1287 @@ func (r *Repository) FindUserByUsername(username string, ctx context.Context) mo
 
 	return user
 }
+
+func (r *Repository) CreateRefreshToken(refreshToken model.RefreshToken, ctx context.Context) (model.RefreshToken, error) {
+	span := tracer.StartSpanFromContext(ctx, "createRefreshTokenRepository")
+	defer span.Finish()
+
+	createdToken := r.Db.Create(&refreshToken)
+
+	if createdToken.Error != nil {
+		tracer.LogError(span, createdToken.Error)
+		return refreshToken, createdToken.Error
+	}
+
+	return refreshToken, nil
+}
+
+func (r *Repository) FindRefreshTokenByHash(tokenHash string, ctx context.Context) (model.RefreshToken, error) {
+	span := tracer.StartSpanFromContext(ctx, "findRefreshTokenByHashRepository")
+	defer span.Finish()
+
+	var refreshToken model.RefreshToken
+
+	r.Db.Where("token_hash = ?", tokenHash).First(&refreshToken)
+
+	if refreshToken.ID == 0 {
+		err := errors.New("refresh token does not exist")
+		tracer.LogError(span, err)
+		return refreshToken, err
+	}
+
+	return refreshToken, nil
+}
+
+// MarkRefreshTokenRotated returns false when the token had already been
+// rotated, so two concurrent refreshes cannot both succeed.
+func (r *Repository) MarkRefreshTokenRotated(id uint, ctx context.Context) (bool, error) {
+	span := tracer.StartSpanFromContext(ctx, "markRefreshTokenRotatedRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.RefreshToken{}).Where("id = ? AND rotated_at IS NULL AND revoked_at IS NULL", id).Update("rotated_at", time.Now())
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+func (r *Repository) RevokeRefreshTokenFamily(familyId string, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "revokeRefreshTokenFamilyRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.RefreshToken{}).Where("family_id = ? AND revoked_at IS NULL", familyId).Update("revoked_at", time.Now())
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return result.Error
+	}
+
+	return nil
+}
+
+func (r *Repository) RevokeRefreshTokensForUser(userId uint, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "revokeRefreshTokensForUserRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.RefreshToken{}).Where("user_id = ? AND revoked_at IS NULL", userId).Update("revoked_at", time.Now())
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return result.Error
+	}
+
+	return nil
+}
+
+func (r *Repository) IncrementTokenVersion(userId uint, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "incrementTokenVersionRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.User{}).Where("id = ?", userId).UpdateColumn("token_version", gorm.Expr("token_version + 1"))
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return result.Error
+	}
+
+	return nil
+}
+
+func (r *Repository) CreateSession(session model.Session, ctx context.Context) (model.Session, error) {
+	span := tracer.StartSpanFromContext(ctx, "createSessionRepository")
+	defer span.Finish()
+
+	createdSession := r.Db.Create(&session)
+
+	if createdSession.Error != nil {
+		tracer.LogError(span, createdSession.Error)
+		return session, createdSession.Error
+	}
+
+	return session, nil
+}
+
+func (r *Repository) FindSessionById(id uint, ctx context.Context) (model.Session, error) {
+	span := tracer.StartSpanFromContext(ctx, "findSessionByIdRepository")
+	defer span.Finish()
+
+	var session model.Session
+
+	r.Db.First(&session, id)
+
+	if session.ID == 0 {
+		err := errors.New("there is no session with id " + strconv.FormatUint(uint64(id), 10))
+		tracer.LogError(span, err)
+		return model.Session{}, err
+	}
+
+	return session, nil
+}
+
+func (r *Repository) FindActiveSessionsByUser(userId uint, ctx context.Context) []model.Session {
+	span := tracer.StartSpanFromContext(ctx, "findActiveSessionsByUserRepository")
+	defer span.Finish()
+
+	var sessions []model.Session
+
+	r.Db.Where("user_id = ? AND revoked_at IS NULL", userId).Order("last_seen_at desc").Find(&sessions)
+
+	return sessions
+}
+
+func (r *Repository) TouchSession(id uint, lastSeenAt time.Time, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "touchSessionRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.Session{}).Where("id = ?", id).UpdateColumn("last_seen_at", lastSeenAt)
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return result.Error
+	}
+
+	return nil
+}
+
+// RevokeSession also revokes the refresh tokens issued within the session.
+func (r *Repository) RevokeSession(id uint, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "revokeSessionRepository")
+	defer span.Finish()
+
+	now := time.Now()
+	result := r.Db.Model(&model.Session{}).Where("id = ? AND revoked_at IS NULL", id).Update("revoked_at", now)
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return result.Error
+	}
+
+	result = r.Db.Model(&model.RefreshToken{}).Where("session_id = ? AND revoked_at IS NULL", id).Update("revoked_at", now)
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return result.Error
+	}
+
+	return nil
+}
+
+func (r *Repository) RevokeSessionsForUser(userId uint, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "revokeSessionsForUserRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.Session{}).Where("user_id = ? AND revoked_at IS NULL", userId).Update("revoked_at", time.Now())
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return result.Error
+	}
+
+	return nil
+}
+
+// UpdateTotpLastStep returns false when the step, or a later one, was already
+// used, which rejects a replayed code even under concurrent logins.
+func (r *Repository) UpdateTotpLastStep(userId uint, step int64, ctx context.Context) (bool, error) {
+	span := tracer.StartSpanFromContext(ctx, "updateTotpLastStepRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.User{}).Where("id = ? AND totp_last_step < ?", userId, step).UpdateColumn("totp_last_step", step)
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+func (r *Repository) ReplaceRecoveryCodes(userId uint, recoveryCodes []model.RecoveryCode, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "replaceRecoveryCodesRepository")
+	defer span.Finish()
+
+	tx := r.Db.Begin()
+
+	if err := tx.Unscoped().Where("user_id = ?", userId).Delete(&model.RecoveryCode{}).Error; err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return err
+	}
+
+	for _, recoveryCode := range recoveryCodes {
+		if err := tx.Create(&recoveryCode).Error; err != nil {
+			tx.Rollback()
+			tracer.LogError(span, err)
+			return err
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		tracer.LogError(span, err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *Repository) FindUnusedRecoveryCodes(userId uint, ctx context.Context) []model.RecoveryCode {
+	span := tracer.StartSpanFromContext(ctx, "findUnusedRecoveryCodesRepository")
+	defer span.Finish()
+
+	var recoveryCodes []model.RecoveryCode
+
+	r.Db.Where("user_id = ? AND used_at IS NULL", userId).Find(&recoveryCodes)
+
+	return recoveryCodes
+}
+
+// MarkRecoveryCodeUsed returns false when the code was already used.
+func (r *Repository) MarkRecoveryCodeUsed(id uint, ctx context.Context) (bool, error) {
+	span := tracer.StartSpanFromContext(ctx, "markRecoveryCodeUsedRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.RecoveryCode{}).Where("id = ? AND used_at IS NULL", id).Update("used_at", time.Now())
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+func (r *Repository) FindLoginThrottle(throttleKey string, ctx context.Context) model.LoginThrottle {
+	span := tracer.StartSpanFromContext(ctx, "findLoginThrottleRepository")
+	defer span.Finish()
+
+	var loginThrottle model.LoginThrottle
+
+	r.Db.Where("throttle_key = ?", throttleKey).First(&loginThrottle)
+
+	return loginThrottle
+}
+
+// RecordLoginFailure atomically counts a failure. Counting starts over when
+// the previous failure is older than the window, which also lifts an expired
+// lock.
+func (r *Repository) RecordLoginFailure(throttleKey string, window time.Duration, ctx context.Context) (model.LoginThrottle, error) {
+	span := tracer.StartSpanFromContext(ctx, "recordLoginFailureRepository")
+	defer span.Finish()
+
+	now := time.Now()
+	windowStart := now.Add(-window)
+
+	// The counter comes from the upsert itself, a separate read could see
+	// the increments of concurrent failures as well.
+	var loginThrottle model.LoginThrottle
+	result := r.Db.Raw(`INSERT INTO login_throttles (created_at, updated_at, throttle_key, failures, last_failure_at)
+		VALUES (?, ?, ?, 1, ?)
+		ON CONFLICT (throttle_key) DO UPDATE SET
+			failures = CASE WHEN login_throttles.last_failure_at < ? THEN 1 ELSE login_throttles.failures + 1 END,
+			locked_until = CASE WHEN login_throttles.last_failure_at < ? THEN NULL ELSE login_throttles.locked_until END,
+			last_failure_at = EXCLUDED.last_failure_at,
+			updated_at = EXCLUDED.updated_at
+		RETURNING *`,
+		now, now, throttleKey, now, windowStart, windowStart).Scan(&loginThrottle)
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return model.LoginThrottle{}, result.Error
+	}
+
+	return loginThrottle, nil
+}
+
+func (r *Repository) LockLoginThrottle(throttleKey string, lockedUntil time.Time, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "lockLoginThrottleRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.LoginThrottle{}).Where("throttle_key = ?", throttleKey).Update("locked_until", lockedUntil)
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return result.Error
+	}
+
+	return nil
+}
+
+func (r *Repository) DeleteLoginThrottle(throttleKey string, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "deleteLoginThrottleRepository")
+	defer span.Finish()
+
+	result := r.Db.Unscoped().Where("throttle_key = ?", throttleKey).Delete(&model.LoginThrottle{})
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return result.Error
+	}
+
+	return nil
+}
+
+func (r *Repository) CreateRevokedToken(revokedToken model.RevokedToken, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "createRevokedTokenRepository")
+	defer span.Finish()
+
+	var existingToken model.RevokedToken
+	r.Db.Where("jti = ?", revokedToken.Jti).First(&existingToken)
+	if existingToken.ID != 0 {
+		return nil
+	}
+
+	createdToken := r.Db.Create(&revokedToken)
+
+	if createdToken.Error != nil {
+		tracer.LogError(span, createdToken.Error)
+		return createdToken.Error
+	}
+
+	return nil
+}
+
+// FindRevokedToken returns an empty token when the jti was never revoked and
+// only fails when the lookup itself fails.
+func (r *Repository) FindRevokedToken(jti string, ctx context.Context) (model.RevokedToken, error) {
+	span := tracer.StartSpanFromContext(ctx, "findRevokedTokenRepository")
+	defer span.Finish()
+
+	var revokedToken model.RevokedToken
+
+	result := r.Db.Where("jti = ?", jti).First(&revokedToken)
+
+	if result.Error != nil && !result.RecordNotFound() {
+		tracer.LogError(span, result.Error)
+		return revokedToken, result.Error
+	}
+
+	return revokedToken, nil
+}
+
+func (r *Repository) CreatePasswordResetToken(resetToken model.PasswordResetToken, ctx context.Context) (model.PasswordResetToken, error) {
+	span := tracer.StartSpanFromContext(ctx, "createPasswordResetTokenRepository")
+	defer span.Finish()
+
+	result := r.Db.Create(&resetToken)
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return resetToken, result.Error
+	}
+
+	return resetToken, nil
+}
+
+func (r *Repository) FindPasswordResetTokenByHash(tokenHash string, ctx context.Context) (model.PasswordResetToken, error) {
+	span := tracer.StartSpanFromContext(ctx, "findPasswordResetTokenByHashRepository")
+	defer span.Finish()
+
+	var resetToken model.PasswordResetToken
+
+	r.Db.Where("token_hash = ?", tokenHash).First(&resetToken)
+
+	if resetToken.ID == 0 {
+		err := errors.New("password reset token does not exist")
+		tracer.LogError(span, err)
+		return resetToken, err
+	}
+
+	return resetToken, nil
+}
+
+// MarkPasswordResetTokenUsed returns false when the token was already used or
+// has expired in the meantime.
+func (r *Repository) MarkPasswordResetTokenUsed(id uint, ctx context.Context) (bool, error) {
+	span := tracer.StartSpanFromContext(ctx, "markPasswordResetTokenUsedRepository")
+	defer span.Finish()
+
+	now := time.Now()
+	result := r.Db.Model(&model.PasswordResetToken{}).Where("id = ? AND used_at IS NULL AND expires_at > ?", id, now).Update("used_at", now)
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+// InvalidatePasswordResetTokens marks every outstanding token of the user as
+// used, so that only the most recently emailed link works.
+func (r *Repository) InvalidatePasswordResetTokens(userId uint, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "invalidatePasswordResetTokensRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.PasswordResetToken{}).Where("user_id = ? AND used_at IS NULL", userId).Update("used_at", time.Now())
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return result.Error
+	}
+
+	return nil
+}
+
+// ReserveVerificationEmail records that a verification email goes out now. It
+// returns false when one was already sent after sentBefore, which keeps
+// concurrent resend requests from both sending.
+func (r *Repository) ReserveVerificationEmail(userId uint, sentBefore time.Time, ctx context.Context) (bool, error) {
+	span := tracer.StartSpanFromContext(ctx, "reserveVerificationEmailRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.User{}).
+		Where("id = ? AND verified = ? AND (verification_sent_at IS NULL OR verification_sent_at < ?)", userId, false, sentBefore).
+		Update("verification_sent_at", time.Now())
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+// MarkUserVerified only verifies the address the link was sent to.
+func (r *Repository) MarkUserVerified(userId uint, email string, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "markUserVerifiedRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.User{}).Where("id = ? AND email = ?", userId, email).Update("verified", true)
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		err := errors.New("user does not exist")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	return nil
+}
+
+// CreateEmailChange replaces any change of the user that is still waiting for
+// confirmation, only the latest requested address can be confirmed.
+func (r *Repository) CreateEmailChange(emailChange model.EmailChange, ctx context.Context) (model.EmailChange, error) {
+	span := tracer.StartSpanFromContext(ctx, "createEmailChangeRepository")
+	defer span.Finish()
+
+	tx := r.Db.Begin()
+
+	err := tx.Unscoped().Where("user_id = ? AND confirmed_at IS NULL AND reverted_at IS NULL", emailChange.UserId).Delete(&model.EmailChange{}).Error
+	if err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return emailChange, err
+	}
+
+	if err := tx.Create(&emailChange).Error; err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return emailChange, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		tracer.LogError(span, err)
+		return emailChange, err
+	}
+
+	return emailChange, nil
+}
+
+func (r *Repository) FindEmailChangeByConfirmHash(tokenHash string, ctx context.Context) (model.EmailChange, error) {
+	span := tracer.StartSpanFromContext(ctx, "findEmailChangeByConfirmHashRepository")
+	defer span.Finish()
+
+	var emailChange model.EmailChange
+
+	r.Db.Where("confirm_token_hash = ?", tokenHash).First(&emailChange)
+
+	if emailChange.ID == 0 {
+		err := errors.New("email change does not exist")
+		tracer.LogError(span, err)
+		return emailChange, err
+	}
+
+	return emailChange, nil
+}
+
+func (r *Repository) FindEmailChangeByRevertHash(tokenHash string, ctx context.Context) (model.EmailChange, error) {
+	span := tracer.StartSpanFromContext(ctx, "findEmailChangeByRevertHashRepository")
+	defer span.Finish()
+
+	var emailChange model.EmailChange
+
+	r.Db.Where("revert_token_hash = ?", tokenHash).First(&emailChange)
+
+	if emailChange.ID == 0 {
+		err := errors.New("email change does not exist")
+		tracer.LogError(span, err)
+		return emailChange, err
+	}
+
+	return emailChange, nil
+}
+
+// MarkEmailChangeConfirmed returns false when the change was already
+// confirmed, reverted or has expired.
+func (r *Repository) MarkEmailChangeConfirmed(id uint, ctx context.Context) (bool, error) {
+	span := tracer.StartSpanFromContext(ctx, "markEmailChangeConfirmedRepository")
+	defer span.Finish()
+
+	now := time.Now()
+	result := r.Db.Model(&model.EmailChange{}).
+		Where("id = ? AND confirmed_at IS NULL AND reverted_at IS NULL AND expires_at > ?", id, now).
+		Update("confirmed_at", now)
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+// MarkEmailChangeReverted returns false when the change was already reverted
+// or the revert window has passed.
+func (r *Repository) MarkEmailChangeReverted(id uint, ctx context.Context) (bool, error) {
+	span := tracer.StartSpanFromContext(ctx, "markEmailChangeRevertedRepository")
+	defer span.Finish()
+
+	now := time.Now()
+	result := r.Db.Model(&model.EmailChange{}).
+		Where("id = ? AND reverted_at IS NULL AND revert_expires_at > ?", id, now).
+		Update("reverted_at", now)
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+// AddPasswordHistory stores a previous password hash and drops all but the
+// newest keep entries of the user.
+func (r *Repository) AddPasswordHistory(userId uint, passwordHash string, keep int, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "addPasswordHistoryRepository")
+	defer span.Finish()
+
+	tx := r.Db.Begin()
+
+	if err := tx.Create(&model.PasswordHistory{UserId: userId, PasswordHash: passwordHash}).Error; err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return err
+	}
+
+	newest := tx.Model(&model.PasswordHistory{}).Where("user_id = ?", userId).Order("id desc").Limit(keep).Select("id").QueryExpr()
+	err := tx.Unscoped().Where("user_id = ? AND id NOT IN (?)", userId, newest).Delete(&model.PasswordHistory{}).Error
+	if err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		tracer.LogError(span, err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *Repository) FindPasswordHistory(userId uint, limit int, ctx context.Context) []model.PasswordHistory {
+	span := tracer.StartSpanFromContext(ctx, "findPasswordHistoryRepository")
+	defer span.Finish()
+
+	var passwordHistory []model.PasswordHistory
+
+	r.Db.Where("user_id = ?", userId).Order("id desc").Limit(limit).Find(&passwordHistory)
+
+	return passwordHistory
+}
+
+func (r *Repository) CreateOAuthClient(client model.OAuthClient, ctx context.Context) (model.OAuthClient, error) {
+	span := tracer.StartSpanFromContext(ctx, "createOAuthClientRepository")
+	defer span.Finish()
+
+	result := r.Db.Create(&client)
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return client, result.Error
+	}
+
+	return client, nil
+}
+
+func (r *Repository) FindOAuthClient(clientId string, ctx context.Context) (model.OAuthClient, error) {
+	span := tracer.StartSpanFromContext(ctx, "findOAuthClientRepository")
+	defer span.Finish()
+
+	var client model.OAuthClient
+
+	r.Db.Where("client_id = ?", clientId).First(&client)
+
+	if client.ID == 0 {
+		err := errors.New("client does not exist")
+		tracer.LogError(span, err)
+		return client, err
+	}
+
+	return client, nil
+}
+
+func (r *Repository) FindOAuthClients(ctx context.Context) []model.OAuthClient {
+	span := tracer.StartSpanFromContext(ctx, "findOAuthClientsRepository")
+	defer span.Finish()
+
+	var clients []model.OAuthClient
+
+	r.Db.Order("id").Find(&clients)
+
+	return clients
+}
+
+// DeleteOAuthClient also revokes the sessions and refresh tokens issued to
+// the client.
+func (r *Repository) DeleteOAuthClient(clientId string, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "deleteOAuthClientRepository")
+	defer span.Finish()
+
+	now := time.Now()
+	tx := r.Db.Begin()
+
+	result := tx.Where("client_id = ?", clientId).Delete(&model.OAuthClient{})
+	if result.Error != nil {
+		tx.Rollback()
+		tracer.LogError(span, result.Error)
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		err := errors.New("client does not exist")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	clientSessions := tx.Model(&model.Session{}).Where("client_id = ?", clientId).Select("id").QueryExpr()
+	err := tx.Model(&model.RefreshToken{}).Where("session_id IN (?) AND revoked_at IS NULL", clientSessions).Update("revoked_at", now).Error
+	if err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return err
+	}
+
+	err = tx.Model(&model.Session{}).Where("client_id = ? AND revoked_at IS NULL", clientId).Update("revoked_at", now).Error
+	if err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		tracer.LogError(span, err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *Repository) CreateAuthorizationCode(code model.AuthorizationCode, ctx context.Context) (model.AuthorizationCode, error) {
+	span := tracer.StartSpanFromContext(ctx, "createAuthorizationCodeRepository")
+	defer span.Finish()
+
+	result := r.Db.Create(&code)
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return code, result.Error
+	}
+
+	return code, nil
+}
+
+func (r *Repository) FindAuthorizationCodeByHash(codeHash string, ctx context.Context) (model.AuthorizationCode, error) {
+	span := tracer.StartSpanFromContext(ctx, "findAuthorizationCodeByHashRepository")
+	defer span.Finish()
+
+	var code model.AuthorizationCode
+
+	r.Db.Where("code_hash = ?", codeHash).First(&code)
+
+	if code.ID == 0 {
+		err := errors.New("authorization code does not exist")
+		tracer.LogError(span, err)
+		return code, err
+	}
+
+	return code, nil
+}
+
+// MarkAuthorizationCodeUsed records the session the code was exchanged for.
+// It returns false when the code was already used.
+func (r *Repository) MarkAuthorizationCodeUsed(id uint, sessionId uint, ctx context.Context) (bool, error) {
+	span := tracer.StartSpanFromContext(ctx, "markAuthorizationCodeUsedRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.AuthorizationCode{}).Where("id = ? AND used_at IS NULL", id).
+		Updates(map[string]interface{}{"used_at": time.Now(), "session_id": sessionId})
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+func (r *Repository) CreateFederatedLoginState(state model.FederatedLoginState, ctx context.Context) (model.FederatedLoginState, error) {
+	span := tracer.StartSpanFromContext(ctx, "createFederatedLoginStateRepository")
+	defer span.Finish()
+
+	result := r.Db.Create(&state)
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return state, result.Error
+	}
+
+	return state, nil
+}
+
+func (r *Repository) FindFederatedLoginStateByHash(stateHash string, ctx context.Context) (model.FederatedLoginState, error) {
+	span := tracer.StartSpanFromContext(ctx, "findFederatedLoginStateByHashRepository")
+	defer span.Finish()
+
+	var state model.FederatedLoginState
+
+	r.Db.Where("state_hash = ? AND expires_at > ?", stateHash, time.Now()).First(&state)
+
+	if state.ID == 0 {
+		err := errors.New("federated login state does not exist")
+		tracer.LogError(span, err)
+		return state, err
+	}
+
+	return state, nil
+}
+
+// DeleteFederatedLoginState consumes a state, it returns false when another
+// callback already did.
+func (r *Repository) DeleteFederatedLoginState(id uint, ctx context.Context) (bool, error) {
+	span := tracer.StartSpanFromContext(ctx, "deleteFederatedLoginStateRepository")
+	defer span.Finish()
+
+	result := r.Db.Unscoped().Where("id = ?", id).Delete(&model.FederatedLoginState{})
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+func (r *Repository) FindUserByIdentity(provider string, subject string, ctx context.Context) (model.User, model.UserIdentity, error) {
+	span := tracer.StartSpanFromContext(ctx, "findUserByIdentityRepository")
+	defer span.Finish()
+
+	var identity model.UserIdentity
+	var user model.User
+
+	r.Db.Where("provider = ? AND subject = ?", provider, subject).First(&identity)
+	if identity.ID != 0 {
+		r.Db.First(&user, identity.UserId)
+	}
+
+	if user.ID == 0 {
+		err := errors.New("user does not exist")
+		tracer.LogError(span, err)
+		return model.User{}, model.UserIdentity{}, err
+	}
+
+	return user, identity, nil
+}
+
+func (r *Repository) FindUserIdentities(userId uint, ctx context.Context) []model.UserIdentity {
+	span := tracer.StartSpanFromContext(ctx, "findUserIdentitiesRepository")
+	defer span.Finish()
+
+	var identities []model.UserIdentity
+	r.Db.Where("user_id = ?", userId).Order("created_at").Find(&identities)
+
+	return identities
+}
+
+func (r *Repository) CreateUserIdentity(identity model.UserIdentity, ctx context.Context) (model.UserIdentity, error) {
+	span := tracer.StartSpanFromContext(ctx, "createUserIdentityRepository")
+	defer span.Finish()
+
+	result := r.Db.Create(&identity)
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return identity, result.Error
+	}
+
+	return identity, nil
+}
+
+func (r *Repository) TouchUserIdentity(id uint, lastUsedAt time.Time, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "touchUserIdentityRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.UserIdentity{}).Where("id = ?", id).UpdateColumn("last_used_at", lastUsedAt)
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return result.Error
+	}
+
+	return nil
+}
+
+// UpdateUserIdentity rekeys an email keyed identity after an email change.
+func (r *Repository) UpdateUserIdentity(userId uint, provider string, subject string, email string, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "updateUserIdentityRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.UserIdentity{}).Where("user_id = ? AND provider = ?", userId, provider).
+		Updates(map[string]interface{}{"subject": subject, "email": email})
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return result.Error
+	}
+
+	return nil
+}
+
+// DeleteUserIdentity removes an identity unless it is the last one of the
+// user. The user row is locked so that two concurrent unlinks cannot remove
+// both of the last two identities.
+func (r *Repository) DeleteUserIdentity(userId uint, identityId uint, ctx context.Context) (bool, error) {
+	span := tracer.StartSpanFromContext(ctx, "deleteUserIdentityRepository")
+	defer span.Finish()
+
+	tx := r.Db.Begin()
+
+	var user model.User
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").First(&user, userId).Error; err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return false, err
+	}
+
+	var identityCount int
+	if err := tx.Model(&model.UserIdentity{}).Where("user_id = ?", userId).Count(&identityCount).Error; err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return false, err
+	}
+
+	if identityCount <= 1 {
+		tx.Rollback()
+		return false, nil
+	}
+
+	result := tx.Unscoped().Where("id = ? AND user_id = ?", identityId, userId).Delete(&model.UserIdentity{})
+	if result.Error != nil {
+		tx.Rollback()
+		tracer.LogError(span, result.Error)
+		return false, result.Error
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		tracer.LogError(span, err)
+		return false, err
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+// FindRole loads the role with its permissions.
+func (r *Repository) FindRole(name model.UserRole, ctx context.Context) (model.Role, error) {
+	span := tracer.StartSpanFromContext(ctx, "findRoleRepository")
+	defer span.Finish()
+
+	var role model.Role
+	r.Db.Preload("Permissions").Where("name = ?", name).First(&role)
+
+	if role.ID == 0 {
+		err := errors.New("role does not exist")
+		tracer.LogError(span, err)
+		return role, err
+	}
+
+	return role, nil
+}
+
+func (r *Repository) FindRoles(ctx context.Context) []model.Role {
+	span := tracer.StartSpanFromContext(ctx, "findRolesRepository")
+	defer span.Finish()
+
+	var roles []model.Role
+	r.Db.Preload("Permissions").Order("id").Find(&roles)
+
+	return roles
+}
+
+func (r *Repository) FindUserRoles(userId uint, ctx context.Context) []model.UserRole {
+	span := tracer.StartSpanFromContext(ctx, "findUserRolesRepository")
+	defer span.Finish()
+
+	var roles []model.UserRole
+	r.Db.Model(&model.RoleAssignment{}).Where("user_id = ?", userId).Order("id").Pluck("role", &roles)
+
+	return roles
+}
+
+// AddUserRole saves the notification defaults of the role together with the
+// new role assignment.
+func (r *Repository) AddUserRole(user model.User, role model.UserRole, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "addUserRoleRepository")
+	defer span.Finish()
+
+	tx := r.Db.Begin()
+
+	if err := tx.Select(append([]string{"updated_at"}, model.NotificationColumns...)).Save(&user).Error; err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return user, err
+	}
+
+	if err := tx.Create(&model.RoleAssignment{UserId: user.ID, Role: role}).Error; err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return user, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		tracer.LogError(span, err)
+		return user, err
+	}
+
+	return user, nil
+}
+
+// RemoveUserRole removes a role unless it is the last one of the user. When
+// new sessions started in the removed role they start in a remaining one.
+func (r *Repository) RemoveUserRole(userId uint, role model.UserRole, ctx context.Context) (bool, error) {
+	span := tracer.StartSpanFromContext(ctx, "removeUserRoleRepository")
+	defer span.Finish()
+
+	tx := r.Db.Begin()
+
+	var user model.User
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").First(&user, userId).Error; err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return false, err
+	}
+
+	var remaining []model.UserRole
+	if err := tx.Model(&model.RoleAssignment{}).Where("user_id = ? AND role <> ?", userId, role).Order("id").Pluck("role", &remaining).Error; err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return false, err
+	}
+
+	if len(remaining) == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+
+	result := tx.Unscoped().Where("user_id = ? AND role = ?", userId, role).Delete(&model.RoleAssignment{})
+	if result.Error != nil {
+		tx.Rollback()
+		tracer.LogError(span, result.Error)
+		return false, result.Error
+	}
+
+	if user.Role == role {
+		if err := tx.Model(&user).UpdateColumn("role", remaining[0]).Error; err != nil {
+			tx.Rollback()
+			tracer.LogError(span, err)
+			return false, err
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		tracer.LogError(span, err)
+		return false, err
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+func (r *Repository) UpdateSessionRole(sessionId uint, role model.UserRole, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "updateSessionRoleRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.Session{}).Where("id = ?", sessionId).UpdateColumn("role", role)
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return result.Error
+	}
+
+	return nil
+}
+
+// CreatePhoneVerification replaces the codes of the user that were not used,
+// only the latest code can verify the phone.
+func (r *Repository) CreatePhoneVerification(verification model.PhoneVerification, ctx context.Context) (model.PhoneVerification, error) {
+	span := tracer.StartSpanFromContext(ctx, "createPhoneVerificationRepository")
+	defer span.Finish()
+
+	tx := r.Db.Begin()
+
+	if err := tx.Unscoped().Where("user_id = ? AND used_at IS NULL", verification.UserId).Delete(&model.PhoneVerification{}).Error; err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return verification, err
+	}
+
+	if err := tx.Create(&verification).Error; err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return verification, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		tracer.LogError(span, err)
+		return verification, err
+	}
+
+	return verification, nil
+}
+
+// FindPhoneVerification finds the latest code of the user, used or not.
+func (r *Repository) FindPhoneVerification(userId uint, ctx context.Context) (model.PhoneVerification, error) {
+	span := tracer.StartSpanFromContext(ctx, "findPhoneVerificationRepository")
+	defer span.Finish()
+
+	var verification model.PhoneVerification
+	r.Db.Where("user_id = ?", userId).Order("id desc").First(&verification)
+
+	if verification.ID == 0 {
+		err := errors.New("phone verification does not exist")
+		tracer.LogError(span, err)
+		return model.PhoneVerification{}, err
+	}
+
+	return verification, nil
+}
+
+// RecordPhoneVerificationAttempt uses up one attempt before a code is
+// checked. It returns false once maxAttempts were used or the code was.
+func (r *Repository) RecordPhoneVerificationAttempt(id uint, maxAttempts int, ctx context.Context) (bool, error) {
+	span := tracer.StartSpanFromContext(ctx, "recordPhoneVerificationAttemptRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.PhoneVerification{}).
+		Where("id = ? AND used_at IS NULL AND attempts < ?", id, maxAttempts).
+		UpdateColumn("attempts", gorm.Expr("attempts + 1"))
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+// MarkPhoneVerified uses the code and verifies the phone it was sent to, if
+// it is still the phone of the user. It returns false when the code was
+// already used.
+func (r *Repository) MarkPhoneVerified(verification model.PhoneVerification, ctx context.Context) (bool, error) {
+	span := tracer.StartSpanFromContext(ctx, "markPhoneVerifiedRepository")
+	defer span.Finish()
+
+	tx := r.Db.Begin()
+
+	result := tx.Model(&model.PhoneVerification{}).Where("id = ? AND used_at IS NULL", verification.ID).UpdateColumn("used_at", time.Now())
+	if result.Error != nil {
+		tx.Rollback()
+		tracer.LogError(span, result.Error)
+		return false, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+
+	result = tx.Model(&model.User{}).Where("id = ? AND phone = ?", verification.UserId, verification.Phone).UpdateColumn("phone_verified", true)
+	if result.Error != nil {
+		tx.Rollback()
+		tracer.LogError(span, result.Error)
+		return false, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		tracer.LogError(span, err)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// CompleteHostOnboarding saves the onboarded user with the HOST role and the
+// event announcing it in one transaction, so that the event is written
+// exactly when the user becomes a host.
+func (r *Repository) CompleteHostOnboarding(user model.User, event model.OutboxEvent, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "completeHostOnboardingRepository")
+	defer span.Finish()
+
+	tx := r.Db.Begin()
+
+	if err := tx.Select(append([]string{"updated_at", "host_onboarding"}, model.NotificationColumns...)).Save(&user).Error; err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return user, err
+	}
+
+	if err := tx.Create(&model.RoleAssignment{UserId: user.ID, Role: model.HOST}).Error; err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return user, err
+	}
+
+	if err := tx.Create(&event).Error; err != nil {
+		tx.Rollback()
+		tracer.LogError(span, err)
+		return user, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		tracer.LogError(span, err)
+		return user, err
+	}
+
+	return user, nil
+}
+
+// FindPendingOutboxEvents returns the oldest undelivered events first.
+func (r *Repository) FindPendingOutboxEvents(limit int, ctx context.Context) []model.OutboxEvent {
+	span := tracer.StartSpanFromContext(ctx, "findPendingOutboxEventsRepository")
+	defer span.Finish()
+
+	var events []model.OutboxEvent
+	r.Db.Where("delivered_at IS NULL").Order("id").Limit(limit).Find(&events)
+
+	return events
+}
+
+func (r *Repository) MarkOutboxEventDelivered(id uint, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "markOutboxEventDeliveredRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.OutboxEvent{}).Where("id = ?", id).
+		UpdateColumns(map[string]interface{}{"delivered_at": time.Now(), "attempts": gorm.Expr("attempts + 1")})
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return result.Error
+	}
+
+	return nil
+}
+
+func (r *Repository) RecordOutboxEventAttempt(id uint, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "recordOutboxEventAttemptRepository")
+	defer span.Finish()
+
+	result := r.Db.Model(&model.OutboxEvent{}).Where("id = ?", id).UpdateColumn("attempts", gorm.Expr("attempts + 1"))
+
+	if result.Error != nil {
+		tracer.LogError(span, result.Error)
+		return result.Error
+	}
+
+	return nil
+}
+
+// likeEscaper keeps LIKE wildcards typed by the user literal.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// FindUsers returns a page of users by keyset pagination on the sort column
+// and the id. The search is a case insensitive substring match on name,
+// surname, username and email, served by the trigram indexes.
+func (r *Repository) FindUsers(query model.UserQuery, ctx context.Context) ([]model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "findUsersRepository")
+	defer span.Finish()
+
+	db := r.Db.Model(&model.User{})
+
+	if query.Role != "" {
+		db = db.Where("users.role = ? OR EXISTS (SELECT 1 FROM role_assignments WHERE role_assignments.user_id = users.id AND role_assignments.role = ? AND role_assignments.deleted_at IS NULL)",
+			query.Role, query.Role)
+	}
+	if query.CreatedFrom != nil {
+		db = db.Where("users.created_at >= ?", *query.CreatedFrom)
+	}
+	if query.CreatedTo != nil {
+		db = db.Where("users.created_at < ?", *query.CreatedTo)
+	}
+	if query.Verified != nil {
+		db = db.Where("users.verified = ?", *query.Verified)
+	}
+	if query.Suspended != nil {
+		db = db.Where("users.suspended = ?", *query.Suspended)
+	}
+	if query.Search != "" {
+		pattern := "%" + likeEscaper.Replace(query.Search) + "%"
+		db = db.Where("users.name ILIKE ? OR users.surname ILIKE ? OR users.username ILIKE ? OR users.email ILIKE ?", pattern, pattern, pattern, pattern)
+	}
+
+	direction, comparison := "ASC", ">"
+	if query.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	if query.AfterId != 0 {
+		db = db.Where("(users."+query.SortField+", users.id) "+comparison+" (?, ?)", query.AfterValue, query.AfterId)
+	}
+
+	var users []model.User
+	err := db.Order("users." + query.SortField + " " + direction).Order("users.id " + direction).Limit(query.Limit).Find(&users).Error
+
+	if err != nil {
+		tracer.LogError(span, err)
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// FindRolesOfUsers loads the roles of a page of users in one query.
+func (r *Repository) FindRolesOfUsers(userIds []uint, ctx context.Context) map[uint][]model.UserRole {
+	span := tracer.StartSpanFromContext(ctx, "findRolesOfUsersRepository")
+	defer span.Finish()
+
+	var assignments []model.RoleAssignment
+	r.Db.Where("user_id IN (?)", userIds).Order("id").Find(&assignments)
+
+	roles := map[uint][]model.UserRole{}
+	for _, assignment := range assignments {
+		roles[assignment.UserId] = append(roles[assignment.UserId], assignment.Role)
+	}
+
+	return roles
+}
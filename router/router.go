@@ -4,13 +4,29 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/windbnb/user-service/handler"
 	"github.com/windbnb/user-service/metrics"
+	"github.com/windbnb/user-service/model"
 )
 
 func ConfigureRouter(handler *handler.Handler) *mux.Router {
 	router := mux.NewRouter()
 	router.HandleFunc("/api/users/login", metrics.MetricProxy(handler.Login)).Methods("POST")
+	router.HandleFunc("/api/users/login/mfa", metrics.MetricProxy(handler.CompleteMfaLogin)).Methods("POST")
+	router.HandleFunc("/api/users/login/magic-link", metrics.MetricProxy(handler.RequestMagicLink)).Methods("POST")
+	router.HandleFunc("/api/users/login/magic-link/consume", metrics.MetricProxy(handler.ConsumeMagicLink)).Methods("POST")
+	router.HandleFunc("/api/users/logout", metrics.MetricProxy(handler.Logout)).Methods("POST")
+	router.HandleFunc("/api/users/reauthenticate", metrics.MetricProxy(handler.StepUp)).Methods("POST")
+	router.HandleFunc("/api/users/token/refresh", metrics.MetricProxy(handler.RefreshToken)).Methods("POST")
+	router.HandleFunc("/api/users/federated/callback", metrics.MetricProxy(handler.CompleteFederatedLogin)).Methods("POST")
+	router.HandleFunc("/api/users/federated/{provider}/start", metrics.MetricProxy(handler.StartFederatedLogin)).Methods("POST")
 	router.HandleFunc("/api/users/register", metrics.MetricProxy(handler.Register)).Methods("POST")
+	router.HandleFunc("/api/users/password/forgot", metrics.MetricProxy(handler.ForgotPassword)).Methods("POST")
+	router.HandleFunc("/api/users/password/reset", metrics.MetricProxy(handler.ResetPassword)).Methods("POST")
+	router.HandleFunc("/api/users/verify-email", metrics.MetricProxy(handler.VerifyEmail)).Methods("POST")
+	router.HandleFunc("/api/users/verify-email/resend", metrics.MetricProxy(handler.ResendVerification)).Methods("POST")
+	router.HandleFunc("/api/users/email/confirm", metrics.MetricProxy(handler.ConfirmEmailChange)).Methods("POST")
+	router.HandleFunc("/api/users/email/revert", metrics.MetricProxy(handler.RevertEmailChange)).Methods("POST")
 
+	router.HandleFunc("/api/users/introspect", metrics.MetricProxy(handler.Introspect)).Methods("POST")
 	router.HandleFunc("/api/users/authorize/guest", metrics.MetricProxy(handler.AuthoriseGuest)).Methods("POST")
 	router.HandleFunc("/api/users/authorize/host", metrics.MetricProxy(handler.AuthoriseHost)).Methods("POST")
 
@@ -18,6 +34,52 @@ func ConfigureRouter(handler *handler.Handler) *mux.Router {
 	router.HandleFunc("/api/users/{id}", metrics.MetricProxy(handler.EditUser)).Methods("PUT")
 	router.HandleFunc("/api/users/change-password/{id}", metrics.MetricProxy(handler.ChangePassword)).Methods("PUT")
 	router.HandleFunc("/api/users/{id}", metrics.MetricProxy(handler.DeleteUser)).Methods("DELETE")
+	router.HandleFunc("/api/users/{id}/logout-all", metrics.MetricProxy(handler.LogoutEverywhere)).Methods("POST")
+	router.HandleFunc("/api/users/{id}/sessions", metrics.MetricProxy(handler.ListSessions)).Methods("GET")
+	router.HandleFunc("/api/users/{id}/sessions/{sessionId}", metrics.MetricProxy(handler.RevokeSession)).Methods("DELETE")
+	router.HandleFunc("/api/users/{id}/identities", metrics.MetricProxy(handler.ListIdentities)).Methods("GET")
+	router.HandleFunc("/api/users/{id}/identities/password", metrics.MetricProxy(handler.LinkPasswordIdentity)).Methods("POST")
+	router.HandleFunc("/api/users/{id}/identities/magic-link", metrics.MetricProxy(handler.LinkMagicLinkIdentity)).Methods("POST")
+	router.HandleFunc("/api/users/{id}/identities/callback", metrics.MetricProxy(handler.CompleteIdentityLink)).Methods("POST")
+	router.HandleFunc("/api/users/{id}/identities/{provider}/start", metrics.MetricProxy(handler.StartIdentityLink)).Methods("POST")
+	router.HandleFunc("/api/users/{id}/identities/{identityId}", metrics.MetricProxy(handler.UnlinkIdentity)).Methods("DELETE")
+	router.HandleFunc("/api/users/{id}/roles", metrics.MetricProxy(handler.ListUserRoles)).Methods("GET")
+	router.HandleFunc("/api/users/{id}/roles", metrics.MetricProxy(handler.AddOwnRole)).Methods("POST")
+	router.HandleFunc("/api/users/{id}/roles/switch", metrics.MetricProxy(handler.SwitchRole)).Methods("POST")
+	router.HandleFunc("/api/users/{id}/host-onboarding", metrics.MetricProxy(handler.HostOnboardingStatus)).Methods("GET")
+	router.HandleFunc("/api/users/{id}/host-onboarding", metrics.MetricProxy(handler.StartHostOnboarding)).Methods("POST")
+	router.HandleFunc("/api/users/{id}/host-onboarding/profile", metrics.MetricProxy(handler.UpdateHostProfile)).Methods("PUT")
+	router.HandleFunc("/api/users/{id}/host-onboarding/terms", metrics.MetricProxy(handler.AcceptHostTerms)).Methods("POST")
+	router.HandleFunc("/api/users/{id}/host-onboarding/phone-code", metrics.MetricProxy(handler.SendPhoneCode)).Methods("POST")
+	router.HandleFunc("/api/users/{id}/host-onboarding/phone-code/verify", metrics.MetricProxy(handler.VerifyPhone)).Methods("POST")
+	router.HandleFunc("/api/users/{id}/host-onboarding/complete", metrics.MetricProxy(handler.CompleteHostOnboarding)).Methods("POST")
+	router.HandleFunc("/api/users/{id}/2fa/enroll", metrics.MetricProxy(handler.EnrollTotp)).Methods("POST")
+	router.HandleFunc("/api/users/{id}/2fa/confirm", metrics.MetricProxy(handler.ConfirmTotp)).Methods("POST")
+	router.HandleFunc("/api/users/{id}/2fa/disable", metrics.MetricProxy(handler.DisableTotp)).Methods("POST")
+
+	router.HandleFunc("/.well-known/jwks.json", metrics.MetricProxy(handler.JWKS)).Methods("GET")
+	router.HandleFunc("/.well-known/openid-configuration", metrics.MetricProxy(handler.OpenIDConfiguration)).Methods("GET")
+
+	router.HandleFunc("/oauth/authorize", metrics.MetricProxy(handler.AuthorizePage)).Methods("GET")
+	router.HandleFunc("/oauth/authorize", metrics.MetricProxy(handler.Authorize)).Methods("POST")
+	router.HandleFunc("/oauth/token", metrics.MetricProxy(handler.Token)).Methods("POST")
+	router.HandleFunc("/oauth/userinfo", metrics.MetricProxy(handler.UserInfo)).Methods("GET", "POST")
+
+	router.HandleFunc("/api/admin/keys", metrics.MetricProxy(handler.RequirePermissions(handler.ListSigningKeys, model.PERMISSION_SIGNING_KEY_MANAGE))).Methods("GET")
+	router.HandleFunc("/api/admin/keys/rotate", metrics.MetricProxy(handler.RequirePermissions(handler.RotateSigningKey, model.PERMISSION_SIGNING_KEY_MANAGE))).Methods("POST")
+	router.HandleFunc("/api/admin/keys/{kid}/retire", metrics.MetricProxy(handler.RequirePermissions(handler.RetireSigningKey, model.PERMISSION_SIGNING_KEY_MANAGE))).Methods("POST")
+
+	router.HandleFunc("/api/admin/users", metrics.MetricProxy(handler.RequirePermissions(handler.ListUsers, model.PERMISSION_USER_READ_ANY))).Methods("GET")
+	router.HandleFunc("/api/admin/users/{id}/suspend", metrics.MetricProxy(handler.RequirePermissions(handler.SuspendUser, model.PERMISSION_USER_SUSPEND))).Methods("POST")
+	router.HandleFunc("/api/admin/users/{id}/unsuspend", metrics.MetricProxy(handler.RequirePermissions(handler.UnsuspendUser, model.PERMISSION_USER_SUSPEND))).Methods("POST")
+	router.HandleFunc("/api/admin/users/{id}/unlock", metrics.MetricProxy(handler.RequirePermissions(handler.UnlockUser, model.PERMISSION_USER_UNLOCK))).Methods("POST")
+	router.HandleFunc("/api/admin/users/{id}/roles", metrics.MetricProxy(handler.RequirePermissions(handler.AddUserRole, model.PERMISSION_USER_ASSIGN_ROLE))).Methods("POST")
+	router.HandleFunc("/api/admin/users/{id}/roles/{role}", metrics.MetricProxy(handler.RequirePermissions(handler.RemoveUserRole, model.PERMISSION_USER_ASSIGN_ROLE))).Methods("DELETE")
+	router.HandleFunc("/api/admin/roles", metrics.MetricProxy(handler.RequirePermissions(handler.ListRoles, model.PERMISSION_USER_ASSIGN_ROLE))).Methods("GET")
+
+	router.HandleFunc("/api/admin/oauth/clients", metrics.MetricProxy(handler.RequirePermissions(handler.ListOAuthClients, model.PERMISSION_OAUTH_CLIENT_MANAGE))).Methods("GET")
+	router.HandleFunc("/api/admin/oauth/clients", metrics.MetricProxy(handler.RequirePermissions(handler.RegisterOAuthClient, model.PERMISSION_OAUTH_CLIENT_MANAGE))).Methods("POST")
+	router.HandleFunc("/api/admin/oauth/clients/{clientId}", metrics.MetricProxy(handler.RequirePermissions(handler.DeleteOAuthClient, model.PERMISSION_OAUTH_CLIENT_MANAGE))).Methods("DELETE")
 
 	router.Path("/metrics").Handler(metrics.MetricsHandler())
 
@@ -0,0 +1,237 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/windbnb/user-service/mailer"
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+	"github.com/windbnb/user-service/util"
+)
+
+func emailChangeTTL() time.Duration {
+	return util.DurationFromEnv("EMAIL_CHANGE_TTL", 24*time.Hour)
+}
+
+// emailChangeRevertTTL is how long the old address can undo a change, it
+// outlives the confirmation so that a hijacked account can still be
+// recovered after the attacker confirmed their own address.
+func emailChangeRevertTTL() time.Duration {
+	return util.DurationFromEnv("EMAIL_CHANGE_REVERT_TTL", 7*24*time.Hour)
+}
+
+func emailChangeURL(action string, token string) string {
+	changeURL, changeURLFound := os.LookupEnv("EMAIL_CHANGE_URL")
+	if !changeURLFound {
+		changeURL = "http://localhost:3000/email-change"
+	}
+
+	return changeURL + "/" + action + "?token=" + url.QueryEscape(token)
+}
+
+// emailChangeRequested is true when newEmail is neither the current nor the
+// pending address of the user.
+func emailChangeRequested(user model.User, newEmail string) bool {
+	return newEmail != "" && !strings.EqualFold(newEmail, user.Email) && newEmail != user.PendingEmail
+}
+
+// RequestsEmailChange tells the handler whether an edit starts an email
+// change, which needs a recent sign in.
+func (service *UserService) RequestsEmailChange(user model.UserDTO, userId uint64, ctx context.Context) bool {
+	span := tracer.StartSpanFromContext(ctx, "requestsEmailChangeService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	currentUser, err := service.Repo.FindUserById(userId, ctx)
+	if err != nil {
+		return false
+	}
+
+	return emailChangeRequested(currentUser, strings.TrimSpace(user.Email))
+}
+
+// requestEmailChange records newEmail as pending and mails a confirmation
+// link to it and a revert link to the current address.
+func (service *UserService) requestEmailChange(user model.User, newEmail string, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "requestEmailChangeService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	if existingUser, err := service.Repo.FindUserByEmail(newEmail, ctx); err == nil && existingUser.ID != user.ID {
+		err := errors.New("email is already in use")
+		tracer.LogError(span, err)
+		return user, err
+	}
+
+	confirmToken, err := util.GenerateOpaqueToken()
+	if err != nil {
+		tracer.LogError(span, err)
+		return user, errors.New("error while requesting email change")
+	}
+
+	revertToken, err := util.GenerateOpaqueToken()
+	if err != nil {
+		tracer.LogError(span, err)
+		return user, errors.New("error while requesting email change")
+	}
+
+	now := time.Now()
+	_, err = service.Repo.CreateEmailChange(model.EmailChange{
+		UserId:           user.ID,
+		OldEmail:         user.Email,
+		NewEmail:         newEmail,
+		ConfirmTokenHash: util.HashToken(confirmToken),
+		RevertTokenHash:  util.HashToken(revertToken),
+		ExpiresAt:        now.Add(emailChangeTTL()),
+		RevertExpiresAt:  now.Add(emailChangeRevertTTL()),
+	}, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return user, errors.New("error while requesting email change")
+	}
+
+	user.PendingEmail = newEmail
+
+	err = service.mailer().Send(mailer.Message{
+		To:      newEmail,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Hi %s,\n\nopen the link below to start using this address for your account, it expires in %s.\n\n%s\n",
+			user.Name, emailChangeTTL(), emailChangeURL("confirm", confirmToken)),
+	})
+	if err != nil {
+		tracer.LogError(span, err)
+		return user, errors.New("error while sending confirmation email")
+	}
+
+	err = service.mailer().Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your email address is being changed",
+		Body: fmt.Sprintf("Hi %s,\n\nsomeone asked to change the email address of your account to %s. "+
+			"If it was not you, open the link below to keep this address and sign out every device.\n\n%s\n",
+			user.Name, newEmail, emailChangeURL("revert", revertToken)),
+	})
+	if err != nil {
+		tracer.LogError(span, err)
+		return user, errors.New("error while sending confirmation email")
+	}
+
+	return user, nil
+}
+
+// ConfirmEmailChange switches the login email to the pending address.
+func (service *UserService) ConfirmEmailChange(token string, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "confirmEmailChangeService")
+	defer span.Finish()
+
+	invalidLinkErr := errors.New("invalid or expired confirmation link")
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	emailChange, err := service.Repo.FindEmailChangeByConfirmHash(util.HashToken(token), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, invalidLinkErr
+	}
+
+	user, err := service.Repo.FindUserById(uint64(emailChange.UserId), ctx)
+	if err != nil || user.Email != emailChange.OldEmail || user.PendingEmail != emailChange.NewEmail {
+		tracer.LogError(span, invalidLinkErr)
+		return model.User{}, invalidLinkErr
+	}
+
+	if existingUser, err := service.Repo.FindUserByEmail(emailChange.NewEmail, ctx); err == nil && existingUser.ID != user.ID {
+		err := errors.New("email is already in use")
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
+
+	confirmed, err := service.Repo.MarkEmailChangeConfirmed(emailChange.ID, ctx)
+	if err != nil || !confirmed {
+		tracer.LogError(span, invalidLinkErr)
+		return model.User{}, invalidLinkErr
+	}
+
+	user.Email = emailChange.NewEmail
+	user.PendingEmail = ""
+	user.Verified = true
+
+	savedUser, err := service.Repo.UpdateUser(user, []string{"email", "pending_email", "verified"}, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("error while saving user")
+	}
+
+	err = service.updateEmailIdentities(savedUser, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("error while saving user")
+	}
+
+	return savedUser, nil
+}
+
+// RevertEmailChange is the one-click undo sent to the old address. It
+// cancels a pending change or restores the old address of a confirmed one,
+// and signs the account out everywhere in case it was taken over.
+func (service *UserService) RevertEmailChange(token string, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "revertEmailChangeService")
+	defer span.Finish()
+
+	invalidLinkErr := errors.New("invalid or expired revert link")
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	emailChange, err := service.Repo.FindEmailChangeByRevertHash(util.HashToken(token), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, invalidLinkErr
+	}
+
+	user, err := service.Repo.FindUserById(uint64(emailChange.UserId), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, invalidLinkErr
+	}
+
+	if existingUser, err := service.Repo.FindUserByEmail(emailChange.OldEmail, ctx); err == nil && existingUser.ID != user.ID {
+		err := errors.New("email is already in use")
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
+
+	reverted, err := service.Repo.MarkEmailChangeReverted(emailChange.ID, ctx)
+	if err != nil || !reverted {
+		tracer.LogError(span, invalidLinkErr)
+		return model.User{}, invalidLinkErr
+	}
+
+	if user.Email != emailChange.OldEmail {
+		user.Email = emailChange.OldEmail
+		user.Verified = true
+	}
+	user.PendingEmail = ""
+
+	savedUser, err := service.Repo.UpdateUser(user, []string{"email", "pending_email", "verified"}, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("error while saving user")
+	}
+
+	err = service.updateEmailIdentities(savedUser, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("error while saving user")
+	}
+
+	err = service.invalidateUserTokens(savedUser.ID, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("error while invalidating sessions")
+	}
+
+	return savedUser, nil
+}
@@ -0,0 +1,561 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/windbnb/user-service/client"
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+	"github.com/windbnb/user-service/util"
+)
+
+const federatedLoginStateTTL = 10 * time.Minute
+
+// federatedSigningAlgorithms are the ID token algorithms accepted from
+// identity providers, symmetric ones would need the client secret as key.
+var federatedSigningAlgorithms = map[string]bool{"RS256": true, "RS384": true, "RS512": true,
+	"ES256": true, "ES384": true, "ES512": true, "EdDSA": true}
+
+// FederatedProvider is an upstream OpenID Connect issuer guests can sign in
+// with.
+type FederatedProvider struct {
+	Name         string
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	Scopes       string
+}
+
+// federatedProviders reads FEDERATED_PROVIDERS, a comma separated list of
+// names, and FEDERATED_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET and _SCOPES
+// for each of them. Providers without issuer or client id are skipped.
+func federatedProviders() map[string]FederatedProvider {
+	providers := map[string]FederatedProvider{}
+
+	names, namesFound := os.LookupEnv("FEDERATED_PROVIDERS")
+	if !namesFound {
+		return providers
+	}
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "FEDERATED_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		provider := FederatedProvider{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientId:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			Scopes:       os.Getenv(prefix + "SCOPES"),
+		}
+		if provider.Issuer == "" || provider.ClientId == "" {
+			continue
+		}
+		if provider.Scopes == "" {
+			provider.Scopes = "openid email profile"
+		}
+
+		providers[name] = provider
+	}
+
+	return providers
+}
+
+// federatedRedirectURL is where providers send the user back to, the page
+// there posts the code and state to the callback endpoint.
+func federatedRedirectURL() string {
+	redirectURL, redirectURLFound := os.LookupEnv("FEDERATED_REDIRECT_URL")
+	if !redirectURLFound {
+		redirectURL = "http://localhost:3000/federated/callback"
+	}
+
+	return redirectURL
+}
+
+func federatedMetadataTTL() time.Duration {
+	return util.DurationFromEnv("FEDERATED_METADATA_TTL", time.Hour)
+}
+
+type providerMetadata struct {
+	configuration model.OpenIDConfiguration
+	jwks          model.JSONWebKeySet
+	fetchedAt     time.Time
+}
+
+var (
+	providerMetadataMutex sync.Mutex
+	providerMetadataCache = map[string]providerMetadata{}
+)
+
+// discoverProvider returns the cached discovery document and keys of an
+// issuer. refresh forces a new fetch, for keys the provider rotated in.
+func discoverProvider(provider FederatedProvider, refresh bool) (providerMetadata, error) {
+	providerMetadataMutex.Lock()
+	defer providerMetadataMutex.Unlock()
+
+	metadata, cached := providerMetadataCache[provider.Issuer]
+	if cached && !refresh && time.Since(metadata.fetchedAt) < federatedMetadataTTL() {
+		return metadata, nil
+	}
+
+	configuration, err := client.FetchOpenIDConfiguration(provider.Issuer)
+	if err != nil {
+		return providerMetadata{}, err
+	}
+
+	if configuration.Issuer != provider.Issuer || configuration.AuthorizationEndpoint == "" ||
+		configuration.TokenEndpoint == "" || configuration.JwksURI == "" {
+		return providerMetadata{}, errors.New("invalid discovery document of " + provider.Issuer)
+	}
+
+	jwks, err := client.FetchJSONWebKeySet(configuration.JwksURI)
+	if err != nil {
+		return providerMetadata{}, err
+	}
+
+	metadata = providerMetadata{configuration: configuration, jwks: jwks, fetchedAt: time.Now()}
+	providerMetadataCache[provider.Issuer] = metadata
+
+	return metadata, nil
+}
+
+func findProviderKey(jwks model.JSONWebKeySet, kid string) (interface{}, bool) {
+	for _, jwk := range jwks.Keys {
+		if jwk.Kid == kid && (jwk.Use == "" || jwk.Use == "sig") {
+			key, err := PublicKeyFromJWK(jwk)
+			return key, err == nil
+		}
+	}
+
+	return nil, false
+}
+
+// StartFederatedLogin returns the authorization URL of the provider. The
+// request uses PKCE and a nonce, both kept on the server with the state.
+func (service *UserService) StartFederatedLogin(providerName string, ctx context.Context) (model.FederatedLoginStartResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "startFederatedLoginService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	return service.startFederatedAuthorization(providerName, 0, ctx)
+}
+
+// startFederatedAuthorization sends the user to the provider, to sign in or,
+// with a linkUserId, to link the provider to that account.
+func (service *UserService) startFederatedAuthorization(providerName string, linkUserId uint, ctx context.Context) (model.FederatedLoginStartResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "startFederatedAuthorizationService")
+	defer span.Finish()
+
+	provider, providerFound := federatedProviders()[strings.ToLower(providerName)]
+	if !providerFound {
+		err := errors.New("unknown identity provider")
+		tracer.LogError(span, err)
+		return model.FederatedLoginStartResponse{}, err
+	}
+
+	metadata, err := discoverProvider(provider, false)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.FederatedLoginStartResponse{}, errors.New("identity provider is unavailable")
+	}
+
+	var randomValues [3]string
+	for i := range randomValues {
+		randomValues[i], err = util.GenerateOpaqueToken()
+		if err != nil {
+			tracer.LogError(span, err)
+			return model.FederatedLoginStartResponse{}, errors.New("error while starting federated login")
+		}
+	}
+	state, nonce, codeVerifier := randomValues[0], randomValues[1], randomValues[2]
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	_, err = service.Repo.CreateFederatedLoginState(model.FederatedLoginState{
+		StateHash:    util.HashToken(state),
+		Provider:     provider.Name,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		LinkUserId:   linkUserId,
+		ExpiresAt:    time.Now().Add(federatedLoginStateTTL),
+	}, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.FederatedLoginStartResponse{}, errors.New("error while starting federated login")
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", provider.ClientId)
+	params.Set("redirect_uri", federatedRedirectURL())
+	params.Set("scope", provider.Scopes)
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", pkceChallenge(codeVerifier))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(metadata.configuration.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return model.FederatedLoginStartResponse{
+		AuthorizationURL: metadata.configuration.AuthorizationEndpoint + separator + params.Encode(),
+	}, nil
+}
+
+// federatedIdentity is what a validated upstream ID token says about the user.
+type federatedIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	GivenName     string
+	FamilyName    string
+	Name          string
+}
+
+func (identity federatedIdentity) toUserIdentity(userId uint) model.UserIdentity {
+	now := time.Now()
+	return model.UserIdentity{UserId: userId, Provider: identity.Provider, Subject: identity.Subject, Email: identity.Email, LastUsedAt: &now}
+}
+
+// verifyFederatedIdToken checks the signature, issuer, audience, expiry and
+// nonce of an ID token issued by the provider.
+func verifyFederatedIdToken(provider FederatedProvider, metadata providerMetadata, idToken string, nonce string) (federatedIdentity, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if !federatedSigningAlgorithms[token.Method.Alg()] {
+			return nil, errors.New("unexpected signing algorithm " + token.Method.Alg())
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		key, keyFound := findProviderKey(metadata.jwks, kid)
+		if !keyFound {
+			refreshed, err := discoverProvider(provider, true)
+			if err != nil {
+				return nil, err
+			}
+			key, keyFound = findProviderKey(refreshed.jwks, kid)
+		}
+		if !keyFound {
+			return nil, errors.New("unknown signing key " + kid)
+		}
+
+		return key, nil
+	})
+	if err != nil || !token.Valid {
+		return federatedIdentity{}, errors.New("invalid id token")
+	}
+
+	if !claims.VerifyIssuer(provider.Issuer, true) {
+		return federatedIdentity{}, errors.New("id token was issued by another issuer")
+	}
+
+	// jwt-go only understands a single string audience, OpenID Connect allows
+	// a list. With several audiences the authorized party has to be us.
+	audiences := []string{}
+	switch aud := claims["aud"].(type) {
+	case string:
+		audiences = append(audiences, aud)
+	case []interface{}:
+		for _, audience := range aud {
+			if audience, isString := audience.(string); isString {
+				audiences = append(audiences, audience)
+			}
+		}
+	}
+	audienceFound := false
+	for _, audience := range audiences {
+		audienceFound = audienceFound || audience == provider.ClientId
+	}
+	if !audienceFound || (len(audiences) > 1 && claims["azp"] != provider.ClientId) {
+		return federatedIdentity{}, errors.New("id token was issued for another client")
+	}
+
+	if _, hasExpiry := claims["exp"]; !hasExpiry {
+		return federatedIdentity{}, errors.New("id token has no expiry")
+	}
+
+	if claimNonce, _ := claims["nonce"].(string); claimNonce == "" || claimNonce != nonce {
+		return federatedIdentity{}, errors.New("id token nonce does not match")
+	}
+
+	identity := federatedIdentity{}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.GivenName, _ = claims["given_name"].(string)
+	identity.FamilyName, _ = claims["family_name"].(string)
+	identity.Name, _ = claims["name"].(string)
+
+	// Some providers send email_verified as a string.
+	switch emailVerified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = emailVerified
+	case string:
+		identity.EmailVerified = strings.EqualFold(emailVerified, "true")
+	}
+
+	if identity.Subject == "" || identity.Email == "" {
+		return federatedIdentity{}, errors.New("id token has no subject or email")
+	}
+
+	return identity, nil
+}
+
+// finishFederatedAuthorization consumes the state, exchanges the code the
+// provider returned and verifies its ID token.
+func (service *UserService) finishFederatedAuthorization(state string, code string, ctx context.Context) (model.FederatedLoginState, federatedIdentity, error) {
+	span := tracer.StartSpanFromContext(ctx, "finishFederatedAuthorizationService")
+	defer span.Finish()
+
+	invalidStateErr := errors.New("invalid or expired login attempt")
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	loginState, err := service.Repo.FindFederatedLoginStateByHash(util.HashToken(state), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.FederatedLoginState{}, federatedIdentity{}, invalidStateErr
+	}
+
+	consumed, err := service.Repo.DeleteFederatedLoginState(loginState.ID, ctx)
+	if err != nil || !consumed {
+		tracer.LogError(span, invalidStateErr)
+		return model.FederatedLoginState{}, federatedIdentity{}, invalidStateErr
+	}
+
+	provider, providerFound := federatedProviders()[loginState.Provider]
+	if !providerFound {
+		err := errors.New("unknown identity provider")
+		tracer.LogError(span, err)
+		return model.FederatedLoginState{}, federatedIdentity{}, err
+	}
+
+	metadata, err := discoverProvider(provider, false)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.FederatedLoginState{}, federatedIdentity{}, errors.New("identity provider is unavailable")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", federatedRedirectURL())
+	form.Set("code_verifier", loginState.CodeVerifier)
+	form.Set("client_id", provider.ClientId)
+	if provider.ClientSecret != "" {
+		form.Set("client_secret", provider.ClientSecret)
+	}
+
+	tokenResponse, err := client.ExchangeAuthorizationCode(metadata.configuration.TokenEndpoint, form)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.FederatedLoginState{}, federatedIdentity{}, errors.New("identity provider rejected the login")
+	}
+
+	identity, err := verifyFederatedIdToken(provider, metadata, tokenResponse.IdToken, loginState.Nonce)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.FederatedLoginState{}, federatedIdentity{}, err
+	}
+	identity.Provider = provider.Name
+
+	return loginState, identity, nil
+}
+
+// CompleteFederatedLogin signs in the account the provider identity is
+// linked to. Unknown identities are linked to the account with the same
+// email when the provider verified it, or get a new GUEST account.
+func (service *UserService) CompleteFederatedLogin(state string, code string, clientInfo model.ClientInfo, ctx context.Context) (model.LoginResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "completeFederatedLoginService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	loginState, identity, err := service.finishFederatedAuthorization(state, code, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, err
+	}
+
+	if loginState.LinkUserId != 0 {
+		err := errors.New("invalid or expired login attempt")
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, err
+	}
+
+	user, err := service.resolveFederatedUser(identity, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, err
+	}
+
+	if user.Suspended {
+		err := errors.New("account is suspended")
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, err
+	}
+
+	if !user.Verified && unverifiedPolicy() == UNVERIFIED_DENY {
+		tracer.LogError(span, ErrEmailNotVerified)
+		return model.LoginResponse{}, ErrEmailNotVerified
+	}
+
+	if user.TotpEnabled {
+		return service.mfaChallenge(user, ctx)
+	}
+
+	return service.startLoginSession(user, clientInfo, ctx)
+}
+
+// resolveFederatedUser finds the account of a federated identity, links it
+// to the account with the same verified email or provisions a GUEST account
+// for it. An account that never verified its email may have been registered
+// by somebody else ahead of its owner, so linking it takes it over: the
+// password identity is removed and every token issued so far is rejected.
+func (service *UserService) resolveFederatedUser(identity federatedIdentity, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "resolveFederatedUserService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, linkedIdentity, err := service.Repo.FindUserByIdentity(identity.Provider, identity.Subject, ctx)
+	if err == nil {
+		service.touchIdentity(linkedIdentity, ctx)
+		return user, nil
+	}
+
+	user, err = service.Repo.FindUserByEmail(identity.Email, ctx)
+	if err == nil {
+		if !identity.EmailVerified {
+			err := errors.New("the identity provider has not verified this email address")
+			tracer.LogError(span, err)
+			return model.User{}, err
+		}
+
+		_, err = service.Repo.CreateUserIdentity(identity.toUserIdentity(user.ID), ctx)
+		if err != nil {
+			tracer.LogError(span, err)
+			return model.User{}, errors.New("error while linking identity")
+		}
+
+		if !user.Verified {
+			return service.takeOverUnverifiedUser(user, ctx)
+		}
+
+		return user, nil
+	}
+
+	return service.provisionFederatedUser(identity, ctx)
+}
+
+// takeOverUnverifiedUser hands an unverified account to the owner of its
+// email, as the identity provider vouched for it.
+func (service *UserService) takeOverUnverifiedUser(user model.User, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "takeOverUnverifiedUserService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	for _, userIdentity := range service.Repo.FindUserIdentities(user.ID, ctx) {
+		if userIdentity.Provider != model.PASSWORD_IDENTITY {
+			continue
+		}
+
+		if _, err := service.Repo.DeleteUserIdentity(user.ID, userIdentity.ID, ctx); err != nil {
+			tracer.LogError(span, err)
+			return model.User{}, errors.New("error while linking identity")
+		}
+	}
+
+	if err := service.invalidateUserTokens(user.ID, ctx); err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("error while linking identity")
+	}
+
+	if err := service.Repo.MarkUserVerified(user.ID, user.Email, ctx); err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("error while verifying email")
+	}
+
+	user, err := service.Repo.FindUserById(uint64(user.ID), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("user with given id does not exist")
+	}
+
+	return user, nil
+}
+
+// provisionFederatedUser creates a GUEST account with an unusable random
+// password and no password identity, the user can add one later.
+func (service *UserService) provisionFederatedUser(identity federatedIdentity, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "provisionFederatedUserService")
+	defer span.Finish()
+
+	randomPassword, err := util.GenerateOpaqueToken()
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("error while trying to save user")
+	}
+
+	hash, err := service.passwordHasher().Hash(randomPassword)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("error while trying to save user")
+	}
+
+	localPart, _, _ := strings.Cut(identity.Email, "@")
+	name, surname := identity.GivenName, identity.FamilyName
+	if name == "" {
+		name, surname, _ = strings.Cut(identity.Name, " ")
+	}
+	if name == "" {
+		name = localPart
+	}
+	if surname == "" {
+		surname = "-"
+	}
+
+	now := time.Now()
+	user := model.User{
+		Email:             identity.Email,
+		Username:          fmt.Sprintf("%s-%s", localPart, randomPassword[:6]),
+		Password:          hash,
+		Name:              name,
+		Surname:           surname,
+		Role:              model.GUEST,
+		Verified:          identity.EmailVerified,
+		PasswordChangedAt: &now,
+	}
+	applyNotificationDefaults(&user, user.Role)
+
+	// Magic links only go to addresses the provider has vouched for.
+	identities := []model.UserIdentity{identity.toUserIdentity(0)}
+	if identity.EmailVerified {
+		identities = append(identities, model.EmailIdentity(model.MAGIC_LINK_IDENTITY, user))
+	}
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	createdUser, err := service.Repo.CreateUser(user, identities, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("error while trying to save user")
+	}
+
+	if !createdUser.Verified {
+		err = service.sendVerificationEmail(createdUser, ctx)
+		if err != nil {
+			tracer.LogError(span, err)
+		}
+	}
+
+	return createdUser, nil
+}
@@ -0,0 +1,428 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/sms"
+	"github.com/windbnb/user-service/tracer"
+	"github.com/windbnb/user-service/util"
+)
+
+// phonePattern is the E.164 form phones are stored in, such as +381641234567.
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// hostOnboardingTransitions are the only moves of the onboarding state.
+var hostOnboardingTransitions = map[model.HostOnboardingState]model.HostOnboardingState{
+	model.HOST_ONBOARDING_NOT_STARTED: model.HOST_ONBOARDING_IN_PROGRESS,
+	model.HOST_ONBOARDING_IN_PROGRESS: model.HOST_ONBOARDING_COMPLETED,
+}
+
+// HostTermsVersion is the version of the host terms users accept during
+// onboarding. Accepting an older version does not count.
+func HostTermsVersion() string {
+	version, versionFound := os.LookupEnv("HOST_TERMS_VERSION")
+	if !versionFound {
+		version = "2024-01"
+	}
+
+	return version
+}
+
+func phoneCodeTTL() time.Duration {
+	return util.DurationFromEnv("PHONE_CODE_TTL", 10*time.Minute)
+}
+
+func phoneCodeResendInterval() time.Duration {
+	return util.DurationFromEnv("PHONE_CODE_RESEND_INTERVAL", time.Minute)
+}
+
+func phoneCodeMaxAttempts() int {
+	return util.IntFromEnv("PHONE_CODE_MAX_ATTEMPTS", 5)
+}
+
+// normalizePhone drops the separators people type in phone numbers.
+func normalizePhone(phone string) string {
+	return strings.NewReplacer(" ", "", "-", "", "(", "", ")", "", ".", "").Replace(strings.TrimSpace(phone))
+}
+
+// phoneCodeHash binds the code to the phone it was sent to.
+func phoneCodeHash(phone string, code string) string {
+	return util.HashToken(phone + ":" + code)
+}
+
+// hostOnboardingState treats users stored before onboarding existed as not
+// started.
+func hostOnboardingState(user model.User) model.HostOnboardingState {
+	if user.HostOnboarding == "" {
+		return model.HOST_ONBOARDING_NOT_STARTED
+	}
+
+	return user.HostOnboarding
+}
+
+func transitionHostOnboarding(user *model.User, state model.HostOnboardingState) error {
+	if hostOnboardingTransitions[hostOnboardingState(*user)] != state {
+		return fmt.Errorf("host onboarding cannot move from %s to %s", hostOnboardingState(*user), state)
+	}
+
+	user.HostOnboarding = state
+	return nil
+}
+
+// missingHostRequirements lists what the user still has to do before
+// onboarding can be completed.
+func missingHostRequirements(user model.User) []string {
+	missing := []string{}
+	if strings.TrimSpace(user.Name) == "" || strings.TrimSpace(user.Surname) == "" || strings.TrimSpace(user.Address) == "" || user.Phone == "" {
+		missing = append(missing, model.HOST_REQUIREMENT_PROFILE)
+	}
+	if user.HostTermsVersion != HostTermsVersion() {
+		missing = append(missing, model.HOST_REQUIREMENT_TERMS)
+	}
+	if !user.Verified {
+		missing = append(missing, model.HOST_REQUIREMENT_EMAIL_VERIFIED)
+	}
+	if !user.PhoneVerified {
+		missing = append(missing, model.HOST_REQUIREMENT_PHONE_VERIFIED)
+	}
+
+	return missing
+}
+
+func hostOnboardingResponse(user model.User) model.HostOnboardingResponse {
+	missing := missingHostRequirements(user)
+	if hostOnboardingState(user) == model.HOST_ONBOARDING_COMPLETED {
+		missing = []string{}
+	}
+
+	return model.HostOnboardingResponse{State: hostOnboardingState(user), Missing: missing, TermsVersion: HostTermsVersion()}
+}
+
+// onboardingUser finds a user whose onboarding is in progress, the steps of
+// onboarding are only open then.
+func (service *UserService) onboardingUser(userId uint64, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "onboardingUserService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, err := service.Repo.FindUserById(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("user with given id does not exist")
+	}
+
+	if hostOnboardingState(user) != model.HOST_ONBOARDING_IN_PROGRESS {
+		err := errors.New("host onboarding is not in progress")
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
+
+	return user, nil
+}
+
+func (service *UserService) HostOnboardingStatus(userId uint64, ctx context.Context) (model.HostOnboardingResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "hostOnboardingStatusService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, err := service.Repo.FindUserById(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.HostOnboardingResponse{}, errors.New("user with given id does not exist")
+	}
+
+	return hostOnboardingResponse(user), nil
+}
+
+// StartHostOnboarding lets a guest start becoming a host. Starting again
+// while in progress only returns the state.
+func (service *UserService) StartHostOnboarding(userId uint64, ctx context.Context) (model.HostOnboardingResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "startHostOnboardingService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, err := service.Repo.FindUserById(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.HostOnboardingResponse{}, errors.New("user with given id does not exist")
+	}
+
+	if hostOnboardingState(user) == model.HOST_ONBOARDING_IN_PROGRESS {
+		return hostOnboardingResponse(user), nil
+	}
+
+	roles := service.userRoles(user, ctx)
+	if hasRole(roles, model.HOST) {
+		err := errors.New("user already has this role")
+		tracer.LogError(span, err)
+		return model.HostOnboardingResponse{}, err
+	}
+
+	if !hasRole(roles, model.GUEST) {
+		err := errors.New("only guests can become hosts")
+		tracer.LogError(span, err)
+		return model.HostOnboardingResponse{}, err
+	}
+
+	err = transitionHostOnboarding(&user, model.HOST_ONBOARDING_IN_PROGRESS)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.HostOnboardingResponse{}, err
+	}
+
+	user, err = service.Repo.UpdateUser(user, []string{"host_onboarding"}, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.HostOnboardingResponse{}, errors.New("error while saving user")
+	}
+
+	return hostOnboardingResponse(user), nil
+}
+
+// UpdateHostProfile fills in the profile fields hosts need. A new phone has
+// to be verified again.
+func (service *UserService) UpdateHostProfile(userId uint64, profile model.HostProfileRequest, ctx context.Context) (model.HostOnboardingResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "updateHostProfileService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, err := service.onboardingUser(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.HostOnboardingResponse{}, err
+	}
+
+	name, surname, address := strings.TrimSpace(profile.Name), strings.TrimSpace(profile.Surname), strings.TrimSpace(profile.Address)
+	if name == "" || surname == "" || address == "" {
+		err := errors.New("name, surname and address are required")
+		tracer.LogError(span, err)
+		return model.HostOnboardingResponse{}, err
+	}
+
+	phone := normalizePhone(profile.Phone)
+	if !phonePattern.MatchString(phone) {
+		err := errors.New("phone must be in international format, such as +381641234567")
+		tracer.LogError(span, err)
+		return model.HostOnboardingResponse{}, err
+	}
+
+	user.Name, user.Surname, user.Address = name, surname, address
+	if user.Phone != phone {
+		user.Phone = phone
+		user.PhoneVerified = false
+	}
+
+	user, err = service.Repo.UpdateUser(user, []string{"name", "surname", "address", "phone", "phone_verified"}, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.HostOnboardingResponse{}, errors.New("error while saving user")
+	}
+
+	return hostOnboardingResponse(user), nil
+}
+
+// AcceptHostTerms records the version of the host terms the user accepted,
+// it has to be the current one.
+func (service *UserService) AcceptHostTerms(userId uint64, version string, ctx context.Context) (model.HostOnboardingResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "acceptHostTermsService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, err := service.onboardingUser(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.HostOnboardingResponse{}, err
+	}
+
+	if version != HostTermsVersion() {
+		err := errors.New("the host terms have changed, accept the current version")
+		tracer.LogError(span, err)
+		return model.HostOnboardingResponse{}, err
+	}
+
+	now := time.Now()
+	user.HostTermsVersion = version
+	user.HostTermsAcceptedAt = &now
+
+	user, err = service.Repo.UpdateUser(user, []string{"host_terms_version", "host_terms_accepted_at"}, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.HostOnboardingResponse{}, errors.New("error while saving user")
+	}
+
+	return hostOnboardingResponse(user), nil
+}
+
+// SendPhoneCode texts a code to the phone of the profile. A new code
+// replaces the previous one, at most one is sent per resend interval.
+func (service *UserService) SendPhoneCode(userId uint64, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "sendPhoneCodeService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, err := service.onboardingUser(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return err
+	}
+
+	if user.Phone == "" {
+		err := errors.New("add a phone to your profile first")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	if user.PhoneVerified {
+		err := errors.New("phone is already verified")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	if previous, err := service.Repo.FindPhoneVerification(user.ID, ctx); err == nil && time.Since(previous.CreatedAt) < phoneCodeResendInterval() {
+		err := errors.New("wait a minute before asking for another code")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	code, err := util.GenerateNumericCode(6)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while sending code")
+	}
+
+	ttl := phoneCodeTTL()
+	_, err = service.Repo.CreatePhoneVerification(model.PhoneVerification{UserId: user.ID, Phone: user.Phone,
+		CodeHash: phoneCodeHash(user.Phone, code), ExpiresAt: time.Now().Add(ttl)}, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while sending code")
+	}
+
+	err = service.smsSender().Send(sms.Message{
+		To:   user.Phone,
+		Body: fmt.Sprintf("Your windbnb verification code is %s, it expires in %s.", code, ttl),
+	})
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while sending code")
+	}
+
+	return nil
+}
+
+// VerifyPhone checks a texted code. Every try uses up an attempt of the code,
+// after the last one a new code has to be sent.
+func (service *UserService) VerifyPhone(userId uint64, code string, ctx context.Context) (model.HostOnboardingResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "verifyPhoneService")
+	defer span.Finish()
+
+	invalidCodeErr := errors.New("invalid or expired code")
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, err := service.onboardingUser(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.HostOnboardingResponse{}, err
+	}
+
+	verification, err := service.Repo.FindPhoneVerification(user.ID, ctx)
+	if err != nil || verification.UsedAt != nil || verification.Phone != user.Phone || time.Now().After(verification.ExpiresAt) {
+		tracer.LogError(span, invalidCodeErr)
+		return model.HostOnboardingResponse{}, invalidCodeErr
+	}
+
+	attempted, err := service.Repo.RecordPhoneVerificationAttempt(verification.ID, phoneCodeMaxAttempts(), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.HostOnboardingResponse{}, errors.New("error while verifying phone")
+	}
+
+	if !attempted {
+		err := errors.New("too many attempts, ask for a new code")
+		tracer.LogError(span, err)
+		return model.HostOnboardingResponse{}, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(phoneCodeHash(user.Phone, strings.TrimSpace(code))), []byte(verification.CodeHash)) != 1 {
+		tracer.LogError(span, invalidCodeErr)
+		return model.HostOnboardingResponse{}, invalidCodeErr
+	}
+
+	verified, err := service.Repo.MarkPhoneVerified(verification, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.HostOnboardingResponse{}, errors.New("error while verifying phone")
+	}
+
+	if !verified {
+		tracer.LogError(span, invalidCodeErr)
+		return model.HostOnboardingResponse{}, invalidCodeErr
+	}
+
+	user.PhoneVerified = true
+	return hostOnboardingResponse(user), nil
+}
+
+// CompleteHostOnboarding grants HOST once every requirement is met. The user
+// gets the host notification defaults and a host.onboarded event is written
+// for the accommodation service, all in one transaction. The user keeps
+// their sessions and switches to the new role when they want to.
+func (service *UserService) CompleteHostOnboarding(userId uint64, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "completeHostOnboardingService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, err := service.onboardingUser(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
+
+	if missing := missingHostRequirements(user); len(missing) > 0 {
+		err := errors.New("host onboarding is missing " + strings.Join(missing, ", "))
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
+
+	if _, err := service.Repo.FindRole(model.HOST, ctx); err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
+
+	if hasRole(service.userRoles(user, ctx), model.HOST) {
+		err := errors.New("user already has this role")
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
+
+	err = transitionHostOnboarding(&user, model.HOST_ONBOARDING_COMPLETED)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
+	applyNotificationDefaults(&user, model.HOST)
+
+	payload, err := json.Marshal(model.HostOnboardedEvent{UserId: user.ID, Email: user.Email, Name: user.Name, Surname: user.Surname,
+		Address: user.Address, Phone: user.Phone, OnboardedAt: time.Now().UTC()})
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("error while saving user")
+	}
+
+	user, err = service.Repo.CompleteHostOnboarding(user, model.OutboxEvent{Type: model.EVENT_HOST_ONBOARDED, Payload: string(payload)}, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("error while saving user")
+	}
+
+	return user, nil
+}
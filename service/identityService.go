@@ -0,0 +1,275 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+	"github.com/windbnb/user-service/util"
+)
+
+// reauthenticationWindow is how recent a sign in has to be to stand in for
+// the password on accounts that do not have one.
+func reauthenticationWindow() time.Duration {
+	return util.DurationFromEnv("REAUTHENTICATION_WINDOW", 5*time.Minute)
+}
+
+// touchIdentity records the use of an identity, failures are only traced.
+func (service *UserService) touchIdentity(identity model.UserIdentity, ctx context.Context) {
+	span := tracer.StartSpanFromContext(ctx, "touchIdentityService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	if err := service.Repo.TouchUserIdentity(identity.ID, time.Now(), ctx); err != nil {
+		tracer.LogError(span, err)
+	}
+}
+
+func findIdentity(identities []model.UserIdentity, provider string) (model.UserIdentity, bool) {
+	for _, identity := range identities {
+		if identity.Provider == provider {
+			return identity, true
+		}
+	}
+
+	return model.UserIdentity{}, false
+}
+
+// updateEmailIdentities moves the email keyed identities to the current
+// email of the user.
+func (service *UserService) updateEmailIdentities(user model.User, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "updateEmailIdentitiesService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	for _, provider := range model.EmailIdentityProviders {
+		err := service.Repo.UpdateUserIdentity(user.ID, provider, model.IdentitySubject(user.Email), user.Email, ctx)
+		if err != nil {
+			tracer.LogError(span, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ensurePasswordIdentity links the password identity once the user has set a
+// password through a flow that proved access to the email address.
+func (service *UserService) ensurePasswordIdentity(user model.User, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "ensurePasswordIdentityService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	if _, linked := findIdentity(service.Repo.FindUserIdentities(user.ID, ctx), model.PASSWORD_IDENTITY); linked {
+		return nil
+	}
+
+	_, err := service.Repo.CreateUserIdentity(model.EmailIdentity(model.PASSWORD_IDENTITY, user), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while linking identity")
+	}
+
+	return nil
+}
+
+// reauthenticate asks for the current password before an account change.
+// Accounts without a password identity instead need a token whose auth_time
+// is within the re-authentication window.
+func (service *UserService) reauthenticate(user model.User, tokenString string, password string, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "reauthenticateService")
+	defer span.Finish()
+
+	reauthenticationErr := errors.New("re-authentication failed")
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	if _, hasPassword := findIdentity(service.Repo.FindUserIdentities(user.ID, ctx), model.PASSWORD_IDENTITY); hasPassword {
+		err := service.checkLoginThrottle(user.Email, "", passwordLoginMethod, ctx)
+		if err != nil {
+			return err
+		}
+
+		if valid, _ := util.VerifyPassword(service.passwordHasher(), password, user.Password); !valid {
+			tracer.LogError(span, reauthenticationErr)
+			service.recordLoginFailure(user.Email, "", passwordLoginMethod, ctx)
+			return reauthenticationErr
+		}
+
+		return nil
+	}
+
+	claims, err := service.parseToken(tokenString, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return reauthenticationErr
+	}
+
+	if time.Since(time.Unix(claims.AuthTime, 0)) > reauthenticationWindow() {
+		err := errors.New("sign in again to confirm it is you")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	return nil
+}
+
+func (service *UserService) ListIdentities(userId uint64, ctx context.Context) []model.UserIdentityDTO {
+	span := tracer.StartSpanFromContext(ctx, "listIdentitiesService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	identities := []model.UserIdentityDTO{}
+	for _, identity := range service.Repo.FindUserIdentities(uint(userId), ctx) {
+		identities = append(identities, identity.ToDTO())
+	}
+
+	return identities
+}
+
+// LinkPasswordIdentity lets an account that signs in through a provider add
+// a password.
+func (service *UserService) LinkPasswordIdentity(userId uint64, tokenString string, newPassword string, ctx context.Context) (model.UserIdentityDTO, error) {
+	span := tracer.StartSpanFromContext(ctx, "linkPasswordIdentityService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, err := service.Repo.FindUserById(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.UserIdentityDTO{}, err
+	}
+
+	if _, linked := findIdentity(service.Repo.FindUserIdentities(user.ID, ctx), model.PASSWORD_IDENTITY); linked {
+		err := errors.New("a password is already linked, change it instead")
+		tracer.LogError(span, err)
+		return model.UserIdentityDTO{}, err
+	}
+
+	err = service.reauthenticate(user, tokenString, "", ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.UserIdentityDTO{}, err
+	}
+
+	err = service.validatePassword("newPassword", newPassword, user.Email, user.Username)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.UserIdentityDTO{}, err
+	}
+
+	hash, err := service.passwordHasher().Hash(newPassword)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.UserIdentityDTO{}, errors.New("error while saving user")
+	}
+
+	now := time.Now()
+	user.Password = hash
+	user.PasswordChangedAt = &now
+
+	_, err = service.Repo.UpdateUser(user, []string{"password", "password_changed_at"}, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.UserIdentityDTO{}, errors.New("error while saving user")
+	}
+
+	identity, err := service.Repo.CreateUserIdentity(model.EmailIdentity(model.PASSWORD_IDENTITY, user), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.UserIdentityDTO{}, errors.New("error while linking identity")
+	}
+
+	return identity.ToDTO(), nil
+}
+
+// StartIdentityLink sends a re-authenticated user to a provider, the
+// callback links the provider identity to the account.
+func (service *UserService) StartIdentityLink(userId uint64, tokenString string, providerName string, password string, ctx context.Context) (model.FederatedLoginStartResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "startIdentityLinkService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, err := service.Repo.FindUserById(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.FederatedLoginStartResponse{}, err
+	}
+
+	err = service.reauthenticate(user, tokenString, password, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.FederatedLoginStartResponse{}, err
+	}
+
+	return service.startFederatedAuthorization(providerName, user.ID, ctx)
+}
+
+func (service *UserService) CompleteIdentityLink(userId uint64, state string, code string, ctx context.Context) (model.UserIdentityDTO, error) {
+	span := tracer.StartSpanFromContext(ctx, "completeIdentityLinkService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	loginState, identity, err := service.finishFederatedAuthorization(state, code, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.UserIdentityDTO{}, err
+	}
+
+	if loginState.LinkUserId == 0 || loginState.LinkUserId != uint(userId) {
+		err := errors.New("invalid or expired login attempt")
+		tracer.LogError(span, err)
+		return model.UserIdentityDTO{}, err
+	}
+
+	if linkedUser, _, err := service.Repo.FindUserByIdentity(identity.Provider, identity.Subject, ctx); err == nil {
+		err := errors.New("this identity is already linked to an account")
+		if linkedUser.ID == uint(userId) {
+			err = errors.New("this identity is already linked to your account")
+		}
+		tracer.LogError(span, err)
+		return model.UserIdentityDTO{}, err
+	}
+
+	userIdentity, err := service.Repo.CreateUserIdentity(identity.toUserIdentity(uint(userId)), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.UserIdentityDTO{}, errors.New("error while linking identity")
+	}
+
+	return userIdentity.ToDTO(), nil
+}
+
+// UnlinkIdentity removes one way of signing in, never the last one.
+func (service *UserService) UnlinkIdentity(userId uint64, identityId uint64, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "unlinkIdentityService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	identities := service.Repo.FindUserIdentities(uint(userId), ctx)
+
+	found := false
+	for _, identity := range identities {
+		found = found || identity.ID == uint(identityId)
+	}
+	if !found {
+		err := errors.New("identity does not exist")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	deleted, err := service.Repo.DeleteUserIdentity(uint(userId), uint(identityId), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while unlinking identity")
+	}
+
+	if !deleted {
+		err := errors.New("cannot remove the last way to sign in")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+)
+
+// validateAccessToken checks an access token against the current state of
+// the account and of its session.
+func (service *UserService) validateAccessToken(tokenString string, ctx context.Context) (*model.Claims, model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "validateAccessTokenService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	claims, err := service.parseToken(tokenString, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return nil, model.User{}, err
+	}
+
+	user, err := service.Repo.FindUserById(uint64(claims.Id), ctx)
+	if err != nil || user.Suspended || user.TokenVersion != claims.TokenVersion {
+		err := errors.New("token is no longer valid")
+		tracer.LogError(span, err)
+		return nil, model.User{}, err
+	}
+
+	err = service.checkSession(claims, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return nil, model.User{}, err
+	}
+
+	return claims, user, nil
+}
+
+// introspectToken describes an access token, any problem with it makes it
+// inactive without saying why.
+func (service *UserService) introspectToken(tokenString string, ctx context.Context) (model.IntrospectionResponse, model.User) {
+	span := tracer.StartSpanFromContext(ctx, "introspectTokenService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	claims, user, err := service.validateAccessToken(tokenString, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.IntrospectionResponse{Active: false}, model.User{}
+	}
+
+	return model.IntrospectionResponse{
+		Active:        true,
+		Scope:         claims.Scope,
+		ClientId:      claims.ClientId,
+		TokenType:     "Bearer",
+		Exp:           claims.ExpiresAt,
+		Iat:           claims.IssuedAt,
+		Sub:           fmt.Sprint(user.ID),
+		Iss:           claims.Issuer,
+		Jti:           claims.StandardClaims.Id,
+		Role:          claims.Role,
+		SessionId:     claims.SessionId,
+		EmailVerified: user.Verified,
+		AuthTime:      claims.AuthTime,
+	}, user
+}
+
+// Introspect answers RFC 7662 introspection requests of confidential clients.
+// Service clients, the services that need to check the tokens sent to them,
+// get any token described. Other clients only get the tokens issued to them,
+// every other token is inactive to them. User access tokens and service
+// tokens are described, refresh tokens are always inactive.
+func (service *UserService) Introspect(request model.IntrospectionRequest, ctx context.Context) (model.IntrospectionResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "introspectService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	client, err := service.authenticateClient(request.ClientId, request.ClientSecret, request.ClientCertificateThumbprint, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.IntrospectionResponse{}, err
+	}
+
+	if client.Public {
+		err := oauthError("invalid_client", "public clients cannot introspect tokens")
+		tracer.LogError(span, err)
+		return model.IntrospectionResponse{}, err
+	}
+
+	if request.Token == "" {
+		err := oauthError("invalid_request", "token is required")
+		tracer.LogError(span, err)
+		return model.IntrospectionResponse{}, err
+	}
+
+	introspection, _ := service.introspectToken(request.Token, ctx)
+	if !introspection.Active {
+		introspection = service.introspectServiceToken(request.Token, ctx)
+	}
+
+	if !client.Service && introspection.ClientId != client.ClientId {
+		return model.IntrospectionResponse{Active: false}, nil
+	}
+
+	return introspection, nil
+}
+
+// AuthoriseRole backs the role specific authorise routes other services
+// called before introspection existed. Tokens issued to third party clients
+// are not accepted there.
+func (service *UserService) AuthoriseRole(tokenString string, role model.UserRole, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "authoriseRoleService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	introspection, user := service.introspectToken(tokenString, ctx)
+	if !introspection.Active || introspection.ClientId != "" {
+		err := errors.New("token is not active")
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
+
+	if introspection.Role != role {
+		err := errors.New("user does not have said role")
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
+
+	if !introspection.EmailVerified && unverifiedPolicy() != UNVERIFIED_ALLOW {
+		tracer.LogError(span, ErrEmailNotVerified)
+		return model.User{}, ErrEmailNotVerified
+	}
+
+	return user, nil
+}
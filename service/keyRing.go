@@ -0,0 +1,617 @@
+package service
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/windbnb/user-service/model"
+)
+
+type KeyStatus string
+
+const (
+	KeyActive  KeyStatus = "active"
+	KeyRetired KeyStatus = "retired"
+)
+
+const keyRingRefreshInterval = 30 * time.Second
+
+// keyRingUnknownKidInterval limits the reloads tokens with an unknown kid
+// cause, made up kids must not make every request read the disk.
+const keyRingUnknownKidInterval = 5 * time.Second
+
+// SigningMethodEdDSA adds Ed25519 support, which jwt-go v3 lacks.
+var SigningMethodEdDSA = &signingMethodEd25519{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+type signingMethodEd25519 struct{}
+
+func (method *signingMethodEd25519) Alg() string {
+	return "EdDSA"
+}
+
+func (method *signingMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+func (method *signingMethodEd25519) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return errors.New("EdDSA verification failed")
+	}
+
+	return nil
+}
+
+type SigningKey struct {
+	Kid       string     `json:"kid"`
+	Algorithm string     `json:"alg"`
+	Status    KeyStatus  `json:"status"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RetiredAt *time.Time `json:"retiredAt,omitempty"`
+	secret    interface{}
+}
+
+// PublicKey returns the key used for verification: the public half of an
+// asymmetric key pair, or the shared secret for HS256.
+func (key *SigningKey) PublicKey() interface{} {
+	if signer, ok := key.secret.(crypto.Signer); ok {
+		return signer.Public()
+	}
+
+	return key.secret
+}
+
+type keyRingFile struct {
+	Current string            `json:"current"`
+	Keys    []keyRingFileItem `json:"keys"`
+}
+
+type keyRingFileItem struct {
+	SigningKey
+	PrivateKey string `json:"privateKey"`
+}
+
+// KeyRing holds the JWT signing keys. Tokens are signed with the current key
+// and verified against any key that has not been retired. The ring is stored
+// as a JSON file, so it survives restarts and can be shared by replicas
+// through a mounted volume or secret.
+type KeyRing struct {
+	path        string
+	mutex       sync.RWMutex
+	current     string
+	keys        map[string]*SigningKey
+	modTime     time.Time
+	lastChecked time.Time
+	// lastUnknownKid is when an unknown kid last forced a reload.
+	lastUnknownKid time.Time
+}
+
+// LoadKeyRing reads the ring from JWT_KEY_RING_PATH. When the file does not
+// exist yet a ring with a single JWT_SIGNING_ALGORITHM key is created there.
+func LoadKeyRing() (*KeyRing, error) {
+	path, pathFound := os.LookupEnv("JWT_KEY_RING_PATH")
+	if !pathFound {
+		path = "keys/jwt-keyring.json"
+	}
+
+	keyRing := &KeyRing{path: path, keys: map[string]*SigningKey{}}
+	err := keyRing.reload()
+	if err == nil {
+		return keyRing, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if _, err := keyRing.Rotate(defaultSigningAlgorithm()); err != nil {
+		return nil, err
+	}
+
+	return keyRing, nil
+}
+
+// NewInMemoryKeyRing returns a ring that is never written to disk.
+func NewInMemoryKeyRing(algorithm string) (*KeyRing, error) {
+	keyRing := &KeyRing{keys: map[string]*SigningKey{}}
+	if _, err := keyRing.Rotate(algorithm); err != nil {
+		return nil, err
+	}
+
+	return keyRing, nil
+}
+
+func defaultSigningAlgorithm() string {
+	algorithm, algorithmFound := os.LookupEnv("JWT_SIGNING_ALGORITHM")
+	if !algorithmFound {
+		algorithm = jwt.SigningMethodRS256.Alg()
+	}
+
+	return algorithm
+}
+
+// Sign signs the claims with the current key and sets its kid header.
+func (keyRing *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	keyRing.refresh()
+
+	key, found := keyRing.find(keyRing.Current())
+	if !found {
+		return "", errors.New("no signing key available")
+	}
+
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.Kid
+
+	return token.SignedString(key.secret)
+}
+
+// Keyfunc resolves the verification key of a token by its kid header.
+func (keyRing *KeyRing) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, found := keyRing.find(kid)
+	if !found {
+		keyRing.mutex.Lock()
+		if time.Since(keyRing.lastUnknownKid) >= keyRingUnknownKidInterval {
+			keyRing.lastUnknownKid = time.Now()
+			keyRing.lastChecked = time.Time{}
+		}
+		keyRing.mutex.Unlock()
+		keyRing.refresh()
+		key, found = keyRing.find(kid)
+	}
+
+	if !found || key.Status == KeyRetired {
+		return nil, errors.New("unknown or retired signing key")
+	}
+
+	if token.Method.Alg() != key.Algorithm {
+		return nil, errors.New("unexpected signing algorithm")
+	}
+
+	return key.PublicKey(), nil
+}
+
+func (keyRing *KeyRing) find(kid string) (SigningKey, bool) {
+	keyRing.mutex.RLock()
+	defer keyRing.mutex.RUnlock()
+
+	key, found := keyRing.keys[kid]
+	if !found {
+		return SigningKey{}, false
+	}
+
+	return *key, true
+}
+
+// Keys lists the keys of the ring, newest first.
+func (keyRing *KeyRing) Keys() []SigningKey {
+	keyRing.refresh()
+
+	keyRing.mutex.RLock()
+	defer keyRing.mutex.RUnlock()
+
+	keys := []SigningKey{}
+	for _, key := range keyRing.keys {
+		keys = append(keys, *key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+
+	return keys
+}
+
+// Current returns the kid of the key new tokens are signed with.
+func (keyRing *KeyRing) Current() string {
+	keyRing.mutex.RLock()
+	defer keyRing.mutex.RUnlock()
+
+	return keyRing.current
+}
+
+// Rotate generates a new key and makes it the signing key. Previous keys stay
+// active for verification until they are retired.
+func (keyRing *KeyRing) Rotate(algorithm string) (SigningKey, error) {
+	key, err := generateSigningKey(algorithm)
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	err = keyRing.modify(func() error {
+		keyRing.keys[key.Kid] = key
+		keyRing.current = key.Kid
+		return nil
+	})
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	return *key, nil
+}
+
+// Retire stops accepting tokens signed with the given key.
+func (keyRing *KeyRing) Retire(kid string) error {
+	return keyRing.modify(func() error {
+		key := keyRing.keys[kid]
+		if key == nil {
+			return errors.New("signing key with given kid does not exist")
+		}
+
+		if kid == keyRing.current {
+			return errors.New("cannot retire the current signing key, rotate first")
+		}
+
+		retiredAt := time.Now()
+		key.Status = KeyRetired
+		key.RetiredAt = &retiredAt
+		return nil
+	})
+}
+
+// modify applies a change to the ring and writes it. Replicas share the
+// file, so it is locked and its keys are merged into this replica's before
+// the change: keys another replica added or retired are never overwritten.
+// The ring stays as it was when the change cannot be written.
+func (keyRing *KeyRing) modify(change func() error) error {
+	var fileKeys map[string]*SigningKey
+	fileCurrent := ""
+	if keyRing.path != "" {
+		if err := os.MkdirAll(filepath.Dir(keyRing.path), 0700); err != nil {
+			return err
+		}
+
+		unlock, err := lockFile(keyRing.path + ".lock")
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		fileKeys, fileCurrent, _, err = readKeyRingFile(keyRing.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	keyRing.mutex.Lock()
+	defer keyRing.mutex.Unlock()
+
+	previousKeys, previousCurrent := map[string]*SigningKey{}, keyRing.current
+	for kid, key := range keyRing.keys {
+		copied := *key
+		previousKeys[kid] = &copied
+	}
+
+	keyRing.merge(fileKeys, fileCurrent)
+
+	if err := change(); err != nil {
+		keyRing.keys, keyRing.current = previousKeys, previousCurrent
+		return err
+	}
+
+	if err := keyRing.persist(); err != nil {
+		keyRing.keys, keyRing.current = previousKeys, previousCurrent
+		return err
+	}
+
+	return nil
+}
+
+// merge adds the keys read from the file to the ring. A key retired on
+// either side stays retired, the current key of the file wins since it was
+// written last. It must be called with the write lock held.
+func (keyRing *KeyRing) merge(fileKeys map[string]*SigningKey, fileCurrent string) {
+	for kid, fileKey := range fileKeys {
+		key := keyRing.keys[kid]
+		if key == nil {
+			keyRing.keys[kid] = fileKey
+			continue
+		}
+
+		if fileKey.Status == KeyRetired && key.Status != KeyRetired {
+			key.Status = KeyRetired
+			key.RetiredAt = fileKey.RetiredAt
+		}
+	}
+
+	if current := keyRing.keys[fileCurrent]; current != nil && current.Status == KeyActive {
+		keyRing.current = fileCurrent
+	}
+}
+
+// refresh picks up rotations made by other replicas sharing the key ring file.
+func (keyRing *KeyRing) refresh() {
+	if keyRing.path == "" {
+		return
+	}
+
+	keyRing.mutex.Lock()
+	if time.Since(keyRing.lastChecked) < keyRingRefreshInterval {
+		keyRing.mutex.Unlock()
+		return
+	}
+	keyRing.lastChecked = time.Now()
+	modTime := keyRing.modTime
+	keyRing.mutex.Unlock()
+
+	info, err := os.Stat(keyRing.path)
+	if err != nil || !info.ModTime().After(modTime) {
+		return
+	}
+
+	keyRing.reload()
+}
+
+func (keyRing *KeyRing) reload() error {
+	keys, current, modTime, err := readKeyRingFile(keyRing.path)
+	if err != nil {
+		return err
+	}
+
+	keyRing.mutex.Lock()
+	defer keyRing.mutex.Unlock()
+
+	keyRing.keys = keys
+	keyRing.current = current
+	keyRing.modTime = modTime
+
+	return nil
+}
+
+func readKeyRingFile(path string) (map[string]*SigningKey, string, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+
+	var file keyRingFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, "", time.Time{}, err
+	}
+
+	keys := map[string]*SigningKey{}
+	for _, item := range file.Keys {
+		key := item.SigningKey
+		key.secret, err = decodePrivateKey(key.Algorithm, item.PrivateKey)
+		if err != nil {
+			return nil, "", time.Time{}, err
+		}
+		keys[key.Kid] = &key
+	}
+
+	if keys[file.Current] == nil || keys[file.Current].Status != KeyActive {
+		return nil, "", time.Time{}, errors.New("key ring has no active current key")
+	}
+
+	return keys, file.Current, info.ModTime(), nil
+}
+
+// persist must be called with the write lock held and, for a ring stored in
+// a file, with the file locked by modify.
+func (keyRing *KeyRing) persist() error {
+	if keyRing.path == "" {
+		return nil
+	}
+
+	file := keyRingFile{Current: keyRing.current}
+	for _, key := range keyRing.keys {
+		privateKey, err := encodePrivateKey(key.secret)
+		if err != nil {
+			return err
+		}
+		file.Keys = append(file.Keys, keyRingFileItem{SigningKey: *key, PrivateKey: privateKey})
+	}
+
+	content, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write and rename, so replicas never read a half written ring
+	temporaryPath := keyRing.path + ".tmp"
+	if err := os.WriteFile(temporaryPath, content, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(temporaryPath, keyRing.path); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(keyRing.path); err == nil {
+		keyRing.modTime = info.ModTime()
+	}
+
+	return nil
+}
+
+func generateSigningKey(algorithm string) (*SigningKey, error) {
+	var secret interface{}
+	var err error
+
+	switch algorithm {
+	case jwt.SigningMethodHS256.Alg():
+		bytes := make([]byte, 32)
+		_, err = rand.Read(bytes)
+		secret = []byte(base64.RawURLEncoding.EncodeToString(bytes))
+	case jwt.SigningMethodRS256.Alg():
+		secret, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jwt.SigningMethodES256.Alg():
+		secret, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case SigningMethodEdDSA.Alg():
+		_, secret, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, errors.New("unsupported signing algorithm " + algorithm)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	kidBytes := make([]byte, 8)
+	if _, err := rand.Read(kidBytes); err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{
+		Kid:       hex.EncodeToString(kidBytes),
+		Algorithm: algorithm,
+		Status:    KeyActive,
+		CreatedAt: time.Now(),
+		secret:    secret,
+	}, nil
+}
+
+func encodePrivateKey(secret interface{}) (string, error) {
+	if bytes, ok := secret.([]byte); ok {
+		return base64.StdEncoding.EncodeToString(bytes), nil
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+func decodePrivateKey(algorithm string, encoded string) (interface{}, error) {
+	if algorithm == jwt.SigningMethodHS256.Alg() {
+		return base64.StdEncoding.DecodeString(encoded)
+	}
+
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, errors.New("invalid private key in key ring")
+	}
+
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+// JWKS returns the public keys of every non-retired asymmetric key. HS256
+// secrets are never published.
+func (keyRing *KeyRing) JWKS() model.JSONWebKeySet {
+	jwks := model.JSONWebKeySet{Keys: []model.JSONWebKey{}}
+	for _, key := range keyRing.Keys() {
+		if key.Status == KeyRetired {
+			continue
+		}
+
+		jwk := model.JSONWebKey{Kid: key.Kid, Alg: key.Algorithm, Use: "sig"}
+		switch publicKey := key.PublicKey().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (publicKey.Curve.Params().BitSize + 7) / 8
+			jwk.Kty = "EC"
+			jwk.Crv = publicKey.Curve.Params().Name
+			jwk.X = base64.RawURLEncoding.EncodeToString(publicKey.X.FillBytes(make([]byte, size)))
+			jwk.Y = base64.RawURLEncoding.EncodeToString(publicKey.Y.FillBytes(make([]byte, size)))
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		default:
+			continue
+		}
+
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	return jwks
+}
+
+// PublicKeyFromJWK is the inverse of JWKS, it decodes keys published by
+// other issuers.
+func PublicKeyFromJWK(jwk model.JSONWebKey) (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, curveFound := curves[jwk.Crv]
+		if !curveFound {
+			return nil, errors.New("unsupported curve " + jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, err := decode(jwk.X)
+		if err != nil || jwk.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("unsupported octet key pair")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, errors.New("unsupported key type " + jwk.Kty)
+	}
+}
+
+// SigningAlgorithms lists the algorithms of the non-retired keys.
+func (keyRing *KeyRing) SigningAlgorithms() []string {
+	algorithms := []string{}
+	seen := map[string]bool{}
+	for _, key := range keyRing.Keys() {
+		if key.Status != KeyRetired && !seen[key.Algorithm] {
+			seen[key.Algorithm] = true
+			algorithms = append(algorithms, key.Algorithm)
+		}
+	}
+
+	return algorithms
+}
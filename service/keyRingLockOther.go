@@ -0,0 +1,14 @@
+//go:build !unix
+
+package service
+
+import "sync"
+
+var keyRingFileMutex sync.Mutex
+
+// lockFile only serializes writers of this process where flock is not
+// available, replicas sharing the key ring have to run on a unix system.
+func lockFile(path string) (func(), error) {
+	keyRingFileMutex.Lock()
+	return keyRingFileMutex.Unlock, nil
+}
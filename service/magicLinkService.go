@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/windbnb/user-service/mailer"
+	"github.com/windbnb/user-service/metrics"
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+	"github.com/windbnb/user-service/util"
+)
+
+const (
+	magicLinkPurpose     = "magic_link"
+	magicLinkLoginMethod = "magic_link"
+)
+
+func magicLinkTTL() time.Duration {
+	return util.DurationFromEnv("MAGIC_LINK_TTL", 15*time.Minute)
+}
+
+// magicLinkURL is the frontend page that reads the token from the query
+// string and posts it to /api/users/login/magic-link/consume.
+func magicLinkURL(token string) string {
+	linkURL, linkURLFound := os.LookupEnv("MAGIC_LINK_URL")
+	if !linkURLFound {
+		linkURL = "http://localhost:3000/magic-link"
+	}
+
+	return linkURL + "?token=" + url.QueryEscape(token)
+}
+
+func magicLinkThrottle() emailRequestThrottle {
+	return emailRequestThrottle{
+		emailLimit: util.IntFromEnv("MAGIC_LINK_EMAIL_LIMIT", 5),
+		ipLimit:    util.IntFromEnv("MAGIC_LINK_IP_LIMIT", 20),
+		window:     util.DurationFromEnv("MAGIC_LINK_WINDOW", 15*time.Minute),
+	}
+}
+
+// RequestMagicLink emails a single use sign in link. Like ForgotPassword it
+// reports success for unknown or suspended accounts and for accounts that
+// unlinked the magic link identity.
+func (service *UserService) RequestMagicLink(email string, clientInfo model.ClientInfo, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "requestMagicLinkService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	err := service.throttleEmailRequest(magicLinkPurpose, magicLinkThrottle(), email, clientInfo.IP, ctx)
+	if err != nil {
+		return err
+	}
+
+	user, _, err := service.Repo.FindUserByIdentity(model.MAGIC_LINK_IDENTITY, model.IdentitySubject(email), ctx)
+	if err != nil || user.Suspended {
+		return nil
+	}
+
+	ttl := magicLinkTTL()
+	token, err := service.signPurposeToken(user, magicLinkPurpose, ttl)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while signing token")
+	}
+
+	err = service.mailer().Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your sign in link",
+		Body: fmt.Sprintf("Hi %s,\n\nopen the link below to sign in to your account. "+
+			"It expires in %s and works once.\n\n%s\n\n"+
+			"If it was not you, ignore this email, nobody can sign in without the link.\n",
+			user.Name, ttl, magicLinkURL(token)),
+	})
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while sending sign in email")
+	}
+
+	return nil
+}
+
+// ConsumeMagicLink exchanges a magic link for the same tokens Login issues.
+// Accounts with two factor authentication still have to answer the MFA
+// challenge. Opening the link proves access to the mailbox, so it verifies
+// the email address and lifts a login lockout like a password reset does.
+func (service *UserService) ConsumeMagicLink(token string, clientInfo model.ClientInfo, ctx context.Context) (model.LoginResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "consumeMagicLinkService")
+	defer span.Finish()
+
+	invalidLinkErr := errors.New("invalid or expired sign in link")
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	claims, err := service.parsePurposeToken(token, magicLinkPurpose, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		metrics.LoginFailed(magicLinkLoginMethod)
+		return model.LoginResponse{}, invalidLinkErr
+	}
+
+	err = service.revocationStore().Revoke(claims.StandardClaims.Id, time.Unix(claims.ExpiresAt, 0), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		metrics.LoginFailed(magicLinkLoginMethod)
+		return model.LoginResponse{}, invalidLinkErr
+	}
+
+	user, identity, err := service.Repo.FindUserByIdentity(model.MAGIC_LINK_IDENTITY, model.IdentitySubject(claims.Email), ctx)
+	if err != nil || user.ID != claims.Id || user.TokenVersion != claims.TokenVersion {
+		tracer.LogError(span, invalidLinkErr)
+		metrics.LoginFailed(magicLinkLoginMethod)
+		return model.LoginResponse{}, invalidLinkErr
+	}
+
+	service.touchIdentity(identity, ctx)
+
+	if user.Suspended {
+		err := errors.New("account is suspended")
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, err
+	}
+
+	if !user.Verified {
+		err = service.Repo.MarkUserVerified(user.ID, user.Email, ctx)
+		if err != nil {
+			tracer.LogError(span, err)
+			return model.LoginResponse{}, errors.New("error while verifying email")
+		}
+		user.Verified = true
+	}
+
+	service.recordLoginSuccess(user.Email, ctx)
+
+	if user.TotpEnabled {
+		return service.mfaChallenge(user, ctx)
+	}
+
+	return service.startLoginSession(user, clientInfo, ctx)
+}
+
+// LinkMagicLinkIdentity lets a re-authenticated user sign in with links sent
+// to their email again after unlinking them.
+func (service *UserService) LinkMagicLinkIdentity(userId uint64, tokenString string, password string, ctx context.Context) (model.UserIdentityDTO, error) {
+	span := tracer.StartSpanFromContext(ctx, "linkMagicLinkIdentityService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, err := service.Repo.FindUserById(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.UserIdentityDTO{}, err
+	}
+
+	if _, linked := findIdentity(service.Repo.FindUserIdentities(user.ID, ctx), model.MAGIC_LINK_IDENTITY); linked {
+		err := errors.New("magic links are already enabled")
+		tracer.LogError(span, err)
+		return model.UserIdentityDTO{}, err
+	}
+
+	err = service.reauthenticate(user, tokenString, password, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.UserIdentityDTO{}, err
+	}
+
+	identity, err := service.Repo.CreateUserIdentity(model.EmailIdentity(model.MAGIC_LINK_IDENTITY, user), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.UserIdentityDTO{}, errors.New("error while linking identity")
+	}
+
+	return identity.ToDTO(), nil
+}
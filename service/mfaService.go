@@ -0,0 +1,255 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+	"github.com/windbnb/user-service/util"
+)
+
+const (
+	mfaChallengePurpose = "mfa"
+	mfaChallengeTTL     = 5 * time.Minute
+	recoveryCodeCount   = 10
+)
+
+func totpIssuer() string {
+	issuer, issuerFound := os.LookupEnv("TOTP_ISSUER")
+	if !issuerFound {
+		issuer = "Windbnb"
+	}
+
+	return issuer
+}
+
+func (service *UserService) mfaChallenge(user model.User, ctx context.Context) (model.LoginResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "mfaChallengeService")
+	defer span.Finish()
+
+	challengeToken, err := service.signPurposeToken(user, mfaChallengePurpose, mfaChallengeTTL)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, errors.New("error while signing token")
+	}
+
+	return model.LoginResponse{Status: model.LOGIN_MFA_REQUIRED, ChallengeToken: challengeToken, ExpiresIn: int64(mfaChallengeTTL.Seconds())}, nil
+}
+
+// CompleteMfaLogin exchanges a challenge token and a TOTP or recovery code for
+// a session. A challenge can be answered only once, a wrong code means the
+// password has to be entered again.
+func (service *UserService) CompleteMfaLogin(challengeToken string, code string, clientInfo model.ClientInfo, ctx context.Context) (model.LoginResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "completeMfaLoginService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	claims, err := service.parsePurposeToken(challengeToken, mfaChallengePurpose, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, errors.New("invalid or expired challenge")
+	}
+
+	err = service.revocationStore().Revoke(claims.StandardClaims.Id, time.Unix(claims.ExpiresAt, 0), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, errors.New("invalid or expired challenge")
+	}
+
+	user, err := service.Repo.FindUserById(uint64(claims.Id), ctx)
+	if err != nil || user.Suspended || user.TokenVersion != claims.TokenVersion || !user.TotpEnabled {
+		err := errors.New("invalid or expired challenge")
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, err
+	}
+
+	err = service.checkLoginThrottle(user.Email, clientInfo.IP, mfaLoginMethod, ctx)
+	if err != nil {
+		return model.LoginResponse{}, err
+	}
+
+	if !service.verifySecondFactor(user, code, ctx) {
+		err := errors.New("invalid verification code")
+		tracer.LogError(span, err)
+		service.recordLoginFailure(user.Email, clientInfo.IP, mfaLoginMethod, ctx)
+		return model.LoginResponse{}, err
+	}
+
+	service.recordLoginSuccess(user.Email, ctx)
+	return service.completeLogin(user, clientInfo, ctx)
+}
+
+// verifySecondFactor accepts a current TOTP code or consumes a recovery code.
+func (service *UserService) verifySecondFactor(user model.User, code string, ctx context.Context) bool {
+	span := tracer.StartSpanFromContext(ctx, "verifySecondFactorService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	if step, valid := util.VerifyTotp(user.TotpSecret, code, time.Now(), user.TotpLastStep); valid {
+		updated, err := service.Repo.UpdateTotpLastStep(user.ID, step, ctx)
+		return err == nil && updated
+	}
+
+	codeHash := util.HashToken(util.NormalizeRecoveryCode(code))
+	for _, recoveryCode := range service.Repo.FindUnusedRecoveryCodes(user.ID, ctx) {
+		if recoveryCode.CodeHash == codeHash {
+			used, err := service.Repo.MarkRecoveryCodeUsed(recoveryCode.ID, ctx)
+			return err == nil && used
+		}
+	}
+
+	return false
+}
+
+// EnrollTotp generates a new secret and recovery codes. 2FA is only enabled
+// once the user confirms a first code from their authenticator app.
+func (service *UserService) EnrollTotp(userId uint64, ctx context.Context) (model.TotpEnrollmentResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "enrollTotpService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, err := service.Repo.FindUserById(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.TotpEnrollmentResponse{}, errors.New("user with given id does not exist")
+	}
+
+	if user.TotpEnabled {
+		err := errors.New("two-factor authentication is already enabled")
+		tracer.LogError(span, err)
+		return model.TotpEnrollmentResponse{}, err
+	}
+
+	secret, err := util.GenerateTotpSecret()
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.TotpEnrollmentResponse{}, errors.New("error while generating secret")
+	}
+
+	recoveryCodes := []string{}
+	storedCodes := []model.RecoveryCode{}
+	for i := 0; i < recoveryCodeCount; i++ {
+		recoveryCode, err := util.GenerateRecoveryCode()
+		if err != nil {
+			tracer.LogError(span, err)
+			return model.TotpEnrollmentResponse{}, errors.New("error while generating recovery codes")
+		}
+		recoveryCodes = append(recoveryCodes, recoveryCode)
+		storedCodes = append(storedCodes, model.RecoveryCode{UserId: user.ID, CodeHash: util.HashToken(util.NormalizeRecoveryCode(recoveryCode))})
+	}
+
+	user.TotpSecret = secret
+	if _, err := service.Repo.UpdateUser(user, []string{"totp_secret"}, ctx); err != nil {
+		tracer.LogError(span, err)
+		return model.TotpEnrollmentResponse{}, errors.New("error while saving user")
+	}
+
+	if err := service.Repo.ReplaceRecoveryCodes(user.ID, storedCodes, ctx); err != nil {
+		tracer.LogError(span, err)
+		return model.TotpEnrollmentResponse{}, errors.New("error while saving recovery codes")
+	}
+
+	return model.TotpEnrollmentResponse{
+		Secret:        secret,
+		OtpauthURI:    util.TotpURI(totpIssuer(), user.Email, secret),
+		RecoveryCodes: recoveryCodes,
+	}, nil
+}
+
+// ConfirmTotp and DisableTotp count wrong codes like the MFA challenge of the
+// login does, against the same account and address.
+func (service *UserService) ConfirmTotp(userId uint64, code string, clientInfo model.ClientInfo, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "confirmTotpService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, err := service.Repo.FindUserById(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("user with given id does not exist")
+	}
+
+	if user.TotpEnabled || user.TotpSecret == "" {
+		err := errors.New("there is no pending two-factor enrollment")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	err = service.checkLoginThrottle(user.Email, clientInfo.IP, mfaLoginMethod, ctx)
+	if err != nil {
+		return err
+	}
+
+	step, valid := util.VerifyTotp(user.TotpSecret, code, time.Now(), user.TotpLastStep)
+	if !valid {
+		err := errors.New("invalid verification code")
+		tracer.LogError(span, err)
+		service.recordLoginFailure(user.Email, clientInfo.IP, mfaLoginMethod, ctx)
+		return err
+	}
+	service.recordLoginSuccess(user.Email, ctx)
+
+	user.TotpEnabled = true
+	user.TotpLastStep = step
+	if _, err := service.Repo.UpdateUser(user, []string{"totp_enabled", "totp_last_step"}, ctx); err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while saving user")
+	}
+
+	return nil
+}
+
+func (service *UserService) DisableTotp(userId uint64, code string, clientInfo model.ClientInfo, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "disableTotpService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, err := service.Repo.FindUserById(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("user with given id does not exist")
+	}
+
+	if !user.TotpEnabled {
+		err := errors.New("two-factor authentication is not enabled")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	err = service.checkLoginThrottle(user.Email, clientInfo.IP, mfaLoginMethod, ctx)
+	if err != nil {
+		return err
+	}
+
+	if !service.verifySecondFactor(user, code, ctx) {
+		err := errors.New("invalid verification code")
+		tracer.LogError(span, err)
+		service.recordLoginFailure(user.Email, clientInfo.IP, mfaLoginMethod, ctx)
+		return err
+	}
+	service.recordLoginSuccess(user.Email, ctx)
+
+	user, err = service.Repo.FindUserById(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("user with given id does not exist")
+	}
+
+	user.TotpEnabled = false
+	user.TotpSecret = ""
+	user.TotpLastStep = 0
+	if _, err := service.Repo.UpdateUser(user, []string{"totp_enabled", "totp_secret", "totp_last_step"}, ctx); err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while saving user")
+	}
+
+	if err := service.Repo.ReplaceRecoveryCodes(user.ID, nil, ctx); err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while removing recovery codes")
+	}
+
+	return nil
+}
@@ -0,0 +1,543 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+	"github.com/windbnb/user-service/util"
+)
+
+const (
+	authorizationCodeTTL = time.Minute
+	openIdScope          = "openid"
+)
+
+// OAuthScopes are the scopes clients can be registered for.
+var OAuthScopes = []string{openIdScope, "profile", "email"}
+
+// ErrInvalidRedirect means the client or redirect URI of an authorization
+// request is unknown. The user must not be redirected anywhere then.
+var ErrInvalidRedirect = errors.New("unknown client or redirect uri")
+
+// OAuthError is an error of RFC 6749 section 4.1.2.1 and 5.2, Code is one of
+// the registered error codes such as invalid_grant.
+type OAuthError struct {
+	Code        string
+	Description string
+}
+
+func (err *OAuthError) Error() string {
+	return err.Code + ": " + err.Description
+}
+
+func oauthError(code string, description string) *OAuthError {
+	return &OAuthError{Code: code, Description: description}
+}
+
+func containsScopes(allowed string, requested string) bool {
+	allowedScopes := strings.Fields(allowed)
+	for _, scope := range strings.Fields(requested) {
+		found := false
+		for _, allowedScope := range allowedScopes {
+			found = found || allowedScope == scope
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validRedirectURI accepts https URIs, http only on the loopback interface
+// and the private schemes mobile apps register, such as com.windbnb.app:/cb.
+func validRedirectURI(redirectURI string) bool {
+	parsed, err := url.Parse(redirectURI)
+	if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+		return false
+	}
+
+	switch parsed.Scheme {
+	case "https":
+		return parsed.Host != ""
+	case "http":
+		host := parsed.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	default:
+		return strings.Contains(parsed.Scheme, ".")
+	}
+}
+
+func (service *UserService) RegisterOAuthClient(request model.RegisterOAuthClientRequest, ctx context.Context) (model.OAuthClientDTO, error) {
+	span := tracer.StartSpanFromContext(ctx, "registerOAuthClientService")
+	defer span.Finish()
+
+	if request.Service {
+		return service.registerServiceClient(request, ctx)
+	}
+
+	if strings.TrimSpace(request.Name) == "" || len(request.RedirectURIs) == 0 {
+		err := errors.New("name and at least one redirect uri are required")
+		tracer.LogError(span, err)
+		return model.OAuthClientDTO{}, err
+	}
+
+	if request.CertificateThumbprint != "" {
+		err := errors.New("only service clients can authenticate with a certificate")
+		tracer.LogError(span, err)
+		return model.OAuthClientDTO{}, err
+	}
+
+	for _, redirectURI := range request.RedirectURIs {
+		if !validRedirectURI(redirectURI) {
+			err := fmt.Errorf("redirect uri %q is not allowed", redirectURI)
+			tracer.LogError(span, err)
+			return model.OAuthClientDTO{}, err
+		}
+	}
+
+	scopes := strings.Join(request.Scopes, " ")
+	if scopes == "" {
+		scopes = openIdScope
+	}
+	if !containsScopes(strings.Join(OAuthScopes, " "), scopes) {
+		err := errors.New("unsupported scope")
+		tracer.LogError(span, err)
+		return model.OAuthClientDTO{}, err
+	}
+
+	clientId, err := util.GenerateOpaqueToken()
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.OAuthClientDTO{}, errors.New("error while registering client")
+	}
+
+	client := model.OAuthClient{
+		ClientId:     clientId[:22],
+		Name:         strings.TrimSpace(request.Name),
+		RedirectURIs: strings.Join(request.RedirectURIs, " "),
+		Scopes:       scopes,
+		Public:       request.Public,
+	}
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	return service.createOAuthClient(client, ctx)
+}
+
+// createOAuthClient stores the client, confidential clients without a pinned
+// certificate get a secret that is only returned here.
+func (service *UserService) createOAuthClient(client model.OAuthClient, ctx context.Context) (model.OAuthClientDTO, error) {
+	span := tracer.StartSpanFromContext(ctx, "createOAuthClientService")
+	defer span.Finish()
+
+	clientSecret := ""
+	if !client.Public && client.CertificateThumbprint == "" {
+		var err error
+		clientSecret, err = util.GenerateOpaqueToken()
+		if err != nil {
+			tracer.LogError(span, err)
+			return model.OAuthClientDTO{}, errors.New("error while registering client")
+		}
+		client.ClientSecretHash = util.HashToken(clientSecret)
+	}
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	client, err := service.Repo.CreateOAuthClient(client, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.OAuthClientDTO{}, errors.New("error while registering client")
+	}
+
+	clientDTO := client.ToDTO()
+	clientDTO.ClientSecret = clientSecret
+
+	return clientDTO, nil
+}
+
+func (service *UserService) ListOAuthClients(ctx context.Context) []model.OAuthClientDTO {
+	span := tracer.StartSpanFromContext(ctx, "listOAuthClientsService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	clients := []model.OAuthClientDTO{}
+	for _, client := range service.Repo.FindOAuthClients(ctx) {
+		clients = append(clients, client.ToDTO())
+	}
+
+	return clients
+}
+
+func (service *UserService) DeleteOAuthClient(clientId string, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "deleteOAuthClientService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	err := service.Repo.DeleteOAuthClient(clientId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("client does not exist")
+	}
+
+	return nil
+}
+
+// ValidateAuthorizationRequest returns ErrInvalidRedirect when the client or
+// redirect URI is unknown and an *OAuthError for anything the client should
+// be told about through its redirect URI.
+func (service *UserService) ValidateAuthorizationRequest(request model.AuthorizationRequest, ctx context.Context) (model.OAuthClient, error) {
+	span := tracer.StartSpanFromContext(ctx, "validateAuthorizationRequestService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	client, err := service.Repo.FindOAuthClient(request.ClientId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.OAuthClient{}, ErrInvalidRedirect
+	}
+
+	redirectAllowed := false
+	for _, redirectURI := range strings.Fields(client.RedirectURIs) {
+		redirectAllowed = redirectAllowed || redirectURI == request.RedirectURI
+	}
+	if !redirectAllowed {
+		tracer.LogError(span, ErrInvalidRedirect)
+		return model.OAuthClient{}, ErrInvalidRedirect
+	}
+
+	if request.ResponseType != "code" {
+		return client, oauthError("unsupported_response_type", "only the code response type is supported")
+	}
+
+	if !containsScopes(client.Scopes, request.Scope) {
+		return client, oauthError("invalid_scope", "the client may not request these scopes")
+	}
+
+	if request.CodeChallenge == "" || request.CodeChallengeMethod != "S256" {
+		return client, oauthError("invalid_request", "a S256 code_challenge is required")
+	}
+
+	return client, nil
+}
+
+// AuthorizationRedirect builds the redirect back to the client, params carry
+// either the code or the error.
+func AuthorizationRedirect(request model.AuthorizationRequest, params url.Values) string {
+	if request.State != "" {
+		params.Set("state", request.State)
+	}
+	params.Set("iss", Issuer())
+
+	separator := "?"
+	if strings.Contains(request.RedirectURI, "?") {
+		separator = "&"
+	}
+
+	return request.RedirectURI + separator + params.Encode()
+}
+
+func AuthorizationErrorRedirect(request model.AuthorizationRequest, err *OAuthError) string {
+	params := url.Values{}
+	params.Set("error", err.Code)
+	params.Set("error_description", err.Description)
+
+	return AuthorizationRedirect(request, params)
+}
+
+// Authorize signs the user in with the credentials from the consent page and
+// returns the redirect carrying a fresh authorization code. A second factor is
+// required from users who enabled it.
+func (service *UserService) Authorize(request model.AuthorizationRequest, credentials model.Credentials, code string, clientInfo model.ClientInfo, ctx context.Context) (string, error) {
+	span := tracer.StartSpanFromContext(ctx, "authorizeService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	client, err := service.ValidateAuthorizationRequest(request, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return "", err
+	}
+
+	user, err := service.authenticatePassword(credentials, clientInfo, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return "", err
+	}
+
+	if user.TotpEnabled {
+		err = service.checkLoginThrottle(user.Email, clientInfo.IP, mfaLoginMethod, ctx)
+		if err != nil {
+			return "", err
+		}
+
+		if !service.verifySecondFactor(user, code, ctx) {
+			err := errors.New("invalid verification code")
+			tracer.LogError(span, err)
+			service.recordLoginFailure(user.Email, clientInfo.IP, mfaLoginMethod, ctx)
+			return "", err
+		}
+	}
+
+	service.recordLoginSuccess(user.Email, ctx)
+
+	if passwordExpired(user) {
+		err := errors.New("your password has expired, change it before signing in")
+		tracer.LogError(span, err)
+		return "", err
+	}
+
+	authorizationCode, err := util.GenerateOpaqueToken()
+	if err != nil {
+		tracer.LogError(span, err)
+		return "", errors.New("error while issuing authorization code")
+	}
+
+	scope := request.Scope
+	if scope == "" {
+		scope = openIdScope
+	}
+
+	now := time.Now()
+	_, err = service.Repo.CreateAuthorizationCode(model.AuthorizationCode{
+		CodeHash:      util.HashToken(authorizationCode),
+		ClientId:      client.ClientId,
+		UserId:        user.ID,
+		RedirectURI:   request.RedirectURI,
+		Scope:         scope,
+		Nonce:         request.Nonce,
+		CodeChallenge: request.CodeChallenge,
+		AuthTime:      now,
+		ExpiresAt:     now.Add(authorizationCodeTTL),
+	}, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return "", errors.New("error while issuing authorization code")
+	}
+
+	params := url.Values{}
+	params.Set("code", authorizationCode)
+
+	return AuthorizationRedirect(request, params), nil
+}
+
+// authenticateClient checks the client secret of confidential clients,
+// public clients must not send one.
+func (service *UserService) authenticateClient(clientId string, clientSecret string, certificateThumbprint string, ctx context.Context) (model.OAuthClient, error) {
+	span := tracer.StartSpanFromContext(ctx, "authenticateClientService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	client, err := service.Repo.FindOAuthClient(clientId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.OAuthClient{}, oauthError("invalid_client", "client authentication failed")
+	}
+
+	// Clients with a pinned certificate authenticate with mTLS only.
+	if client.CertificateThumbprint != "" {
+		if subtle.ConstantTimeCompare([]byte(certificateThumbprint), []byte(client.CertificateThumbprint)) != 1 {
+			err := oauthError("invalid_client", "client certificate does not match")
+			tracer.LogError(span, err)
+			return model.OAuthClient{}, err
+		}
+		return client, nil
+	}
+
+	if client.Public {
+		if clientSecret != "" {
+			return model.OAuthClient{}, oauthError("invalid_client", "public clients do not have a secret")
+		}
+		return client, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(util.HashToken(clientSecret)), []byte(client.ClientSecretHash)) != 1 {
+		err := oauthError("invalid_client", "client authentication failed")
+		tracer.LogError(span, err)
+		return model.OAuthClient{}, err
+	}
+
+	return client, nil
+}
+
+// Token implements the token endpoint for the authorization_code and
+// refresh_token grants of user facing clients and the client_credentials
+// grant of service clients.
+func (service *UserService) Token(request model.TokenRequest, clientInfo model.ClientInfo, ctx context.Context) (model.OAuthTokenResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "tokenService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	client, err := service.authenticateClient(request.ClientId, request.ClientSecret, request.ClientCertificateThumbprint, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.OAuthTokenResponse{}, err
+	}
+
+	if client.Service != (request.GrantType == "client_credentials") {
+		err := oauthError("unauthorized_client", "the client is not allowed to use this grant type")
+		tracer.LogError(span, err)
+		return model.OAuthTokenResponse{}, err
+	}
+
+	switch request.GrantType {
+	case "client_credentials":
+		return service.clientCredentialsGrant(client, request.Scope, ctx)
+	case "authorization_code":
+		return service.exchangeAuthorizationCode(client, request, clientInfo, ctx)
+	case "refresh_token":
+		loginResponse, err := service.refreshTokenForClient(request.RefreshToken, client.ClientId, ctx)
+		if err != nil {
+			tracer.LogError(span, err)
+			return model.OAuthTokenResponse{}, oauthError("invalid_grant", err.Error())
+		}
+
+		return model.OAuthTokenResponse{AccessToken: loginResponse.Token, TokenType: "Bearer", ExpiresIn: loginResponse.ExpiresIn,
+			RefreshToken: loginResponse.RefreshToken}, nil
+	default:
+		return model.OAuthTokenResponse{}, oauthError("unsupported_grant_type", "grant type is not supported")
+	}
+}
+
+func pkceChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// exchangeAuthorizationCode redeems a code once. A code presented twice was
+// intercepted, so the session created by the first exchange is revoked.
+func (service *UserService) exchangeAuthorizationCode(client model.OAuthClient, request model.TokenRequest, clientInfo model.ClientInfo, ctx context.Context) (model.OAuthTokenResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "exchangeAuthorizationCodeService")
+	defer span.Finish()
+
+	invalidGrantErr := oauthError("invalid_grant", "invalid authorization code")
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	code, err := service.Repo.FindAuthorizationCodeByHash(util.HashToken(request.Code), ctx)
+	if err != nil || code.ClientId != client.ClientId {
+		tracer.LogError(span, invalidGrantErr)
+		return model.OAuthTokenResponse{}, invalidGrantErr
+	}
+
+	if code.UsedAt != nil {
+		tracer.LogError(span, invalidGrantErr)
+		service.Repo.RevokeSession(code.SessionId, ctx)
+		return model.OAuthTokenResponse{}, invalidGrantErr
+	}
+
+	if code.RedirectURI != request.RedirectURI || time.Now().After(code.ExpiresAt) {
+		tracer.LogError(span, invalidGrantErr)
+		return model.OAuthTokenResponse{}, invalidGrantErr
+	}
+
+	if len(request.CodeVerifier) < 43 || len(request.CodeVerifier) > 128 ||
+		subtle.ConstantTimeCompare([]byte(pkceChallenge(request.CodeVerifier)), []byte(code.CodeChallenge)) != 1 {
+		err := oauthError("invalid_grant", "code verifier does not match the challenge")
+		tracer.LogError(span, err)
+		return model.OAuthTokenResponse{}, err
+	}
+
+	user, err := service.Repo.FindUserById(uint64(code.UserId), ctx)
+	if err != nil || user.Suspended {
+		tracer.LogError(span, invalidGrantErr)
+		return model.OAuthTokenResponse{}, invalidGrantErr
+	}
+
+	session, err := service.startClientSession(user, client, code.Scope, clientInfo, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.OAuthTokenResponse{}, err
+	}
+
+	used, err := service.Repo.MarkAuthorizationCodeUsed(code.ID, session.ID, ctx)
+	if err != nil || !used {
+		tracer.LogError(span, invalidGrantErr)
+		service.Repo.RevokeSession(session.ID, ctx)
+		return model.OAuthTokenResponse{}, invalidGrantErr
+	}
+
+	loginResponse, err := service.issueTokens(user, session, "", ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.OAuthTokenResponse{}, err
+	}
+
+	response := model.OAuthTokenResponse{AccessToken: loginResponse.Token, TokenType: "Bearer", ExpiresIn: loginResponse.ExpiresIn,
+		RefreshToken: loginResponse.RefreshToken, Scope: code.Scope}
+
+	if containsScopes(code.Scope, openIdScope) {
+		response.IdToken, err = service.signIdToken(user, client, session, code, ctx)
+		if err != nil {
+			tracer.LogError(span, err)
+			return model.OAuthTokenResponse{}, errors.New("error while signing token")
+		}
+	}
+
+	return response, nil
+}
+
+func (service *UserService) signIdToken(user model.User, client model.OAuthClient, session model.Session, code model.AuthorizationCode, ctx context.Context) (string, error) {
+	span := tracer.StartSpanFromContext(ctx, "signIdTokenService")
+	defer span.Finish()
+
+	jti, err := util.GenerateOpaqueToken()
+	if err != nil {
+		tracer.LogError(span, err)
+		return "", err
+	}
+
+	now := time.Now()
+	claims := model.IdTokenClaims{
+		Claims: model.Claims{Email: user.Email, Role: activeRole(user, session), Id: user.ID, TokenVersion: user.TokenVersion, SessionId: session.ID,
+			EmailVerified: user.Verified, Purpose: "id_token", AuthTime: code.AuthTime.Unix(),
+			StandardClaims: jwt.StandardClaims{Id: jti, Subject: fmt.Sprint(user.ID), Audience: client.ClientId,
+				ExpiresAt: now.Add(accessTokenTTL()).Unix(), IssuedAt: now.Unix(), Issuer: Issuer()}},
+		Nonce: code.Nonce,
+	}
+
+	return service.keyRing().Sign(&claims)
+}
+
+// UserInfo answers the OpenID Connect userinfo endpoint. Client tokens need
+// the openid scope and get the name claims with profile and the email claims
+// with email, first party tokens get all of them.
+func (service *UserService) UserInfo(tokenString string, ctx context.Context) (model.UserInfoResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "userInfoService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	claims, user, err := service.validateAccessToken(tokenString, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.UserInfoResponse{}, err
+	}
+
+	if claims.ClientId != "" && !containsScopes(claims.Scope, openIdScope) {
+		err := errors.New("token does not grant the openid scope")
+		tracer.LogError(span, err)
+		return model.UserInfoResponse{}, err
+	}
+
+	userInfo := model.UserInfoResponse{Sub: fmt.Sprint(user.ID)}
+	if claims.ClientId == "" || containsScopes(claims.Scope, "profile") {
+		userInfo.Name = strings.TrimSpace(user.Name + " " + user.Surname)
+		userInfo.GivenName = user.Name
+		userInfo.FamilyName = user.Surname
+		userInfo.PreferredUsername = user.Username
+	}
+	if claims.ClientId == "" || containsScopes(claims.Scope, "email") {
+		emailVerified := user.Verified
+		userInfo.Email = user.Email
+		userInfo.EmailVerified = &emailVerified
+	}
+
+	return userInfo, nil
+}
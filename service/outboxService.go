@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/windbnb/user-service/client"
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+	"github.com/windbnb/user-service/util"
+)
+
+func outboxBatchSize() int {
+	return util.IntFromEnv("OUTBOX_BATCH_SIZE", 100)
+}
+
+// DeliverOutboxEvents sends pending events to the accommodation service in
+// the order they were written. Delivery stops at the first failure so that
+// a later event never overtakes an earlier one, the cron job tries again.
+// It returns how many events were delivered.
+func (service *UserService) DeliverOutboxEvents(ctx context.Context) (int, error) {
+	span := tracer.StartSpanFromContext(ctx, "deliverOutboxEventsService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	events := service.Repo.FindPendingOutboxEvents(outboxBatchSize(), ctx)
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	serviceToken, err := service.ServiceToken(client.AccommodationsEventsScope)
+	if err != nil {
+		tracer.LogError(span, err)
+		return 0, errors.New("error while signing token")
+	}
+
+	for delivered, event := range events {
+		err := client.PublishEvent(model.EventEnvelope{Id: event.ID, Type: event.Type, OccurredAt: event.CreatedAt,
+			Data: json.RawMessage(event.Payload)}, serviceToken)
+		if err != nil {
+			tracer.LogError(span, err)
+			if err := service.Repo.RecordOutboxEventAttempt(event.ID, ctx); err != nil {
+				tracer.LogError(span, err)
+			}
+			return delivered, err
+		}
+
+		err = service.Repo.MarkOutboxEventDelivered(event.ID, ctx)
+		if err != nil {
+			tracer.LogError(span, err)
+			return delivered, errors.New("error while recording delivery")
+		}
+	}
+
+	return len(events), nil
+}
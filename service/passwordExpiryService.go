@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+	"github.com/windbnb/user-service/util"
+)
+
+const (
+	passwordChangePurpose = "password_change"
+	passwordChangeTTL     = 10 * time.Minute
+)
+
+// passwordHistorySize is how many passwords, the current one included, a new
+// password must differ from. Zero turns the check off.
+func passwordHistorySize() int {
+	return util.IntFromEnv("PASSWORD_HISTORY_SIZE", 0)
+}
+
+// passwordMaxAge forces a password change once the password is older than
+// PASSWORD_EXPIRY_DAYS. Zero turns expiry off.
+func passwordMaxAge() time.Duration {
+	return time.Duration(util.IntFromEnv("PASSWORD_EXPIRY_DAYS", 0)) * 24 * time.Hour
+}
+
+// passwordRotationApplies limits history and expiry to the roles listed in
+// PASSWORD_ROTATION_ROLES, every role when it is not set.
+func passwordRotationApplies(role model.UserRole) bool {
+	roles, rolesFound := os.LookupEnv("PASSWORD_ROTATION_ROLES")
+	if !rolesFound || strings.TrimSpace(roles) == "" {
+		return true
+	}
+
+	for _, listedRole := range strings.Split(roles, ",") {
+		if strings.EqualFold(strings.TrimSpace(listedRole), string(role)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func passwordExpired(user model.User) bool {
+	maxAge := passwordMaxAge()
+	if maxAge <= 0 || !passwordRotationApplies(user.Role) {
+		return false
+	}
+
+	changedAt := user.CreatedAt
+	if user.PasswordChangedAt != nil {
+		changedAt = *user.PasswordChangedAt
+	}
+
+	return time.Since(changedAt) > maxAge
+}
+
+// passwordChangeRequired hands out a token that only the change-password
+// endpoint accepts instead of a session.
+func (service *UserService) passwordChangeRequired(user model.User, ctx context.Context) (model.LoginResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "passwordChangeRequiredService")
+	defer span.Finish()
+
+	token, err := service.signPurposeToken(user, passwordChangePurpose, passwordChangeTTL)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, errors.New("error while signing token")
+	}
+
+	return model.LoginResponse{Status: model.LOGIN_PASSWORD_CHANGE_REQUIRED, Token: token, ExpiresIn: int64(passwordChangeTTL.Seconds())}, nil
+}
+
+// checkPasswordReuse rejects the current password and the ones kept in the
+// history.
+func (service *UserService) checkPasswordReuse(user model.User, field string, newPassword string, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "checkPasswordReuseService")
+	defer span.Finish()
+
+	historySize := passwordHistorySize()
+	if historySize <= 0 || !passwordRotationApplies(user.Role) {
+		return nil
+	}
+
+	previousHashes := []string{user.Password}
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	for _, passwordHistory := range service.Repo.FindPasswordHistory(user.ID, historySize-1, ctx) {
+		previousHashes = append(previousHashes, passwordHistory.PasswordHash)
+	}
+
+	for _, previousHash := range previousHashes {
+		if reused, _ := util.VerifyPassword(service.passwordHasher(), newPassword, previousHash); reused {
+			err := &ValidationError{Message: "password does not meet the password policy", Errors: []model.FieldError{{
+				Field: field, Code: "reused", Message: "password must differ from your recent passwords"}}}
+			tracer.LogError(span, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setPassword replaces the password hash of the user, keeping the old hash in
+// the history when reuse is limited. The caller saves the user.
+func (service *UserService) setPassword(user model.User, newHash string, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "setPasswordService")
+	defer span.Finish()
+
+	historySize := passwordHistorySize()
+	if historySize > 1 && user.Password != "" && passwordRotationApplies(user.Role) {
+		ctx = tracer.ContextWithSpan(context.Background(), span)
+		err := service.Repo.AddPasswordHistory(user.ID, user.Password, historySize-1, ctx)
+		if err != nil {
+			tracer.LogError(span, err)
+			return user, errors.New("error while saving user")
+		}
+	}
+
+	now := time.Now()
+	user.Password = newHash
+	user.PasswordChangedAt = &now
+
+	return user, nil
+}
+
+// AuthenticatePasswordChange accepts a regular access token as well as the
+// restricted token that Login returns for an expired password.
+func (service *UserService) AuthenticatePasswordChange(tokenString string, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "authenticatePasswordChangeService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	claims, err := service.parsePurposeToken(tokenString, passwordChangePurpose, ctx)
+	if err != nil {
+		return service.AuthenticateUser(tokenString, "", false, ctx)
+	}
+
+	user, err := service.Repo.FindUserById(uint64(claims.Id), ctx)
+	if err != nil || user.Suspended || user.TokenVersion != claims.TokenVersion {
+		err := errors.New("token is no longer valid")
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
+
+	return user, nil
+}
@@ -0,0 +1,31 @@
+package service
+
+import (
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/util"
+)
+
+// ValidationError carries every field rule a request broke, handlers return
+// them as ErrorResponse.Errors.
+type ValidationError struct {
+	Message string
+	Errors  []model.FieldError
+}
+
+func (err *ValidationError) Error() string {
+	return err.Message
+}
+
+func (service *UserService) passwordPolicy() *util.PasswordPolicy {
+	service.defaults()
+	return service.PasswordPolicy
+}
+
+func (service *UserService) validatePassword(field string, password string, email string, username string) error {
+	fieldErrors := service.passwordPolicy().Validate(field, password, email, username)
+	if len(fieldErrors) == 0 {
+		return nil
+	}
+
+	return &ValidationError{Message: "password does not meet the password policy", Errors: fieldErrors}
+}
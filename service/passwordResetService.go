@@ -0,0 +1,197 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/windbnb/user-service/mailer"
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+	"github.com/windbnb/user-service/util"
+)
+
+func passwordResetTTL() time.Duration {
+	return util.DurationFromEnv("PASSWORD_RESET_TTL", 30*time.Minute)
+}
+
+// passwordResetURL is the frontend page that reads the token from the query
+// string and posts it to /api/users/password/reset.
+func passwordResetURL(token string) string {
+	resetURL, resetURLFound := os.LookupEnv("PASSWORD_RESET_URL")
+	if !resetURLFound {
+		resetURL = "http://localhost:3000/reset-password"
+	}
+
+	return resetURL + "?token=" + url.QueryEscape(token)
+}
+
+const passwordResetPurpose = "password_reset"
+
+func passwordResetThrottle() emailRequestThrottle {
+	return emailRequestThrottle{
+		emailLimit: util.IntFromEnv("PASSWORD_RESET_EMAIL_LIMIT", 5),
+		ipLimit:    util.IntFromEnv("PASSWORD_RESET_IP_LIMIT", 20),
+		window:     util.DurationFromEnv("PASSWORD_RESET_WINDOW", 15*time.Minute),
+	}
+}
+
+// ForgotPassword emails a single use reset link. Only the throttle is checked
+// while the request waits, the account is looked up and the email is sent in
+// the background, so the answer and its timing are the same for unknown or
+// suspended accounts and the endpoint cannot be used to find out which emails
+// are registered.
+func (service *UserService) ForgotPassword(email string, clientInfo model.ClientInfo, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "forgotPasswordService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	err := service.throttleEmailRequest(passwordResetPurpose, passwordResetThrottle(), email, clientInfo.IP, ctx)
+	if err != nil {
+		return err
+	}
+
+	go service.sendPasswordReset(email, ctx)
+
+	return nil
+}
+
+// sendPasswordReset replaces the reset tokens of the account with a new one
+// and emails it. Failures are only traced, nobody waits for them.
+func (service *UserService) sendPasswordReset(email string, ctx context.Context) {
+	span := tracer.StartSpanFromContext(ctx, "sendPasswordResetService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, err := service.Repo.FindUserByEmail(email, ctx)
+	if err != nil || user.Suspended {
+		return
+	}
+
+	token, err := util.GenerateOpaqueToken()
+	if err != nil {
+		tracer.LogError(span, err)
+		return
+	}
+
+	err = service.Repo.InvalidatePasswordResetTokens(user.ID, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return
+	}
+
+	ttl := passwordResetTTL()
+	_, err = service.Repo.CreatePasswordResetToken(model.PasswordResetToken{
+		UserId:    user.ID,
+		TokenHash: util.HashToken(token),
+		ExpiresAt: time.Now().Add(ttl),
+	}, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return
+	}
+
+	err = service.mailer().Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nsomeone asked to reset the password of your account. "+
+			"Open the link below to choose a new one, it expires in %s and works once.\n\n%s\n\n"+
+			"If it was not you, ignore this email and your password stays the same.\n",
+			user.Name, ttl, passwordResetURL(token)),
+	})
+	if err != nil {
+		tracer.LogError(span, err)
+	}
+}
+
+// ResetPassword checks the new password, consumes the reset token, sets the
+// password and signs the user out everywhere.
+func (service *UserService) ResetPassword(token string, newPassword string, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "resetPasswordService")
+	defer span.Finish()
+
+	if newPassword == "" {
+		err := errors.New("new password is required")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	resetToken, err := service.Repo.FindPasswordResetTokenByHash(util.HashToken(token), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("invalid or expired reset token")
+	}
+
+	if resetToken.UsedAt != nil || !time.Now().Before(resetToken.ExpiresAt) {
+		err := errors.New("invalid or expired reset token")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	user, err := service.Repo.FindUserById(uint64(resetToken.UserId), ctx)
+	if err != nil || user.Suspended {
+		err := errors.New("invalid or expired reset token")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	err = service.validatePassword("newPassword", newPassword, user.Email, user.Username)
+	if err != nil {
+		tracer.LogError(span, err)
+		return err
+	}
+
+	err = service.checkPasswordReuse(user, "newPassword", newPassword, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return err
+	}
+
+	hash, err := service.passwordHasher().Hash(newPassword)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while saving user")
+	}
+
+	// The token is only used up by a password that is saved, a rejected
+	// password leaves it valid for another try.
+	used, err := service.Repo.MarkPasswordResetTokenUsed(resetToken.ID, ctx)
+	if err != nil || !used {
+		err := errors.New("invalid or expired reset token")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	user, err = service.setPassword(user, hash, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return err
+	}
+
+	_, err = service.Repo.UpdateUser(user, []string{"password", "password_changed_at"}, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while saving user")
+	}
+
+	err = service.ensurePasswordIdentity(user, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return err
+	}
+
+	err = service.invalidateUserTokens(user.ID, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while invalidating sessions")
+	}
+
+	// Proving access to the mailbox is enough to lift a login lockout.
+	service.recordLoginSuccess(user.Email, ctx)
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+)
+
+// ErrPermissionDenied means the token is valid but its scope lacks a
+// permission the route requires.
+var ErrPermissionDenied = errors.New("missing permission")
+
+// rolePermissions is the scope of first party access tokens, the permissions
+// of the role separated by spaces. An unknown role grants nothing.
+func (service *UserService) rolePermissions(role model.UserRole, ctx context.Context) string {
+	span := tracer.StartSpanFromContext(ctx, "rolePermissionsService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	storedRole, err := service.Repo.FindRole(role, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return ""
+	}
+
+	return strings.Join(storedRole.ToDTO().Permissions, " ")
+}
+
+// AuthorisePermissions checks that a first party access token is still
+// valid and that its scope has every one of the permissions. Permissions are
+// read from the token, removing a role signs the user out so that no token
+// keeps its permissions.
+func (service *UserService) AuthorisePermissions(tokenString string, permissions []string, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "authorisePermissionsService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	claims, user, err := service.validateAccessToken(tokenString, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("Unauthorised")
+	}
+
+	if claims.ClientId != "" || !containsScopes(claims.Scope, strings.Join(permissions, " ")) {
+		tracer.LogError(span, ErrPermissionDenied)
+		return model.User{}, ErrPermissionDenied
+	}
+
+	return user, nil
+}
+
+func (service *UserService) ListRoles(ctx context.Context) []model.RoleDTO {
+	span := tracer.StartSpanFromContext(ctx, "listRolesService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	roles := []model.RoleDTO{}
+	for _, role := range service.Repo.FindRoles(ctx) {
+		roles = append(roles, role.ToDTO())
+	}
+
+	return roles
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/repository"
+	"github.com/windbnb/user-service/tracer"
+)
+
+// RevocationStore records revoked access tokens by jti. Postgres is the
+// source of truth shared by all replicas, revocations seen by this replica
+// are additionally cached in memory until the token would have expired.
+type RevocationStore struct {
+	Repo    repository.IRepository
+	mutex   sync.Mutex
+	revoked map[string]time.Time
+}
+
+func NewRevocationStore(repo repository.IRepository) *RevocationStore {
+	return &RevocationStore{Repo: repo, revoked: map[string]time.Time{}}
+}
+
+func (store *RevocationStore) Revoke(jti string, expiresAt time.Time, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "revokeTokenRevocationStore")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	err := store.Repo.CreateRevokedToken(model.RevokedToken{Jti: jti, ExpiresAt: expiresAt}, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return err
+	}
+
+	store.remember(jti, expiresAt)
+
+	return nil
+}
+
+// IsRevoked fails closed: an error means the token must not be accepted.
+func (store *RevocationStore) IsRevoked(jti string, ctx context.Context) (bool, error) {
+	span := tracer.StartSpanFromContext(ctx, "isRevokedRevocationStore")
+	defer span.Finish()
+
+	store.mutex.Lock()
+	expiresAt, found := store.revoked[jti]
+	store.mutex.Unlock()
+
+	if found && time.Now().Before(expiresAt) {
+		return true, nil
+	}
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	revokedToken, err := store.Repo.FindRevokedToken(jti, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return true, err
+	}
+
+	if revokedToken.ID == 0 {
+		return false, nil
+	}
+
+	store.remember(jti, revokedToken.ExpiresAt)
+
+	return true, nil
+}
+
+func (store *RevocationStore) remember(jti string, expiresAt time.Time) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	for cachedJti, cachedExpiresAt := range store.revoked {
+		if now.After(cachedExpiresAt) {
+			delete(store.revoked, cachedJti)
+		}
+	}
+
+	store.revoked[jti] = expiresAt
+}
@@ -0,0 +1,215 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+)
+
+// applyNotificationDefaults turns on the notifications of a role once, when
+// the user gets the role.
+func applyNotificationDefaults(user *model.User, role model.UserRole) {
+	switch role {
+	case model.GUEST:
+		user.ReservationStatusChangedNotification = true
+	case model.HOST:
+		user.SelfReviewNotification = true
+		user.AccomodationReviewNotification = true
+		user.ReservationRequestNotification = true
+		user.ReservationCanceledNotification = true
+	}
+}
+
+func hasRole(roles []model.UserRole, role model.UserRole) bool {
+	for _, heldRole := range roles {
+		if heldRole == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// activeRole is the role tokens of the session are issued for.
+func activeRole(user model.User, session model.Session) model.UserRole {
+	if session.Role != "" {
+		return session.Role
+	}
+
+	return user.Role
+}
+
+// userRoles are the roles the user holds, at least the role new sessions
+// start in.
+func (service *UserService) userRoles(user model.User, ctx context.Context) []model.UserRole {
+	span := tracer.StartSpanFromContext(ctx, "userRolesService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	roles := service.Repo.FindUserRoles(user.ID, ctx)
+	if !hasRole(roles, user.Role) {
+		roles = append(roles, user.Role)
+	}
+
+	return roles
+}
+
+// UserRoles lists the roles of the signed in user and the active one.
+func (service *UserService) UserRoles(tokenString string, ctx context.Context) (model.UserRolesResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "userRolesListService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	claims, user, err := service.validateAccessToken(tokenString, ctx)
+	if err != nil || claims.ClientId != "" {
+		err := errors.New("Unauthorised")
+		tracer.LogError(span, err)
+		return model.UserRolesResponse{}, err
+	}
+
+	return model.UserRolesResponse{Active: claims.Role, Roles: service.userRoles(user, ctx)}, nil
+}
+
+// SwitchRole makes another role of the user the active role of the session
+// and returns an access token for it. The refresh token of the session keeps
+// working and issues tokens for the new role, the old access token is
+// revoked. Switching is not a sign in, auth_time stays as it was.
+func (service *UserService) SwitchRole(tokenString string, role model.UserRole, ctx context.Context) (model.LoginResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "switchRoleService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	claims, user, err := service.validateAccessToken(tokenString, ctx)
+	if err != nil || claims.ClientId != "" {
+		err := errors.New("Unauthorised")
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, err
+	}
+
+	if !hasRole(service.userRoles(user, ctx), role) {
+		err := errors.New("you do not have this role")
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, err
+	}
+
+	session, err := service.Repo.FindSessionById(claims.SessionId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, errors.New("session has been revoked")
+	}
+
+	err = service.Repo.UpdateSessionRole(session.ID, role, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, errors.New("error while switching role")
+	}
+	session.Role = role
+
+	err = service.revocationStore().Revoke(claims.StandardClaims.Id, time.Unix(claims.ExpiresAt, 0), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, errors.New("error while switching role")
+	}
+
+	token, err := service.signAccessToken(user, session, time.Unix(claims.AuthTime, 0), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, errors.New("error while signing token")
+	}
+
+	return model.LoginResponse{Status: model.LOGIN_SUCCESS, Token: token, ExpiresIn: int64(accessTokenTTL().Seconds())}, nil
+}
+
+// AddRole gives the user another role with its notification defaults. The
+// role has to exist in the roles table.
+func (service *UserService) AddRole(userId uint64, role model.UserRole, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "addRoleService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	if _, err := service.Repo.FindRole(role, ctx); err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
+
+	user, err := service.Repo.FindUserById(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("user with given id does not exist")
+	}
+
+	if hasRole(service.userRoles(user, ctx), role) {
+		err := errors.New("user already has this role")
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
+
+	applyNotificationDefaults(&user, role)
+
+	user, err = service.Repo.AddUserRole(user, role, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("error while saving user")
+	}
+
+	return user, nil
+}
+
+// AddOwnRole lets a host start booking as a guest. Guests become hosts
+// through host onboarding, other roles are granted by an admin.
+func (service *UserService) AddOwnRole(userId uint64, role model.UserRole, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "addOwnRoleService")
+	defer span.Finish()
+
+	if role != model.GUEST {
+		err := errors.New("only the GUEST role can be added to your own account")
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	return service.AddRole(userId, role, ctx)
+}
+
+// RemoveRole takes a role away, never the last one, and signs the user out
+// everywhere so that no session stays in the removed role.
+func (service *UserService) RemoveRole(userId uint64, role model.UserRole, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "removeRoleService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, err := service.Repo.FindUserById(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("user with given id does not exist")
+	}
+
+	if !hasRole(service.userRoles(user, ctx), role) {
+		err := errors.New("user does not have this role")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	removed, err := service.Repo.RemoveUserRole(user.ID, role, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while removing role")
+	}
+
+	if !removed {
+		err := errors.New("cannot remove the last role of a user")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	err = service.invalidateUserTokens(user.ID, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while signing the user out")
+	}
+
+	return nil
+}
@@ -2,56 +2,242 @@ package service
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/base64"
 	"errors"
 	"net/mail"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/windbnb/user-service/client"
+	"github.com/windbnb/user-service/mailer"
 	"github.com/windbnb/user-service/model"
 	"github.com/windbnb/user-service/repository"
+	"github.com/windbnb/user-service/sms"
 	"github.com/windbnb/user-service/tracer"
+	"github.com/windbnb/user-service/util"
 )
 
-var jwtKey []byte
-
-func InitJWTKey() {
-	keyLength := 32
+var (
+	defaultKeyRing     *KeyRing
+	defaultKeyRingOnce sync.Once
+)
 
-	randomString := make([]byte, keyLength)
-	_, err := rand.Read(randomString)
-	if err != nil {
-		panic(err)
+// Issuer is the public base URL of the service, used as the iss claim and in
+// the discovery document.
+func Issuer() string {
+	issuer, issuerFound := os.LookupEnv("ISSUER_URL")
+	if !issuerFound {
+		issuer = "http://localhost:8081"
 	}
 
-	jwtKey = []byte(base64.RawURLEncoding.EncodeToString(randomString))
+	return strings.TrimSuffix(issuer, "/")
 }
 
 type UserService struct {
-	Repo repository.IRepository
+	Repo           repository.IRepository
+	Hasher         util.PasswordHasher
+	Keys           *KeyRing
+	Revocations    *RevocationStore
+	Mailer         mailer.Mailer
+	PasswordPolicy *util.PasswordPolicy
+	SMS            sms.Sender
+	defaultsOnce   sync.Once
+	// dummyHash is verified when a login has no stored password, so unknown
+	// emails take as long as wrong passwords.
+	dummyHash string
+}
+
+// defaults fills in the dependencies that were not injected, main injects
+// all of them. The service is shared by every request, so it runs once.
+func (service *UserService) defaults() {
+	service.defaultsOnce.Do(func() {
+		if service.Hasher == nil {
+			service.Hasher = util.NewPasswordHasher()
+		}
+		if service.Revocations == nil {
+			service.Revocations = NewRevocationStore(service.Repo)
+		}
+		if service.Mailer == nil {
+			service.Mailer = mailer.NewMailer()
+		}
+		if service.PasswordPolicy == nil {
+			service.PasswordPolicy = util.NewPasswordPolicy()
+		}
+		if service.SMS == nil {
+			service.SMS = sms.NewSender()
+		}
+		if dummyHash, err := service.Hasher.Hash("dummy-password"); err == nil {
+			service.dummyHash = dummyHash
+		}
+		// A process local ring is shared by the services that were given
+		// none, tokens signed with it do not survive a restart.
+		if service.Keys == nil {
+			defaultKeyRingOnce.Do(func() {
+				keyRing, err := NewInMemoryKeyRing(defaultSigningAlgorithm())
+				if err != nil {
+					panic(err)
+				}
+				defaultKeyRing = keyRing
+			})
+			service.Keys = defaultKeyRing
+		}
+	})
+}
+
+func (service *UserService) mailer() mailer.Mailer {
+	service.defaults()
+	return service.Mailer
+}
+
+func (service *UserService) smsSender() sms.Sender {
+	service.defaults()
+	return service.SMS
+}
+
+func (service *UserService) revocationStore() *RevocationStore {
+	service.defaults()
+	return service.Revocations
+}
+
+func (service *UserService) keyRing() *KeyRing {
+	service.defaults()
+	return service.Keys
+}
+
+func (service *UserService) passwordHasher() util.PasswordHasher {
+	service.defaults()
+	return service.Hasher
 }
 
-func (service *UserService) Login(credentials model.Credentials, ctx context.Context) (string, error) {
+func (service *UserService) Login(credentials model.Credentials, clientInfo model.ClientInfo, ctx context.Context) (model.LoginResponse, error) {
 	span := tracer.StartSpanFromContext(ctx, "loginService")
 	defer span.Finish()
 
 	ctx = tracer.ContextWithSpan(context.Background(), span)
-	user, err := service.Repo.CheckCredentials(credentials.Email, credentials.Password, ctx)
+	user, err := service.authenticatePassword(credentials, clientInfo, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, err
+	}
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	if user.TotpEnabled {
+		return service.mfaChallenge(user, ctx)
+	}
+
+	service.recordLoginSuccess(user.Email, ctx)
+	return service.completeLogin(user, clientInfo, ctx)
+}
+
+// authenticatePassword checks the first factor of every login flow: the login
+// throttle, the password and the account state.
+func (service *UserService) authenticatePassword(credentials model.Credentials, clientInfo model.ClientInfo, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "authenticatePasswordService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	err := service.checkLoginThrottle(credentials.Email, clientInfo.IP, passwordLoginMethod, ctx)
+	if err != nil {
+		return model.User{}, err
+	}
+
+	// Accounts without a linked password identity cannot sign in with one.
+	user, identity, err := service.Repo.FindUserByIdentity(model.PASSWORD_IDENTITY, model.IdentitySubject(credentials.Email), ctx)
+
+	if err != nil || user.Password == "" {
+		if err == nil {
+			err = errors.New("bad credentials")
+		}
+		tracer.LogError(span, err)
+		hasher := service.passwordHasher()
+		util.VerifyPassword(hasher, credentials.Password, service.dummyHash)
+		service.recordLoginFailure(credentials.Email, clientInfo.IP, passwordLoginMethod, ctx)
+		return model.User{}, errors.New("bad credentials")
+	}
+
+	valid, needsRehash := util.VerifyPassword(service.passwordHasher(), credentials.Password, user.Password)
+	if !valid {
+		err := errors.New("bad credentials")
+		tracer.LogError(span, err)
+		service.recordLoginFailure(credentials.Email, clientInfo.IP, passwordLoginMethod, ctx)
+		return model.User{}, err
+	}
+
+	if needsRehash {
+		service.rehashPassword(user, credentials.Password, ctx)
+	}
+
+	service.touchIdentity(identity, ctx)
+
+	if user.Suspended {
+		err := errors.New("account is suspended")
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
+
+	if !user.Verified && unverifiedPolicy() == UNVERIFIED_DENY {
+		tracer.LogError(span, ErrEmailNotVerified)
+		return model.User{}, ErrEmailNotVerified
+	}
+
+	return user, nil
+}
+
+// completeLogin starts a session for a fully authenticated user, unless
+// their password has expired and has to be changed first.
+func (service *UserService) completeLogin(user model.User, clientInfo model.ClientInfo, ctx context.Context) (model.LoginResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "completeLoginService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	if passwordExpired(user) {
+		return service.passwordChangeRequired(user, ctx)
+	}
+
+	return service.startLoginSession(user, clientInfo, ctx)
+}
+
+// startLoginSession starts a first party session once every login check
+// passed.
+func (service *UserService) startLoginSession(user model.User, clientInfo model.ClientInfo, ctx context.Context) (model.LoginResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "startLoginSessionService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	session, err := service.startSession(user, clientInfo, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, err
+	}
 
+	response, err := service.issueTokens(user, session, "", ctx)
 	if err != nil {
 		tracer.LogError(span, err)
-		return "", errors.New("bad credentials")
+		return model.LoginResponse{}, err
 	}
 
-	expirationTime := time.Now().Add(time.Hour * 24)
-	claims := model.Claims{Email: user.Email, Role: user.Role, Id: user.ID, StandardClaims: jwt.StandardClaims{ExpiresAt: expirationTime.Unix()}}
+	return response, nil
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims)
-	tokenString, _ := token.SignedString(jwtKey)
+// rehashPassword upgrades legacy plaintext or outdated hashes after a
+// successful login. Failures are only traced, the login itself goes through.
+func (service *UserService) rehashPassword(user model.User, password string, ctx context.Context) {
+	span := tracer.StartSpanFromContext(ctx, "rehashPasswordService")
+	defer span.Finish()
 
-	return tokenString, nil
+	hash, err := service.passwordHasher().Hash(password)
+	if err != nil {
+		tracer.LogError(span, err)
+		return
+	}
+
+	user.Password = hash
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	if _, err := service.Repo.UpdateUser(user, []string{"password"}, ctx); err != nil {
+		tracer.LogError(span, err)
+	}
 }
 
 func (service *UserService) CreateUser(user model.User, ctx context.Context) (model.User, error) {
@@ -65,23 +251,56 @@ func (service *UserService) CreateUser(user model.User, ctx context.Context) (mo
 		return user, errors.New("email format is not valid")
 	}
 
-	if user.Role == model.GUEST {
-		user.ReservationStatusChangedNotification = true
-	} else {
-		user.SelfReviewNotification = true
-		user.AccomodationReviewNotification = true
-		user.ReservationRequestNotification = true
-		user.ReservationCanceledNotification = true
+	err = service.validatePassword("password", user.Password, user.Email, user.Username)
+	if err != nil {
+		tracer.LogError(span, err)
+		return user, err
+	}
+
+	if user.Role != model.GUEST && user.Role != model.HOST {
+		err := errors.New("role must be GUEST or HOST")
+		tracer.LogError(span, err)
+		return user, err
 	}
 
+	// Only accounts provisioned by an identity provider may leave it empty.
+	if strings.TrimSpace(user.Address) == "" {
+		err := errors.New("address is required")
+		tracer.LogError(span, err)
+		return user, err
+	}
+
+	applyNotificationDefaults(&user, user.Role)
+
+	hash, err := service.passwordHasher().Hash(user.Password)
+	if err != nil {
+		tracer.LogError(span, err)
+		return user, errors.New("error while trying to save user")
+	}
+
+	userToCreate := user
+	userToCreate.Password = hash
+	userToCreate.Verified = false
+	passwordChangedAt := time.Now()
+	userToCreate.PasswordChangedAt = &passwordChangedAt
+
 	ctx = tracer.ContextWithSpan(context.Background(), span)
-	createdUser, err := service.Repo.CreateUser(user, ctx)
+	createdUser, err := service.Repo.CreateUser(userToCreate, []model.UserIdentity{
+		model.EmailIdentity(model.PASSWORD_IDENTITY, userToCreate),
+		model.EmailIdentity(model.MAGIC_LINK_IDENTITY, userToCreate),
+	}, ctx)
 
 	if err != nil {
 		tracer.LogError(span, err)
 		return user, errors.New("error while trying to save user")
 	}
 
+	// The account exists either way, the user can ask for another link.
+	err = service.sendVerificationEmail(createdUser, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+	}
+
 	return createdUser, nil
 }
 
@@ -89,30 +308,59 @@ func (service *UserService) AuthenticateUser(tokenString string, role model.User
 	span := tracer.StartSpanFromContext(ctx, "authoriseUserService")
 	defer span.Finish()
 
-	claims := model.Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, &claims,
-		func(t *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	claims, err := service.parseToken(tokenString, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
 
-	if err != nil || !token.Valid {
+	// Tokens issued to OAuth clients are only good for the endpoints their
+	// scopes grant, such as userinfo.
+	if claims.ClientId != "" {
+		err := errors.New("token was issued to a third party client")
 		tracer.LogError(span, err)
 		return model.User{}, err
 	}
 
-	if authorise && token.Claims.(*model.Claims).Role != role {
+	// The role claim is the active role of the session, a user holding both
+	// roles only passes the check for the one they switched to.
+	if authorise && claims.Role != role {
 		err := errors.New("user does not have said role")
 		tracer.LogError(span, err)
 		return model.User{}, err
 	}
 
 	ctx = tracer.ContextWithSpan(context.Background(), span)
-	user, err := service.Repo.FindUserById(uint64(token.Claims.(*model.Claims).Id), ctx)
+	user, err := service.Repo.FindUserById(uint64(claims.Id), ctx)
 
 	if err != nil {
 		return model.User{}, err
 	}
 
+	if claims.TokenVersion != user.TokenVersion {
+		err := errors.New("token is no longer valid")
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
+
+	if user.Suspended {
+		err := errors.New("account is suspended")
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
+
+	err = service.checkSession(claims, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, err
+	}
+
+	if authorise && !user.Verified && unverifiedPolicy() != UNVERIFIED_ALLOW {
+		tracer.LogError(span, ErrEmailNotVerified)
+		return model.User{}, ErrEmailNotVerified
+	}
+
 	return user, nil
 }
 
@@ -131,7 +379,7 @@ func (service *UserService) FindUser(userId uint64, ctx context.Context) (model.
 	return userToUpdate, nil
 }
 
-func (service *UserService) DeleteUser(userId uint64, tokenString string, ctx context.Context) error {
+func (service *UserService) DeleteUser(userId uint64, ctx context.Context) error {
 	span := tracer.StartSpanFromContext(ctx, "deleteUserService")
 	defer span.Finish()
 
@@ -142,22 +390,36 @@ func (service *UserService) DeleteUser(userId uint64, tokenString string, ctx co
 		return err
 	}
 
-	userIsHost := false
-	if userToDelete.Role == model.GUEST {
-		err := client.CheckReservations(userToDelete.ID, "guest", tokenString)
+	reservationsToken, err := service.ServiceToken(client.ReservationsReadScope)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while signing token")
+	}
+
+	roles := service.userRoles(userToDelete, ctx)
+	if hasRole(roles, model.GUEST) {
+		err := client.CheckReservations(userToDelete.ID, "guest", reservationsToken)
 		if err != nil {
 			tracer.LogError(span, err)
 			return err
 		}
-	} else if userToDelete.Role == model.HOST {
-		userIsHost = true
-		err := client.CheckReservations(userToDelete.ID, "owner", tokenString)
+	}
+
+	userIsHost := hasRole(roles, model.HOST)
+	if userIsHost {
+		err := client.CheckReservations(userToDelete.ID, "owner", reservationsToken)
 		if err != nil {
 			tracer.LogError(span, err)
 			return err
 		}
 	}
 
+	err = service.invalidateUserTokens(userToDelete.ID, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return err
+	}
+
 	err = service.Repo.DeleteUser(userId, ctx)
 	if err != nil {
 		tracer.LogError(span, err)
@@ -165,7 +427,7 @@ func (service *UserService) DeleteUser(userId uint64, tokenString string, ctx co
 	}
 
 	if userIsHost {
-		err = client.DeleteAccomodationForHost(uint(userId))
+		err = service.DeleteAccomodationForHost(uint(userId))
 		if err != nil {
 			tracer.LogError(span, err)
 			service.Repo.SaveUserDeletionEvent(userId, ctx)
@@ -175,6 +437,17 @@ func (service *UserService) DeleteUser(userId uint64, tokenString string, ctx co
 	return nil
 }
 
+// DeleteAccomodationForHost removes the accommodations of a deleted host, the
+// cron job retries it for the hosts it failed for.
+func (service *UserService) DeleteAccomodationForHost(hostId uint) error {
+	serviceToken, err := service.ServiceToken(client.AccommodationsDeleteScope)
+	if err != nil {
+		return errors.New("error while signing token")
+	}
+
+	return client.DeleteAccomodationForHost(hostId, serviceToken)
+}
+
 func (service *UserService) EditUser(user model.UserDTO, userId uint64, ctx context.Context) (model.User, error) {
 	span := tracer.StartSpanFromContext(ctx, "editUserService")
 	defer span.Finish()
@@ -189,12 +462,13 @@ func (service *UserService) EditUser(user model.UserDTO, userId uint64, ctx cont
 
 	userToUpdate.Name = user.Name
 	userToUpdate.Surname = user.Surname
-	userToUpdate.Email = user.Email
 	userToUpdate.Address = user.Address
 
-	if userToUpdate.Role == model.GUEST {
+	roles := service.userRoles(userToUpdate, ctx)
+	if hasRole(roles, model.GUEST) {
 		userToUpdate.ReservationStatusChangedNotification = user.ReservationStatusChangedNotification
-	} else {
+	}
+	if hasRole(roles, model.HOST) {
 		userToUpdate.SelfReviewNotification = user.SelfReviewNotification
 		userToUpdate.AccomodationReviewNotification = user.AccomodationReviewNotification
 		userToUpdate.ReservationRequestNotification = user.ReservationRequestNotification
@@ -211,8 +485,27 @@ func (service *UserService) EditUser(user model.UserDTO, userId uint64, ctx cont
 
 	userToUpdate.Username = user.Username
 
+	// A new email only replaces the login email once the new address confirms
+	// it, see requestEmailChange.
+	newEmail := strings.TrimSpace(user.Email)
+	if emailChangeRequested(userToUpdate, newEmail) {
+		address, err := mail.ParseAddress(newEmail)
+		if err != nil || address.Address != newEmail {
+			err := errors.New("email format is not valid")
+			tracer.LogError(span, err)
+			return model.User{}, err
+		}
+
+		ctx = tracer.ContextWithSpan(context.Background(), span)
+		userToUpdate, err = service.requestEmailChange(userToUpdate, newEmail, ctx)
+		if err != nil {
+			tracer.LogError(span, err)
+			return model.User{}, err
+		}
+	}
+
 	ctx = tracer.ContextWithSpan(context.Background(), span)
-	savedUser, err := service.Repo.SaveUser(userToUpdate, ctx)
+	savedUser, err := service.Repo.UpdateUser(userToUpdate, append([]string{"name", "surname", "address", "username", "pending_email"}, model.NotificationColumns...), ctx)
 
 	if err != nil {
 		tracer.LogError(span, err)
@@ -234,23 +527,197 @@ func (service *UserService) ChangePassword(user model.ChangePasswordDTO, userId
 		return errors.New("user with given id does not exist")
 	}
 
-	if user.OldPassword != "" {
-		if user.OldPassword != userToUpdate.Password {
-			err := errors.New("old and new password do not match")
-			tracer.LogError(span, err)
-			return err
-		}
+	if user.OldPassword == "" || user.NewPassword == "" {
+		err := errors.New("old and new password are required")
+		tracer.LogError(span, err)
+		return err
+	}
 
-		userToUpdate.Password = user.NewPassword
+	if valid, _ := util.VerifyPassword(service.passwordHasher(), user.OldPassword, userToUpdate.Password); !valid {
+		err := errors.New("old and new password do not match")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	err = service.validatePassword("newPassword", user.NewPassword, userToUpdate.Email, userToUpdate.Username)
+	if err != nil {
+		tracer.LogError(span, err)
+		return err
 	}
 
 	ctx = tracer.ContextWithSpan(context.Background(), span)
-	_, err = service.Repo.SaveUser(userToUpdate, ctx)
+	err = service.checkPasswordReuse(userToUpdate, "newPassword", user.NewPassword, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return err
+	}
 
+	hash, err := service.passwordHasher().Hash(user.NewPassword)
 	if err != nil {
 		tracer.LogError(span, err)
 		return errors.New("error while saving user")
 	}
 
+	userToUpdate, err = service.setPassword(userToUpdate, hash, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return err
+	}
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	_, err = service.Repo.UpdateUser(userToUpdate, []string{"password", "password_changed_at"}, ctx)
+
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while saving user")
+	}
+
+	err = service.invalidateUserTokens(userToUpdate.ID, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while invalidating sessions")
+	}
+
+	return nil
+}
+
+// invalidateUserTokens rejects every access token issued to the user so far
+// and revokes their refresh tokens.
+func (service *UserService) invalidateUserTokens(userId uint, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "invalidateUserTokensService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	err := service.Repo.IncrementTokenVersion(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return err
+	}
+
+	err = service.Repo.RevokeRefreshTokensForUser(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return err
+	}
+
+	err = service.Repo.RevokeSessionsForUser(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return err
+	}
+
 	return nil
 }
+
+func (service *UserService) LogoutEverywhere(userId uint64, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "logoutEverywhereService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	err := service.invalidateUserTokens(uint(userId), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while invalidating sessions")
+	}
+
+	return nil
+}
+
+func (service *UserService) SuspendUser(userId uint64, suspended bool, ctx context.Context) (model.User, error) {
+	span := tracer.StartSpanFromContext(ctx, "suspendUserService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	userToUpdate, err := service.Repo.FindUserById(userId, ctx)
+
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("user with given id does not exist")
+	}
+
+	userToUpdate.Suspended = suspended
+
+	savedUser, err := service.Repo.UpdateUser(userToUpdate, []string{"suspended"}, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.User{}, errors.New("error while saving user")
+	}
+
+	if suspended {
+		err = service.invalidateUserTokens(savedUser.ID, ctx)
+		if err != nil {
+			tracer.LogError(span, err)
+			return model.User{}, errors.New("error while invalidating sessions")
+		}
+	}
+
+	return savedUser, nil
+}
+
+func (service *UserService) ListSigningKeys(ctx context.Context) []SigningKey {
+	span := tracer.StartSpanFromContext(ctx, "listSigningKeysService")
+	defer span.Finish()
+
+	return service.keyRing().Keys()
+}
+
+func (service *UserService) RotateSigningKey(algorithm string, ctx context.Context) (SigningKey, error) {
+	span := tracer.StartSpanFromContext(ctx, "rotateSigningKeyService")
+	defer span.Finish()
+
+	if algorithm == "" {
+		algorithm = defaultSigningAlgorithm()
+	}
+
+	key, err := service.keyRing().Rotate(algorithm)
+	if err != nil {
+		tracer.LogError(span, err)
+		return SigningKey{}, err
+	}
+
+	return key, nil
+}
+
+func (service *UserService) RetireSigningKey(kid string, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "retireSigningKeyService")
+	defer span.Finish()
+
+	err := service.keyRing().Retire(kid)
+	if err != nil {
+		tracer.LogError(span, err)
+		return err
+	}
+
+	return nil
+}
+
+func (service *UserService) JWKS(ctx context.Context) model.JSONWebKeySet {
+	span := tracer.StartSpanFromContext(ctx, "jwksService")
+	defer span.Finish()
+
+	return service.keyRing().JWKS()
+}
+
+func (service *UserService) OpenIDConfiguration(ctx context.Context) model.OpenIDConfiguration {
+	span := tracer.StartSpanFromContext(ctx, "openIDConfigurationService")
+	defer span.Finish()
+
+	return model.OpenIDConfiguration{
+		Issuer:                            Issuer(),
+		AuthorizationEndpoint:             Issuer() + "/oauth/authorize",
+		TokenEndpoint:                     Issuer() + "/oauth/token",
+		UserinfoEndpoint:                  Issuer() + "/oauth/userinfo",
+		IntrospectionEndpoint:             Issuer() + "/api/users/introspect",
+		JwksURI:                           Issuer() + "/.well-known/jwks.json",
+		ScopesSupported:                   OAuthScopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token", "client_credentials"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "self_signed_tls_client_auth", "none"},
+		IntrospectionEndpointAuthMethods:  []string{"client_secret_basic", "client_secret_post", "self_signed_tls_client_auth"},
+		SubjectTypesSupported:             []string{"public"},
+		IdTokenSigningAlgValuesSupported:  service.keyRing().SigningAlgorithms(),
+		ClaimsSupported: []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "name", "given_name", "family_name",
+			"preferred_username", "email", "email_verified", "role", "id"},
+	}
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+	"github.com/windbnb/user-service/util"
+)
+
+// servicePurpose marks the tokens services get for calling each other, they
+// are never accepted where a user token is expected.
+const servicePurpose = "service"
+
+// serviceScopePattern is the resource:action form of service scopes, such
+// as reservations:read.
+var serviceScopePattern = regexp.MustCompile(`^[a-z]+:[a-z]+$`)
+
+func serviceTokenTTL() time.Duration {
+	return util.DurationFromEnv("SERVICE_TOKEN_TTL", 5*time.Minute)
+}
+
+// ServiceClientId is the client id this service puts into the tokens it signs
+// for its own outgoing calls.
+func ServiceClientId() string {
+	clientId, clientIdFound := os.LookupEnv("SERVICE_CLIENT_ID")
+	if !clientIdFound {
+		clientId = "user-service"
+	}
+
+	return clientId
+}
+
+func (service *UserService) signServiceToken(clientId string, scope string) (string, error) {
+	jti, err := util.GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := model.Claims{ClientId: clientId, Scope: scope, Purpose: servicePurpose,
+		StandardClaims: jwt.StandardClaims{Id: jti, Subject: clientId, ExpiresAt: now.Add(serviceTokenTTL()).Unix(), IssuedAt: now.Unix(), Issuer: Issuer()}}
+
+	return service.keyRing().Sign(&claims)
+}
+
+// ServiceToken signs a token for a call of this service to another one. It
+// is signed directly, the service does not go through its own token endpoint.
+func (service *UserService) ServiceToken(scope string) (string, error) {
+	return service.signServiceToken(ServiceClientId(), scope)
+}
+
+// registerServiceClient registers another service. Service clients have no
+// redirect URIs and authenticate with a secret or a pinned certificate.
+func (service *UserService) registerServiceClient(request model.RegisterOAuthClientRequest, ctx context.Context) (model.OAuthClientDTO, error) {
+	span := tracer.StartSpanFromContext(ctx, "registerServiceClientService")
+	defer span.Finish()
+
+	if strings.TrimSpace(request.Name) == "" || len(request.Scopes) == 0 {
+		err := errors.New("name and at least one scope are required")
+		tracer.LogError(span, err)
+		return model.OAuthClientDTO{}, err
+	}
+
+	if len(request.RedirectURIs) > 0 || request.Public {
+		err := errors.New("service clients are confidential and have no redirect uris")
+		tracer.LogError(span, err)
+		return model.OAuthClientDTO{}, err
+	}
+
+	for _, scope := range request.Scopes {
+		if !serviceScopePattern.MatchString(scope) {
+			err := errors.New("unsupported scope")
+			tracer.LogError(span, err)
+			return model.OAuthClientDTO{}, err
+		}
+	}
+
+	clientId, err := util.GenerateOpaqueToken()
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.OAuthClientDTO{}, errors.New("error while registering client")
+	}
+
+	client := model.OAuthClient{
+		ClientId:              clientId[:22],
+		Name:                  strings.TrimSpace(request.Name),
+		Scopes:                strings.Join(request.Scopes, " "),
+		Service:               true,
+		CertificateThumbprint: request.CertificateThumbprint,
+	}
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	return service.createOAuthClient(client, ctx)
+}
+
+// clientCredentialsGrant issues a service token for the requested scopes,
+// all scopes of the client when none are requested. There is no refresh
+// token, the client asks for a new token instead.
+func (service *UserService) clientCredentialsGrant(client model.OAuthClient, scope string, ctx context.Context) (model.OAuthTokenResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "clientCredentialsGrantService")
+	defer span.Finish()
+
+	scope = strings.Join(strings.Fields(scope), " ")
+	if scope == "" {
+		scope = client.Scopes
+	}
+
+	if !containsScopes(client.Scopes, scope) {
+		err := oauthError("invalid_scope", "the client may not request these scopes")
+		tracer.LogError(span, err)
+		return model.OAuthTokenResponse{}, err
+	}
+
+	token, err := service.signServiceToken(client.ClientId, scope)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.OAuthTokenResponse{}, errors.New("error while signing token")
+	}
+
+	return model.OAuthTokenResponse{AccessToken: token, TokenType: "Bearer", ExpiresIn: int64(serviceTokenTTL().Seconds()), Scope: scope}, nil
+}
+
+// introspectServiceToken describes a service token, it stops being active
+// once its client is deleted.
+func (service *UserService) introspectServiceToken(tokenString string, ctx context.Context) model.IntrospectionResponse {
+	span := tracer.StartSpanFromContext(ctx, "introspectServiceTokenService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	claims, err := service.parsePurposeToken(tokenString, servicePurpose, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.IntrospectionResponse{Active: false}
+	}
+
+	if claims.ClientId != ServiceClientId() {
+		client, err := service.Repo.FindOAuthClient(claims.ClientId, ctx)
+		if err != nil || !client.Service {
+			tracer.LogError(span, errors.New("service client does not exist"))
+			return model.IntrospectionResponse{Active: false}
+		}
+	}
+
+	return model.IntrospectionResponse{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientId:  claims.ClientId,
+		TokenType: "Bearer",
+		Exp:       claims.ExpiresAt,
+		Iat:       claims.IssuedAt,
+		Sub:       claims.Subject,
+		Iss:       claims.Issuer,
+		Jti:       claims.StandardClaims.Id,
+	}
+}
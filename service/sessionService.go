@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+)
+
+// last seen timestamps are only written once per interval, so that every
+// authenticated request does not turn into a database write
+const sessionTouchInterval = time.Minute
+
+func (service *UserService) startSession(user model.User, clientInfo model.ClientInfo, ctx context.Context) (model.Session, error) {
+	span := tracer.StartSpanFromContext(ctx, "startSessionService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	session, err := service.Repo.CreateSession(model.Session{
+		UserId:     user.ID,
+		Role:       user.Role,
+		Device:     clientInfo.Device,
+		UserAgent:  clientInfo.UserAgent,
+		IP:         clientInfo.IP,
+		LastSeenAt: time.Now(),
+	}, ctx)
+
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.Session{}, errors.New("error while saving session")
+	}
+
+	return session, nil
+}
+
+// startClientSession starts a session for tokens issued to a third party
+// client, the session remembers the client and the granted scope.
+func (service *UserService) startClientSession(user model.User, client model.OAuthClient, scope string, clientInfo model.ClientInfo, ctx context.Context) (model.Session, error) {
+	span := tracer.StartSpanFromContext(ctx, "startClientSessionService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	session, err := service.Repo.CreateSession(model.Session{
+		UserId:     user.ID,
+		Role:       user.Role,
+		ClientId:   client.ClientId,
+		Scope:      scope,
+		Device:     client.Name,
+		UserAgent:  clientInfo.UserAgent,
+		IP:         clientInfo.IP,
+		LastSeenAt: time.Now(),
+	}, ctx)
+
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.Session{}, errors.New("error while saving session")
+	}
+
+	return session, nil
+}
+
+// checkSession rejects tokens whose session was revoked and records activity.
+func (service *UserService) checkSession(claims *model.Claims, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "checkSessionService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	session, err := service.Repo.FindSessionById(claims.SessionId, ctx)
+	if err != nil || session.UserId != claims.Id || session.RevokedAt != nil {
+		err := errors.New("session has been revoked")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	now := time.Now()
+	if now.Sub(session.LastSeenAt) > sessionTouchInterval {
+		service.Repo.TouchSession(session.ID, now, ctx)
+	}
+
+	return nil
+}
+
+func (service *UserService) ListSessions(userId uint64, tokenString string, ctx context.Context) ([]model.SessionDTO, error) {
+	span := tracer.StartSpanFromContext(ctx, "listSessionsService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	claims, err := service.parseToken(tokenString, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return nil, err
+	}
+
+	sessions := []model.SessionDTO{}
+	for _, session := range service.Repo.FindActiveSessionsByUser(uint(userId), ctx) {
+		sessions = append(sessions, session.ToDTO(claims.SessionId))
+	}
+
+	return sessions, nil
+}
+
+func (service *UserService) RevokeSession(userId uint64, sessionId uint64, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "revokeSessionService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	session, err := service.Repo.FindSessionById(uint(sessionId), ctx)
+	if err != nil || session.UserId != uint(userId) {
+		err := errors.New("session with given id does not exist")
+		tracer.LogError(span, err)
+		return err
+	}
+
+	err = service.Repo.RevokeSession(session.ID, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while revoking session")
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+	"github.com/windbnb/user-service/util"
+)
+
+// SensitiveOperation names an account change that needs a recent sign in.
+type SensitiveOperation string
+
+const (
+	STEP_UP_DELETE_ACCOUNT  SensitiveOperation = "DELETE_ACCOUNT"
+	STEP_UP_CHANGE_PASSWORD SensitiveOperation = "CHANGE_PASSWORD"
+	STEP_UP_CHANGE_EMAIL    SensitiveOperation = "CHANGE_EMAIL"
+	STEP_UP_MANAGE_2FA      SensitiveOperation = "MANAGE_2FA"
+)
+
+var stepUpDefaultMaxAge = map[SensitiveOperation]time.Duration{
+	STEP_UP_DELETE_ACCOUNT:  5 * time.Minute,
+	STEP_UP_CHANGE_PASSWORD: 10 * time.Minute,
+	STEP_UP_CHANGE_EMAIL:    10 * time.Minute,
+	STEP_UP_MANAGE_2FA:      5 * time.Minute,
+}
+
+// stepUpMaxAge is how long ago the user may have entered their credentials
+// for the operation, configured with STEP_UP_MAX_AGE_<OPERATION>.
+func stepUpMaxAge(operation SensitiveOperation) time.Duration {
+	return util.DurationFromEnv("STEP_UP_MAX_AGE_"+string(operation), stepUpDefaultMaxAge[operation])
+}
+
+// StepUpRequiredError tells the client to ask for the credentials again and
+// retry with the token returned by StepUp.
+type StepUpRequiredError struct {
+	MaxAge time.Duration
+}
+
+func (err *StepUpRequiredError) Error() string {
+	return fmt.Sprintf("sign in again to continue, this needs a sign in from the last %s", err.MaxAge)
+}
+
+// RequireStepUp checks that the token was issued for credentials entered
+// recently enough for the operation. The restricted token of an expired
+// password counts as fresh for the password change it is meant for.
+func (service *UserService) RequireStepUp(tokenString string, operation SensitiveOperation, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "requireStepUpService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	claims, err := service.parseToken(tokenString, ctx)
+	if err != nil && operation == STEP_UP_CHANGE_PASSWORD {
+		claims, err = service.parsePurposeToken(tokenString, passwordChangePurpose, ctx)
+		if err == nil {
+			claims.AuthTime = claims.IssuedAt
+		}
+	}
+
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("Unauthorised")
+	}
+
+	maxAge := stepUpMaxAge(operation)
+	if claims.AuthTime == 0 || time.Since(time.Unix(claims.AuthTime, 0)) > maxAge {
+		err := &StepUpRequiredError{MaxAge: maxAge}
+		tracer.LogError(span, err)
+		return err
+	}
+
+	return nil
+}
+
+// StepUp confirms the password, and the second factor when it is enabled, of
+// a signed in user and returns an access token for the same session with a
+// fresh auth_time. Accounts without a password have to sign in again.
+func (service *UserService) StepUp(tokenString string, request model.StepUpRequest, clientInfo model.ClientInfo, ctx context.Context) (model.LoginResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "stepUpService")
+	defer span.Finish()
+
+	invalidTokenErr := errors.New("Unauthorised")
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	claims, err := service.parseToken(tokenString, ctx)
+	if err != nil || claims.ClientId != "" {
+		tracer.LogError(span, invalidTokenErr)
+		return model.LoginResponse{}, invalidTokenErr
+	}
+
+	user, err := service.Repo.FindUserById(uint64(claims.Id), ctx)
+	if err != nil || user.Suspended || user.TokenVersion != claims.TokenVersion {
+		tracer.LogError(span, invalidTokenErr)
+		return model.LoginResponse{}, invalidTokenErr
+	}
+
+	session, err := service.Repo.FindSessionById(claims.SessionId, ctx)
+	if err != nil || session.RevokedAt != nil || session.UserId != user.ID {
+		tracer.LogError(span, invalidTokenErr)
+		return model.LoginResponse{}, invalidTokenErr
+	}
+
+	if _, hasPassword := findIdentity(service.Repo.FindUserIdentities(user.ID, ctx), model.PASSWORD_IDENTITY); !hasPassword {
+		err := errors.New("sign in again to confirm it is you")
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, err
+	}
+
+	err = service.checkLoginThrottle(user.Email, clientInfo.IP, passwordLoginMethod, ctx)
+	if err != nil {
+		return model.LoginResponse{}, err
+	}
+
+	if valid, _ := util.VerifyPassword(service.passwordHasher(), request.Password, user.Password); !valid {
+		err := errors.New("re-authentication failed")
+		tracer.LogError(span, err)
+		service.recordLoginFailure(user.Email, clientInfo.IP, passwordLoginMethod, ctx)
+		return model.LoginResponse{}, err
+	}
+
+	if user.TotpEnabled {
+		err = service.checkLoginThrottle(user.Email, clientInfo.IP, mfaLoginMethod, ctx)
+		if err != nil {
+			return model.LoginResponse{}, err
+		}
+
+		if !service.verifySecondFactor(user, request.Code, ctx) {
+			err := errors.New("invalid verification code")
+			tracer.LogError(span, err)
+			service.recordLoginFailure(user.Email, clientInfo.IP, mfaLoginMethod, ctx)
+			return model.LoginResponse{}, err
+		}
+	}
+
+	service.recordLoginSuccess(user.Email, ctx)
+
+	token, err := service.signAccessToken(user, session, time.Now(), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, errors.New("error while signing token")
+	}
+
+	return model.LoginResponse{Status: model.LOGIN_SUCCESS, Token: token, ExpiresIn: int64(accessTokenTTL().Seconds())}, nil
+}
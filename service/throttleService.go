@@ -0,0 +1,250 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/windbnb/user-service/metrics"
+	"github.com/windbnb/user-service/tracer"
+	"github.com/windbnb/user-service/util"
+)
+
+const (
+	passwordLoginMethod = "password"
+	mfaLoginMethod      = "mfa"
+)
+
+// TooManyAttemptsError is returned while an account or address is backing off
+// or locked out. It deliberately looks the same for existing and unknown
+// emails.
+type TooManyAttemptsError struct {
+	RetryAfter time.Duration
+}
+
+func (err *TooManyAttemptsError) Error() string {
+	return "too many failed login attempts, try again later"
+}
+
+type loginThrottleConfig struct {
+	accountThreshold int
+	ipThreshold      int
+	lockoutDuration  time.Duration
+	backoffAfter     int
+	backoffBase      time.Duration
+	backoffMax       time.Duration
+}
+
+func throttleConfig() loginThrottleConfig {
+	return loginThrottleConfig{
+		accountThreshold: util.IntFromEnv("LOGIN_LOCKOUT_THRESHOLD", 5),
+		ipThreshold:      util.IntFromEnv("LOGIN_IP_LOCKOUT_THRESHOLD", 20),
+		lockoutDuration:  util.DurationFromEnv("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		backoffAfter:     util.IntFromEnv("LOGIN_BACKOFF_AFTER", 3),
+		backoffBase:      util.DurationFromEnv("LOGIN_BACKOFF_BASE", time.Second),
+		backoffMax:       util.DurationFromEnv("LOGIN_BACKOFF_MAX", time.Minute),
+	}
+}
+
+func accountThrottleKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// backoff leaves the first few typos alone and then doubles with every
+// failure: base, 2*base, 4*base... up to max.
+func (config loginThrottleConfig) backoff(failures int) time.Duration {
+	if failures < config.backoffAfter {
+		return 0
+	}
+
+	delay := float64(config.backoffBase) * math.Pow(2, float64(failures-config.backoffAfter))
+	if delay > float64(config.backoffMax) {
+		return config.backoffMax
+	}
+
+	return time.Duration(delay)
+}
+
+func (service *UserService) throttleKeys(email string, ip string) []string {
+	keys := []string{accountThrottleKey(email)}
+	if ip != "" {
+		keys = append(keys, ipThrottleKey(ip))
+	}
+
+	return keys
+}
+
+// checkLoginThrottle rejects the attempt while the account or the source
+// address is locked or still inside its backoff delay.
+func (service *UserService) checkLoginThrottle(email string, ip string, method string, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "checkLoginThrottleService")
+	defer span.Finish()
+
+	config := throttleConfig()
+	now := time.Now()
+	retryAfter := time.Duration(0)
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	for _, key := range service.throttleKeys(email, ip) {
+		loginThrottle := service.Repo.FindLoginThrottle(key, ctx)
+		if loginThrottle.ID == 0 {
+			continue
+		}
+
+		if loginThrottle.LockedUntil != nil && loginThrottle.LockedUntil.After(now) {
+			retryAfter = maxDuration(retryAfter, loginThrottle.LockedUntil.Sub(now))
+		}
+
+		if wait := loginThrottle.LastFailureAt.Add(config.backoff(loginThrottle.Failures)).Sub(now); wait > 0 {
+			retryAfter = maxDuration(retryAfter, wait)
+		}
+	}
+
+	if retryAfter > 0 {
+		metrics.LoginThrottled(method)
+		err := &TooManyAttemptsError{RetryAfter: retryAfter}
+		tracer.LogError(span, err)
+		return err
+	}
+
+	return nil
+}
+
+func (service *UserService) recordLoginFailure(email string, ip string, method string, ctx context.Context) {
+	span := tracer.StartSpanFromContext(ctx, "recordLoginFailureService")
+	defer span.Finish()
+
+	metrics.LoginFailed(method)
+	config := throttleConfig()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	for _, key := range service.throttleKeys(email, ip) {
+		loginThrottle, err := service.Repo.RecordLoginFailure(key, config.lockoutDuration, ctx)
+		if err != nil {
+			tracer.LogError(span, err)
+			continue
+		}
+
+		scope, threshold := "account", config.accountThreshold
+		if strings.HasPrefix(key, "ip:") {
+			scope, threshold = "ip", config.ipThreshold
+		}
+
+		// Every failure from the threshold on locks, so that concurrent
+		// failures jumping past it cannot skip the lock.
+		if loginThrottle.Failures >= threshold {
+			metrics.LoginLockedOut(scope)
+			service.Repo.LockLoginThrottle(key, time.Now().Add(config.lockoutDuration), ctx)
+		}
+	}
+}
+
+// recordLoginSuccess only resets the account counter, a valid login from an
+// address must not clear failures it produced against other accounts.
+func (service *UserService) recordLoginSuccess(email string, ctx context.Context) {
+	span := tracer.StartSpanFromContext(ctx, "recordLoginSuccessService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	service.Repo.DeleteLoginThrottle(accountThrottleKey(email), ctx)
+}
+
+func (service *UserService) UnlockUser(userId uint64, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "unlockUserService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, err := service.Repo.FindUserById(userId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("user with given id does not exist")
+	}
+
+	err = service.Repo.DeleteLoginThrottle(accountThrottleKey(user.Email), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while unlocking user")
+	}
+
+	return nil
+}
+
+// emailRequestThrottle limits the requests that email an account, like magic
+// links and password resets, per email and per source address.
+type emailRequestThrottle struct {
+	emailLimit int
+	ipLimit    int
+	window     time.Duration
+}
+
+// emailRequestThrottleKeys are kept apart from the password login keys by the
+// purpose, asking for emails must not lock anybody out of their password.
+func emailRequestThrottleKeys(purpose string, email string, ip string) []string {
+	keys := []string{purpose + ":" + accountThrottleKey(email)}
+	if ip != "" {
+		keys = append(keys, purpose+":"+ipThrottleKey(ip))
+	}
+
+	return keys
+}
+
+// throttleEmailRequest counts the request against the email and the source
+// address and rejects it once either one used up its requests for the
+// window. The count is kept for unknown emails as well.
+func (service *UserService) throttleEmailRequest(purpose string, config emailRequestThrottle, email string, ip string, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "throttleEmailRequestService")
+	defer span.Finish()
+
+	keys := emailRequestThrottleKeys(purpose, email, ip)
+	now := time.Now()
+	retryAfter := time.Duration(0)
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	for _, key := range keys {
+		loginThrottle := service.Repo.FindLoginThrottle(key, ctx)
+		if loginThrottle.LockedUntil != nil && loginThrottle.LockedUntil.After(now) {
+			retryAfter = maxDuration(retryAfter, loginThrottle.LockedUntil.Sub(now))
+		}
+	}
+
+	if retryAfter > 0 {
+		metrics.LoginThrottled(purpose)
+		err := &TooManyAttemptsError{RetryAfter: retryAfter}
+		tracer.LogError(span, err)
+		return err
+	}
+
+	for _, key := range keys {
+		loginThrottle, err := service.Repo.RecordLoginFailure(key, config.window, ctx)
+		if err != nil {
+			tracer.LogError(span, err)
+			continue
+		}
+
+		scope, limit := "account", config.emailLimit
+		if strings.HasPrefix(key, purpose+":ip:") {
+			scope, limit = "ip", config.ipLimit
+		}
+
+		if loginThrottle.Failures >= limit {
+			metrics.LoginLockedOut(scope)
+			service.Repo.LockLoginThrottle(key, now.Add(config.window), ctx)
+		}
+	}
+
+	return nil
+}
+
+func maxDuration(a time.Duration, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+
+	return b
+}
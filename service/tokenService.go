@@ -0,0 +1,263 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+	"github.com/windbnb/user-service/util"
+)
+
+func accessTokenTTL() time.Duration {
+	return util.DurationFromEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
+}
+
+func refreshTokenTTL() time.Duration {
+	return util.DurationFromEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+}
+
+// issueTokens signs a short lived access token for the session and stores a
+// new refresh token in the given family. An empty familyId starts a new family.
+func (service *UserService) issueTokens(user model.User, session model.Session, familyId string, ctx context.Context) (model.LoginResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "issueTokensService")
+	defer span.Finish()
+
+	tokenString, err := service.signAccessToken(user, session, session.CreatedAt, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, errors.New("error while signing token")
+	}
+
+	refreshToken, err := util.GenerateOpaqueToken()
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, errors.New("error while generating refresh token")
+	}
+
+	now := time.Now()
+	if familyId == "" {
+		familyId, err = util.GenerateOpaqueToken()
+		if err != nil {
+			tracer.LogError(span, err)
+			return model.LoginResponse{}, errors.New("error while generating refresh token")
+		}
+	}
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	_, err = service.Repo.CreateRefreshToken(model.RefreshToken{
+		UserId:    user.ID,
+		SessionId: session.ID,
+		FamilyId:  familyId,
+		TokenHash: util.HashToken(refreshToken),
+		ExpiresAt: now.Add(refreshTokenTTL()),
+	}, ctx)
+
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, errors.New("error while saving refresh token")
+	}
+
+	return model.LoginResponse{Status: model.LOGIN_SUCCESS, Token: tokenString, RefreshToken: refreshToken, ExpiresIn: int64(accessTokenTTL().Seconds())}, nil
+}
+
+// signAccessToken signs an access token for the session, authTime is when
+// the user last entered their credentials. Tokens are issued for the active
+// role of the session. Tokens of OAuth clients carry the granted scopes,
+// first party tokens the permissions of the role.
+func (service *UserService) signAccessToken(user model.User, session model.Session, authTime time.Time, ctx context.Context) (string, error) {
+	jti, err := util.GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	role := activeRole(user, session)
+	scope := session.Scope
+	if session.ClientId == "" {
+		scope = service.rolePermissions(role, ctx)
+	}
+
+	now := time.Now()
+	claims := model.Claims{Email: user.Email, Role: role, Id: user.ID, TokenVersion: user.TokenVersion, SessionId: session.ID, EmailVerified: user.Verified,
+		ClientId: session.ClientId, Scope: scope, AuthTime: authTime.Unix(),
+		StandardClaims: jwt.StandardClaims{Id: jti, ExpiresAt: now.Add(accessTokenTTL()).Unix(), IssuedAt: now.Unix(), Issuer: Issuer()}}
+
+	return service.keyRing().Sign(&claims)
+}
+
+// parseToken verifies an access token. Purpose tokens, such as MFA
+// challenges, are not accepted as access tokens.
+func (service *UserService) parseToken(tokenString string, ctx context.Context) (*model.Claims, error) {
+	return service.parsePurposeToken(tokenString, "", ctx)
+}
+
+// signPurposeToken signs a short lived, single purpose token for the user.
+func (service *UserService) signPurposeToken(user model.User, purpose string, ttl time.Duration) (string, error) {
+	jti, err := util.GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := model.Claims{Email: user.Email, Role: user.Role, Id: user.ID, TokenVersion: user.TokenVersion, Purpose: purpose,
+		StandardClaims: jwt.StandardClaims{Id: jti, ExpiresAt: now.Add(ttl).Unix(), IssuedAt: now.Unix(), Issuer: Issuer()}}
+
+	return service.keyRing().Sign(&claims)
+}
+
+// parsePurposeToken verifies the signature, expiry and issuer of a token,
+// checks that it was not revoked and that it was issued for the purpose.
+func (service *UserService) parsePurposeToken(tokenString string, purpose string, ctx context.Context) (*model.Claims, error) {
+	span := tracer.StartSpanFromContext(ctx, "parseTokenService")
+	defer span.Finish()
+
+	claims := model.Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, &claims, service.keyRing().Keyfunc)
+
+	if err != nil || !token.Valid {
+		tracer.LogError(span, err)
+		return nil, errors.New("invalid token")
+	}
+
+	if !claims.VerifyIssuer(Issuer(), true) {
+		err := errors.New("token was issued by another issuer")
+		tracer.LogError(span, err)
+		return nil, err
+	}
+
+	if claims.StandardClaims.Id == "" {
+		err := errors.New("token has no jti")
+		tracer.LogError(span, err)
+		return nil, err
+	}
+
+	if claims.Purpose != purpose {
+		err := errors.New("token was issued for another purpose")
+		tracer.LogError(span, err)
+		return nil, err
+	}
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	revoked, err := service.revocationStore().IsRevoked(claims.StandardClaims.Id, ctx)
+	if err != nil || revoked {
+		err := errors.New("token has been revoked")
+		tracer.LogError(span, err)
+		return nil, err
+	}
+
+	return &claims, nil
+}
+
+// Logout revokes the access token until it expires together with its
+// session, which also revokes the refresh tokens issued within it.
+func (service *UserService) Logout(tokenString string, refreshToken string, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "logoutService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	claims, err := service.parseToken(tokenString, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return err
+	}
+
+	err = service.revocationStore().Revoke(claims.StandardClaims.Id, time.Unix(claims.ExpiresAt, 0), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while revoking token")
+	}
+
+	err = service.Repo.RevokeSession(claims.SessionId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while revoking session")
+	}
+
+	if refreshToken == "" {
+		return nil
+	}
+
+	storedToken, err := service.Repo.FindRefreshTokenByHash(util.HashToken(refreshToken), ctx)
+	if err != nil || storedToken.UserId != claims.Id {
+		return nil
+	}
+
+	err = service.Repo.RevokeRefreshTokenFamily(storedToken.FamilyId, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while revoking refresh token")
+	}
+
+	return nil
+}
+
+// RefreshToken exchanges a refresh token for a new access and refresh token
+// pair. Presenting a token that was already rotated means it leaked, so the
+// whole family is revoked and its holder has to log in again.
+func (service *UserService) RefreshToken(refreshToken string, ctx context.Context) (model.LoginResponse, error) {
+	return service.refreshTokenForClient(refreshToken, "", ctx)
+}
+
+// refreshTokenForClient only rotates refresh tokens of sessions that belong to
+// the client, first party sessions have no client id.
+func (service *UserService) refreshTokenForClient(refreshToken string, clientId string, ctx context.Context) (model.LoginResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "refreshTokenService")
+	defer span.Finish()
+
+	invalidTokenErr := errors.New("invalid refresh token")
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	storedToken, err := service.Repo.FindRefreshTokenByHash(util.HashToken(refreshToken), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, invalidTokenErr
+	}
+
+	if storedToken.RevokedAt != nil || time.Now().After(storedToken.ExpiresAt) {
+		tracer.LogError(span, invalidTokenErr)
+		return model.LoginResponse{}, invalidTokenErr
+	}
+
+	session, err := service.Repo.FindSessionById(storedToken.SessionId, ctx)
+	if err != nil || session.ClientId != clientId {
+		tracer.LogError(span, invalidTokenErr)
+		return model.LoginResponse{}, invalidTokenErr
+	}
+
+	rotated, err := service.Repo.MarkRefreshTokenRotated(storedToken.ID, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.LoginResponse{}, invalidTokenErr
+	}
+
+	if !rotated {
+		err := errors.New("refresh token reuse detected")
+		tracer.LogError(span, err)
+		service.Repo.RevokeRefreshTokenFamily(storedToken.FamilyId, ctx)
+		service.Repo.RevokeSession(storedToken.SessionId, ctx)
+		return model.LoginResponse{}, invalidTokenErr
+	}
+
+	if session.RevokedAt != nil {
+		tracer.LogError(span, invalidTokenErr)
+		return model.LoginResponse{}, invalidTokenErr
+	}
+	service.Repo.TouchSession(session.ID, time.Now(), ctx)
+
+	user, err := service.Repo.FindUserById(uint64(storedToken.UserId), ctx)
+	if err == nil && user.Suspended {
+		err = errors.New("account is suspended")
+	}
+	if err == nil && passwordExpired(user) {
+		err = errors.New("password has expired")
+	}
+	if err != nil {
+		tracer.LogError(span, err)
+		service.Repo.RevokeRefreshTokenFamily(storedToken.FamilyId, ctx)
+		return model.LoginResponse{}, invalidTokenErr
+	}
+
+	return service.issueTokens(user, session, storedToken.FamilyId, ctx)
+}
@@ -0,0 +1,239 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+)
+
+const (
+	defaultUserPageSize = 20
+	maxUserPageSize     = 100
+	// minUserSearchLength is the shortest search the trigram indexes serve.
+	minUserSearchLength = 3
+	maxUserSearchLength = 100
+)
+
+// userSortFields maps the sort parameter to the column it sorts by, a
+// leading "-" sorts descending.
+var userSortFields = map[string]string{
+	"createdAt": "created_at",
+	"email":     "email",
+	"username":  "username",
+}
+
+// parseUserListDate accepts a timestamp or a day. A day given as createdTo
+// includes the whole day, createdTo is exclusive otherwise.
+func parseUserListDate(value string, endOfDay bool) (time.Time, error) {
+	if timestamp, err := time.Parse(time.RFC3339, value); err == nil {
+		return timestamp, nil
+	}
+
+	day, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if endOfDay {
+		return day.AddDate(0, 0, 1), nil
+	}
+
+	return day, nil
+}
+
+// optionalBool parses a filter that does not filter when it is empty.
+func optionalBool(value string) (*bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &parsed, nil
+}
+
+func encodeUserCursor(cursor model.UserCursor) string {
+	encoded, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeUserCursor(value string) (model.UserCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return model.UserCursor{}, err
+	}
+
+	var cursor model.UserCursor
+	if err := json.Unmarshal(decoded, &cursor); err != nil || cursor.Id == 0 {
+		return model.UserCursor{}, errors.New("invalid cursor")
+	}
+
+	return cursor, nil
+}
+
+// userCursorValue is the value of the sort column of the user, as it is put
+// into cursors.
+func userCursorValue(user model.User, sortField string) string {
+	switch sortField {
+	case "email":
+		return user.Email
+	case "username":
+		return user.Username
+	default:
+		return user.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
+}
+
+// userQuery turns the query parameters of the listing into a query, every
+// invalid parameter is reported.
+func (service *UserService) userQuery(request model.UserListRequest, ctx context.Context) (model.UserQuery, string, error) {
+	span := tracer.StartSpanFromContext(ctx, "userQueryService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	query := model.UserQuery{Limit: defaultUserPageSize}
+	fieldErrors := []model.FieldError{}
+	invalid := func(field string, message string) {
+		fieldErrors = append(fieldErrors, model.FieldError{Field: field, Code: "invalid", Message: message})
+	}
+
+	if request.Role != "" {
+		if _, err := service.Repo.FindRole(model.UserRole(request.Role), ctx); err != nil {
+			invalid("role", "role does not exist")
+		}
+		query.Role = model.UserRole(request.Role)
+	}
+
+	if request.CreatedFrom != "" {
+		createdFrom, err := parseUserListDate(request.CreatedFrom, false)
+		if err != nil {
+			invalid("createdFrom", "createdFrom must be a date or an RFC 3339 timestamp")
+		}
+		query.CreatedFrom = &createdFrom
+	}
+
+	if request.CreatedTo != "" {
+		createdTo, err := parseUserListDate(request.CreatedTo, true)
+		if err != nil {
+			invalid("createdTo", "createdTo must be a date or an RFC 3339 timestamp")
+		}
+		query.CreatedTo = &createdTo
+	}
+
+	verified, err := optionalBool(request.Verified)
+	if err != nil {
+		invalid("verified", "verified must be true or false")
+	}
+	query.Verified = verified
+
+	suspended, err := optionalBool(request.Suspended)
+	if err != nil {
+		invalid("suspended", "suspended must be true or false")
+	}
+	query.Suspended = suspended
+
+	query.Search = strings.TrimSpace(request.Search)
+	if query.Search != "" && (len([]rune(query.Search)) < minUserSearchLength || len([]rune(query.Search)) > maxUserSearchLength) {
+		invalid("q", "search must be between 3 and 100 characters")
+	}
+
+	sort := request.Sort
+	if sort == "" {
+		sort = "-createdAt"
+	}
+	sortField, sortFound := userSortFields[strings.TrimPrefix(sort, "-")]
+	if !sortFound {
+		invalid("sort", "sort must be createdAt, email or username, with a leading - for descending")
+	}
+	query.SortField = sortField
+	query.Descending = strings.HasPrefix(sort, "-")
+
+	if request.Limit != "" {
+		limit, err := strconv.Atoi(request.Limit)
+		if err != nil || limit < 1 || limit > maxUserPageSize {
+			invalid("limit", "limit must be between 1 and 100")
+		}
+		query.Limit = limit
+	}
+
+	if request.Cursor != "" {
+		cursor, err := decodeUserCursor(request.Cursor)
+		if err != nil || cursor.Sort != sort {
+			invalid("cursor", "cursor is invalid or belongs to another sort")
+		} else {
+			query.AfterId, query.AfterValue = cursor.Id, cursor.Value
+			if sortField == "created_at" {
+				createdAt, err := time.Parse(time.RFC3339Nano, cursor.Value)
+				if err != nil {
+					invalid("cursor", "cursor is invalid or belongs to another sort")
+				}
+				query.AfterValue = createdAt
+			}
+		}
+	}
+
+	if len(fieldErrors) > 0 {
+		err := &ValidationError{Message: "invalid user query", Errors: fieldErrors}
+		tracer.LogError(span, err)
+		return model.UserQuery{}, "", err
+	}
+
+	return query, sort, nil
+}
+
+// ListUsers is the admin user listing. It pages with an opaque cursor, the
+// position after the last user of the page, so that pages stay stable while
+// users register.
+func (service *UserService) ListUsers(request model.UserListRequest, ctx context.Context) (model.UserListResponse, error) {
+	span := tracer.StartSpanFromContext(ctx, "listUsersService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	query, sort, err := service.userQuery(request, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.UserListResponse{}, err
+	}
+
+	pageSize := query.Limit
+	query.Limit = pageSize + 1
+
+	users, err := service.Repo.FindUsers(query, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return model.UserListResponse{}, errors.New("error while listing users")
+	}
+
+	response := model.UserListResponse{Users: []model.AdminUserDTO{}}
+	if len(users) > pageSize {
+		users = users[:pageSize]
+		last := users[pageSize-1]
+		response.NextCursor = encodeUserCursor(model.UserCursor{Sort: sort, Value: userCursorValue(last, query.SortField), Id: last.ID})
+	}
+
+	userIds := []uint{}
+	for _, user := range users {
+		userIds = append(userIds, user.ID)
+	}
+	roles := service.Repo.FindRolesOfUsers(userIds, ctx)
+
+	for _, user := range users {
+		userRoles := roles[user.ID]
+		if !hasRole(userRoles, user.Role) {
+			userRoles = append(userRoles, user.Role)
+		}
+		response.Users = append(response.Users, model.AdminUserDTO{AccountDTO: user.ToAccountDTO(), Roles: userRoles, CreatedAt: user.CreatedAt})
+	}
+
+	return response, nil
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/windbnb/user-service/mailer"
+	"github.com/windbnb/user-service/model"
+	"github.com/windbnb/user-service/tracer"
+	"github.com/windbnb/user-service/util"
+)
+
+const emailVerificationPurpose = "email_verification"
+
+var ErrEmailNotVerified = errors.New("email address is not verified")
+
+// UnverifiedPolicy decides what an account may do before its email address
+// is verified.
+type UnverifiedPolicy string
+
+const (
+	// UNVERIFIED_ALLOW treats unverified accounts like verified ones.
+	UNVERIFIED_ALLOW UnverifiedPolicy = "allow"
+	// UNVERIFIED_RESTRICTED lets users log in and browse, but the authorise
+	// endpoints other services call before guests request reservations or
+	// hosts list accommodation refuse them.
+	UNVERIFIED_RESTRICTED UnverifiedPolicy = "restricted"
+	// UNVERIFIED_DENY refuses to log unverified users in at all.
+	UNVERIFIED_DENY UnverifiedPolicy = "deny"
+)
+
+func unverifiedPolicy() UnverifiedPolicy {
+	policy, policyFound := os.LookupEnv("UNVERIFIED_ACCOUNT_POLICY")
+	if !policyFound {
+		return UNVERIFIED_RESTRICTED
+	}
+
+	switch UnverifiedPolicy(strings.ToLower(policy)) {
+	case UNVERIFIED_ALLOW:
+		return UNVERIFIED_ALLOW
+	case UNVERIFIED_DENY:
+		return UNVERIFIED_DENY
+	default:
+		return UNVERIFIED_RESTRICTED
+	}
+}
+
+func emailVerificationTTL() time.Duration {
+	return util.DurationFromEnv("EMAIL_VERIFICATION_TTL", 24*time.Hour)
+}
+
+func verificationResendInterval() time.Duration {
+	return util.DurationFromEnv("VERIFICATION_RESEND_INTERVAL", 5*time.Minute)
+}
+
+func verificationResendThrottle() emailRequestThrottle {
+	return emailRequestThrottle{
+		emailLimit: util.IntFromEnv("VERIFICATION_RESEND_EMAIL_LIMIT", 5),
+		ipLimit:    util.IntFromEnv("VERIFICATION_RESEND_IP_LIMIT", 20),
+		window:     util.DurationFromEnv("VERIFICATION_RESEND_WINDOW", 15*time.Minute),
+	}
+}
+
+func emailVerificationURL(token string) string {
+	verificationURL, verificationURLFound := os.LookupEnv("EMAIL_VERIFICATION_URL")
+	if !verificationURLFound {
+		verificationURL = "http://localhost:3000/verify-email"
+	}
+
+	return verificationURL + "?token=" + url.QueryEscape(token)
+}
+
+// sendVerificationEmail mails a signed verification link, at most once per
+// resend interval. Calls inside the interval are silently dropped.
+func (service *UserService) sendVerificationEmail(user model.User, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "sendVerificationEmailService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	reserved, err := service.Repo.ReserveVerificationEmail(user.ID, time.Now().Add(-verificationResendInterval()), ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while sending verification email")
+	}
+
+	if !reserved {
+		return nil
+	}
+
+	ttl := emailVerificationTTL()
+	token, err := service.signPurposeToken(user, emailVerificationPurpose, ttl)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while sending verification email")
+	}
+
+	err = service.mailer().Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nplease confirm your email address by opening the link below, it expires in %s.\n\n%s\n",
+			user.Name, ttl, emailVerificationURL(token)),
+	})
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("error while sending verification email")
+	}
+
+	return nil
+}
+
+// VerifyEmail accepts a link only for the address it was sent to, so a link
+// mailed before an email change cannot verify the new address.
+func (service *UserService) VerifyEmail(token string, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "verifyEmailService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	claims, err := service.parsePurposeToken(token, emailVerificationPurpose, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("invalid or expired verification link")
+	}
+
+	err = service.Repo.MarkUserVerified(claims.Id, claims.Email, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+		return errors.New("invalid or expired verification link")
+	}
+
+	return nil
+}
+
+// ResendVerification answers the same way for unknown, verified and
+// unverified addresses. Like ForgotPassword only the throttle is checked
+// while the request waits, the account is looked up in the background.
+func (service *UserService) ResendVerification(email string, clientInfo model.ClientInfo, ctx context.Context) error {
+	span := tracer.StartSpanFromContext(ctx, "resendVerificationService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	err := service.throttleEmailRequest(emailVerificationPurpose, verificationResendThrottle(), email, clientInfo.IP, ctx)
+	if err != nil {
+		return err
+	}
+
+	go service.resendVerificationEmail(email, ctx)
+
+	return nil
+}
+
+// resendVerificationEmail mails a new link to unverified accounts. Failures
+// are only traced, nobody waits for them.
+func (service *UserService) resendVerificationEmail(email string, ctx context.Context) {
+	span := tracer.StartSpanFromContext(ctx, "resendVerificationEmailService")
+	defer span.Finish()
+
+	ctx = tracer.ContextWithSpan(context.Background(), span)
+	user, err := service.Repo.FindUserByEmail(email, ctx)
+	if err != nil || user.Verified || user.Suspended {
+		return
+	}
+
+	err = service.sendVerificationEmail(user, ctx)
+	if err != nil {
+		tracer.LogError(span, err)
+	}
+}
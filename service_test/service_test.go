@@ -2,13 +2,33 @@ package service_test
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
+	"github.com/jinzhu/gorm"
 	"github.com/stretchr/testify/assert"
+	"github.com/windbnb/user-service/mailer"
 	"github.com/windbnb/user-service/model"
 	"github.com/windbnb/user-service/repository"
 	"github.com/windbnb/user-service/service"
+	"github.com/windbnb/user-service/sms"
 	"github.com/windbnb/user-service/util"
 )
 
@@ -22,7 +42,7 @@ func TestLogin_ValidCredentials_Integration(t *testing.T) {
 		Password: "host",
 	}
 
-	token, err := userService.Login(credentials, context.Background())
+	token, err := userService.Login(credentials, model.ClientInfo{}, context.Background())
 
 	assert.NotEmpty(t, token)
 	assert.NoError(t, err)
@@ -38,56 +58,1280 @@ func TestLogin_InvalidCredentials_Integration(t *testing.T) {
 		Password: "wrong_password",
 	}
 
-	token, err := userService.Login(credentials, context.Background())
+	token, err := userService.Login(credentials, model.ClientInfo{}, context.Background())
 
 	assert.Empty(t, token)
 	assert.EqualError(t, err, "bad credentials")
 }
 
 func TestLogin_SuccessfulLogin(t *testing.T) {
+	mockRepo := &MockRepo{}
+	mockRepo.addPasswordUser(model.User{
+		Email: "test@example.com",
+		Password: "password",
+		Role:  model.HOST,
+	})
+
+	userService := service.UserService{
+		Repo: mockRepo,
+	}
+
+	credentials := model.Credentials{
+		Email:    "test@example.com",
+		Password: "password",
+	}
+	token, err := userService.Login(credentials, model.ClientInfo{}, context.Background())
+
+	assert.NotEmpty(t, token)
+	assert.NoError(t, err)
+}
+
+func TestLogin_InvalidCredentials(t *testing.T) {
+	mockRepo := &MockRepo{}
+
+	userService := service.UserService{
+		Repo: mockRepo,
+	}
+
+	credentials := model.Credentials{
+		Email:    "test@example.com",
+		Password: "password",
+	}
+	token, err := userService.Login(credentials, model.ClientInfo{}, context.Background())
+
+	assert.Empty(t, token)
+	assert.EqualError(t, err, "bad credentials")
+}
+
+func TestLogin_WrongPassword(t *testing.T) {
+	hash, _ := util.NewArgon2idHasher().Hash("password")
+	mockRepo := &MockRepo{}
+	mockRepo.addPasswordUser(model.User{Email: "test@example.com", Password: hash, Role: model.GUEST, Verified: true})
+
+	userService := service.UserService{
+		Repo: mockRepo,
+	}
+
+	credentials := model.Credentials{
+		Email:    "test@example.com",
+		Password: "wrong_password",
+	}
+	token, err := userService.Login(credentials, model.ClientInfo{}, context.Background())
+
+	assert.Empty(t, token)
+	assert.EqualError(t, err, "bad credentials")
+}
+
+func TestLogin_RehashesLegacyPlaintextPassword(t *testing.T) {
+	var savedUser model.User
+	mockRepo := &MockRepo{
+		UpdateUserFn: func(user model.User, ctx context.Context) (model.User, error) {
+			savedUser = user
+			return user, nil
+		},
+	}
+	mockRepo.addPasswordUser(model.User{Email: "test@example.com", Password: "password", Role: model.GUEST, Verified: true})
+
+	userService := service.UserService{
+		Repo: mockRepo,
+	}
+
+	credentials := model.Credentials{
+		Email:    "test@example.com",
+		Password: "password",
+	}
+	token, err := userService.Login(credentials, model.ClientInfo{}, context.Background())
+
+	assert.NotEmpty(t, token)
+	assert.NoError(t, err)
+	assert.Equal(t, util.Argon2idAlgorithm, util.HashAlgorithm(savedUser.Password))
+	valid, needsRehash := util.VerifyPassword(util.NewArgon2idHasher(), "password", savedUser.Password)
+	assert.True(t, valid)
+	assert.False(t, needsRehash)
+}
+
+func TestLogin_RehashesBcryptPasswordToArgon2id(t *testing.T) {
+	hash, _ := (&util.BcryptHasher{Cost: 4}).Hash("password")
+	var savedUser model.User
+	mockRepo := &MockRepo{
+		UpdateUserFn: func(user model.User, ctx context.Context) (model.User, error) {
+			savedUser = user
+			return user, nil
+		},
+	}
+	mockRepo.addPasswordUser(model.User{Email: "test@example.com", Password: hash, Role: model.HOST, Verified: true})
+
+	userService := service.UserService{
+		Repo:   mockRepo,
+		Hasher: util.NewArgon2idHasher(),
+	}
+
+	credentials := model.Credentials{
+		Email:    "test@example.com",
+		Password: "password",
+	}
+	token, err := userService.Login(credentials, model.ClientInfo{}, context.Background())
+
+	assert.NotEmpty(t, token)
+	assert.NoError(t, err)
+	assert.Equal(t, util.Argon2idAlgorithm, util.HashAlgorithm(savedUser.Password))
+}
+
+func TestAuthenticateUser_KeyRotationAndRetirement(t *testing.T) {
+	t.Setenv("JWT_KEY_RING_PATH", filepath.Join(t.TempDir(), "keyring.json"))
+	t.Setenv("JWT_SIGNING_ALGORITHM", "ES256")
+	keyRing, err := service.LoadKeyRing()
+	assert.NoError(t, err)
+
+	hash, _ := util.NewArgon2idHasher().Hash("password")
+	mockRepo := &MockRepo{}
+	mockRepo.addPasswordUser(model.User{Email: "test@example.com", Password: hash, Role: model.GUEST, Verified: true})
+	userService := service.UserService{Repo: mockRepo, Keys: keyRing}
+
+	credentials := model.Credentials{Email: "test@example.com", Password: "password"}
+	oldToken, err := userService.Login(credentials, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+	oldKid := keyRing.Current()
+
+	_, err = userService.RotateSigningKey("EdDSA", context.Background())
+	assert.NoError(t, err)
+	newToken, err := userService.Login(credentials, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+
+	reloadedKeyRing, err := service.LoadKeyRing()
+	assert.NoError(t, err)
+	reloadedService := service.UserService{Repo: mockRepo, Keys: reloadedKeyRing}
+
+	_, err = reloadedService.AuthenticateUser(oldToken.Token, model.GUEST, true, context.Background())
+	assert.NoError(t, err)
+	_, err = reloadedService.AuthenticateUser(newToken.Token, model.GUEST, true, context.Background())
+	assert.NoError(t, err)
+
+	assert.NoError(t, userService.RetireSigningKey(oldKid, context.Background()))
+	_, err = userService.AuthenticateUser(oldToken.Token, model.GUEST, true, context.Background())
+	assert.Error(t, err)
+	_, err = userService.AuthenticateUser(newToken.Token, model.GUEST, true, context.Background())
+	assert.NoError(t, err)
+}
+
+func TestKeyRing_ReplicasMergeSharedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	t.Setenv("JWT_KEY_RING_PATH", path)
+	first, err := service.LoadKeyRing()
+	assert.NoError(t, err)
+	second, err := service.LoadKeyRing()
+	assert.NoError(t, err)
+	initialKid := first.Current()
+
+	firstKey, err := first.Rotate("ES256")
+	assert.NoError(t, err)
+	secondKey, err := second.Rotate("EdDSA")
+	assert.NoError(t, err)
+	assert.NoError(t, first.Retire(initialKid))
+
+	reloaded, err := service.LoadKeyRing()
+	assert.NoError(t, err)
+	assert.Equal(t, secondKey.Kid, reloaded.Current())
+	statuses := map[string]service.KeyStatus{}
+	for _, key := range reloaded.Keys() {
+		statuses[key.Kid] = key.Status
+	}
+	assert.Equal(t, map[string]service.KeyStatus{initialKid: service.KeyRetired, firstKey.Kid: service.KeyActive,
+		secondKey.Kid: service.KeyActive}, statuses)
+}
+
+func TestJWKS_VerifiesTokenOffline(t *testing.T) {
+	keyRing, err := service.NewInMemoryKeyRing("RS256")
+	assert.NoError(t, err)
+
+	hash, _ := util.NewArgon2idHasher().Hash("password")
+	mockRepo := &MockRepo{}
+	mockRepo.addPasswordUser(model.User{Email: "test@example.com", Password: hash, Role: model.HOST, Verified: true})
+	userService := service.UserService{Repo: mockRepo, Keys: keyRing}
+
+	loginResponse, err := userService.Login(model.Credentials{Email: "test@example.com", Password: "password"}, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+	tokenString := loginResponse.Token
+
+	jwks := userService.JWKS(context.Background())
+	assert.Len(t, jwks.Keys, 1)
+
+	claims := model.Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		for _, jwk := range jwks.Keys {
+			if jwk.Kid == token.Header["kid"] {
+				n, _ := base64.RawURLEncoding.DecodeString(jwk.N)
+				e, _ := base64.RawURLEncoding.DecodeString(jwk.E)
+				return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+			}
+		}
+		return nil, errors.New("unknown kid")
+	})
+
+	assert.NoError(t, err)
+	assert.True(t, token.Valid)
+	assert.Equal(t, model.HOST, claims.Role)
+	assert.Equal(t, service.Issuer(), claims.Issuer)
+}
+
+func TestRefreshToken_RotatesAndDetectsReuse(t *testing.T) {
+	hash, _ := util.NewArgon2idHasher().Hash("password")
+	mockRepo := &MockRepo{}
+	mockRepo.addPasswordUser(model.User{Email: "test@example.com", Password: hash, Role: model.GUEST, Verified: true})
+	userService := service.UserService{Repo: mockRepo}
+
+	loginResponse, err := userService.Login(model.Credentials{Email: "test@example.com", Password: "password"}, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+	assert.NotEmpty(t, loginResponse.RefreshToken)
+
+	refreshed, err := userService.RefreshToken(loginResponse.RefreshToken, context.Background())
+	assert.NoError(t, err)
+	assert.NotEmpty(t, refreshed.Token)
+	assert.NotEqual(t, loginResponse.RefreshToken, refreshed.RefreshToken)
+
+	_, err = userService.RefreshToken(loginResponse.RefreshToken, context.Background())
+	assert.EqualError(t, err, "invalid refresh token")
+
+	_, err = userService.RefreshToken(refreshed.RefreshToken, context.Background())
+	assert.EqualError(t, err, "invalid refresh token")
+}
+
+func TestLogout_RevokesAccessAndRefreshToken(t *testing.T) {
+	hash, _ := util.NewArgon2idHasher().Hash("password")
+	mockRepo := &MockRepo{}
+	mockRepo.addPasswordUser(model.User{Email: "test@example.com", Password: hash, Role: model.GUEST, Verified: true})
+	userService := service.UserService{Repo: mockRepo}
+
+	loginResponse, err := userService.Login(model.Credentials{Email: "test@example.com", Password: "password"}, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+
+	_, err = userService.AuthenticateUser(loginResponse.Token, model.GUEST, true, context.Background())
+	assert.NoError(t, err)
+
+	err = userService.Logout(loginResponse.Token, loginResponse.RefreshToken, context.Background())
+	assert.NoError(t, err)
+
+	_, err = userService.AuthenticateUser(loginResponse.Token, model.GUEST, true, context.Background())
+	assert.EqualError(t, err, "token has been revoked")
+
+	otherReplica := service.UserService{Repo: mockRepo}
+	_, err = otherReplica.AuthenticateUser(loginResponse.Token, model.GUEST, true, context.Background())
+	assert.EqualError(t, err, "token has been revoked")
+
+	_, err = userService.RefreshToken(loginResponse.RefreshToken, context.Background())
+	assert.EqualError(t, err, "invalid refresh token")
+}
+
+func TestLogoutEverywhere_InvalidatesIssuedTokens(t *testing.T) {
+	hash, _ := util.NewArgon2idHasher().Hash("password")
+	user := model.User{Email: "test@example.com", Password: hash, Role: model.GUEST, Verified: true}
+	user.ID = 1
+	mockRepo := &MockRepo{}
+	mockRepo.addPasswordUser(user)
+	userService := service.UserService{Repo: mockRepo}
+
+	loginResponse, err := userService.Login(model.Credentials{Email: "test@example.com", Password: "password"}, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+
+	err = userService.LogoutEverywhere(1, context.Background())
+	assert.NoError(t, err)
+
+	_, err = userService.AuthenticateUser(loginResponse.Token, model.GUEST, true, context.Background())
+	assert.EqualError(t, err, "token is no longer valid")
+
+	_, err = userService.RefreshToken(loginResponse.RefreshToken, context.Background())
+	assert.EqualError(t, err, "invalid refresh token")
+}
+
+func TestSessions_ListAndRevoke(t *testing.T) {
+	hash, _ := util.NewArgon2idHasher().Hash("password")
+	mockRepo := &MockRepo{}
+	mockRepo.addPasswordUser(model.User{Email: "test@example.com", Password: hash, Role: model.GUEST, Verified: true})
+	userService := service.UserService{Repo: mockRepo}
+	credentials := model.Credentials{Email: "test@example.com", Password: "password"}
+
+	phone, err := userService.Login(credentials, model.ClientInfo{Device: "Safari on iPhone", IP: "10.0.0.1"}, context.Background())
+	assert.NoError(t, err)
+	laptop, err := userService.Login(credentials, model.ClientInfo{Device: "Firefox on Linux", IP: "10.0.0.2"}, context.Background())
+	assert.NoError(t, err)
+
+	sessions, err := userService.ListSessions(0, laptop.Token, context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 2)
+	assert.False(t, sessions[0].Current)
+	assert.Equal(t, "Safari on iPhone", sessions[0].Device)
+	assert.True(t, sessions[1].Current)
+
+	err = userService.RevokeSession(0, uint64(sessions[0].Id), context.Background())
+	assert.NoError(t, err)
+
+	_, err = userService.AuthenticateUser(phone.Token, model.GUEST, true, context.Background())
+	assert.EqualError(t, err, "session has been revoked")
+	_, err = userService.RefreshToken(phone.RefreshToken, context.Background())
+	assert.EqualError(t, err, "invalid refresh token")
+	_, err = userService.AuthenticateUser(laptop.Token, model.GUEST, true, context.Background())
+	assert.NoError(t, err)
+}
+
+func TestLogin_TwoFactorChallenge(t *testing.T) {
+	hash, _ := util.NewArgon2idHasher().Hash("password")
+	mockRepo := &MockRepo{}
+	mockRepo.addPasswordUser(model.User{Email: "test@example.com", Password: hash, Role: model.HOST})
+	userService := service.UserService{Repo: mockRepo}
+	credentials := model.Credentials{Email: "test@example.com", Password: "password"}
+
+	enrollment, err := userService.EnrollTotp(0, context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, enrollment.RecoveryCodes, 10)
+	assert.Contains(t, enrollment.OtpauthURI, "otpauth://totp/")
+
+	loginResponse, err := userService.Login(credentials, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, model.LOGIN_SUCCESS, loginResponse.Status)
+
+	code, _ := util.TotpCode(enrollment.Secret, time.Now().Unix()/util.TotpPeriod)
+	assert.NoError(t, userService.ConfirmTotp(0, code, model.ClientInfo{}, context.Background()))
+
+	loginResponse, err = userService.Login(credentials, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, model.LOGIN_MFA_REQUIRED, loginResponse.Status)
+	assert.Empty(t, loginResponse.Token)
+
+	_, err = userService.AuthenticateUser(loginResponse.ChallengeToken, model.HOST, true, context.Background())
+	assert.Error(t, err)
+
+	_, err = userService.CompleteMfaLogin(loginResponse.ChallengeToken, code, model.ClientInfo{}, context.Background())
+	assert.EqualError(t, err, "invalid verification code")
+
+	_, err = userService.CompleteMfaLogin(loginResponse.ChallengeToken, enrollment.RecoveryCodes[0], model.ClientInfo{}, context.Background())
+	assert.EqualError(t, err, "invalid or expired challenge")
+
+	loginResponse, _ = userService.Login(credentials, model.ClientInfo{}, context.Background())
+	completed, err := userService.CompleteMfaLogin(loginResponse.ChallengeToken, enrollment.RecoveryCodes[0], model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+	assert.NotEmpty(t, completed.Token)
+
+	loginResponse, _ = userService.Login(credentials, model.ClientInfo{}, context.Background())
+	_, err = userService.CompleteMfaLogin(loginResponse.ChallengeToken, enrollment.RecoveryCodes[0], model.ClientInfo{}, context.Background())
+	assert.EqualError(t, err, "invalid verification code")
+
+	for i := 0; i < 2; i++ {
+		assert.EqualError(t, userService.DisableTotp(0, enrollment.RecoveryCodes[0], model.ClientInfo{}, context.Background()), "invalid verification code")
+	}
+	var tooManyAttempts *service.TooManyAttemptsError
+	assert.ErrorAs(t, userService.DisableTotp(0, enrollment.RecoveryCodes[1], model.ClientInfo{}, context.Background()), &tooManyAttempts)
+}
+
+func TestLogin_BackoffAfterRepeatedFailures(t *testing.T) {
+	mockRepo := &MockRepo{}
+	userService := service.UserService{Repo: mockRepo}
+	credentials := model.Credentials{Email: "nobody@example.com", Password: "password"}
+	clientInfo := model.ClientInfo{IP: "10.0.0.1"}
+
+	for i := 0; i < 3; i++ {
+		_, err := userService.Login(credentials, clientInfo, context.Background())
+		assert.EqualError(t, err, "bad credentials")
+	}
+
+	_, err := userService.Login(credentials, clientInfo, context.Background())
+	var tooManyAttempts *service.TooManyAttemptsError
+	assert.True(t, errors.As(err, &tooManyAttempts))
+	assert.InDelta(t, time.Second, tooManyAttempts.RetryAfter, float64(100*time.Millisecond))
+}
+
+func TestLogin_LockoutAndAdminUnlock(t *testing.T) {
+	t.Setenv("LOGIN_BACKOFF_AFTER", "100")
+	user := model.User{Email: "test@example.com", Password: "password", Role: model.HOST}
+	user.ID = 1
+	mockRepo := &MockRepo{}
+	mockRepo.addPasswordUser(user)
+	userService := service.UserService{Repo: mockRepo}
+
+	for i := 0; i < 5; i++ {
+		_, err := userService.Login(model.Credentials{Email: "test@example.com", Password: "wrong"}, model.ClientInfo{}, context.Background())
+		assert.EqualError(t, err, "bad credentials")
+	}
+
+	_, err := userService.Login(model.Credentials{Email: "TEST@example.com", Password: "password"}, model.ClientInfo{}, context.Background())
+	var tooManyAttempts *service.TooManyAttemptsError
+	assert.True(t, errors.As(err, &tooManyAttempts))
+	assert.Greater(t, tooManyAttempts.RetryAfter, 14*time.Minute)
+
+	assert.NoError(t, userService.UnlockUser(1, context.Background()))
+
+	loginResponse, err := userService.Login(model.Credentials{Email: "test@example.com", Password: "password"}, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+	assert.NotEmpty(t, loginResponse.Token)
+}
+
+func TestPasswordReset_SingleUseTokenRevokesSessions(t *testing.T) {
+	t.Setenv("PASSWORD_RESET_EMAIL_LIMIT", "2")
+	t.Setenv("PASSWORD_RESET_IP_LIMIT", "3")
+	user := model.User{Email: "test@example.com", Password: "password", Role: model.HOST}
+	user.ID = 1
+	mockRepo := &MockRepo{}
+	mockRepo.addPasswordUser(user)
+	mockMailer := &MockMailer{}
+	userService := service.UserService{Repo: mockRepo, Mailer: mockMailer}
+
+	clientInfo := model.ClientInfo{IP: "198.51.100.7"}
+	assert.NoError(t, userService.ForgotPassword("unknown@example.com", clientInfo, context.Background()))
+
+	loginResponse, err := userService.Login(model.Credentials{Email: user.Email, Password: "password"}, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+
+	assert.NoError(t, userService.ForgotPassword(user.Email, clientInfo, context.Background()))
+	assert.Eventually(t, func() bool { return mockMailer.Sent() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Len(t, mockMailer.Messages, 1)
+	assert.Equal(t, user.Email, mockMailer.Messages[0].To)
+
+	link := regexp.MustCompile(`token=(\S+)`).FindStringSubmatch(mockMailer.Messages[0].Body)
+	assert.Len(t, link, 2)
+	token, _ := url.QueryUnescape(link[1])
+
+	assert.EqualError(t, userService.ResetPassword("wrong", "n3w-passw0rd", context.Background()), "invalid or expired reset token")
+	assert.EqualError(t, userService.ResetPassword(token, "short", context.Background()), "password does not meet the password policy")
+	assert.NoError(t, userService.ResetPassword(token, "n3w-passw0rd", context.Background()))
+	assert.EqualError(t, userService.ResetPassword(token, "0ther-passw0rd", context.Background()), "invalid or expired reset token")
+
+	_, err = userService.AuthenticateUser(loginResponse.Token, model.HOST, true, context.Background())
+	assert.Error(t, err)
+
+	_, err = userService.Login(model.Credentials{Email: user.Email, Password: "n3w-passw0rd"}, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+
+	var tooManyAttempts *service.TooManyAttemptsError
+	assert.NoError(t, userService.ForgotPassword(user.Email, clientInfo, context.Background()))
+	assert.ErrorAs(t, userService.ForgotPassword(user.Email, clientInfo, context.Background()), &tooManyAttempts)
+	assert.ErrorAs(t, userService.ForgotPassword("unknown@example.com", clientInfo, context.Background()), &tooManyAttempts)
+}
+
+func TestChangePassword_RequiresOldPassword(t *testing.T) {
+	mockRepo := &MockRepo{
+		FindUserByIdFn: func(id uint64, ctx context.Context) (model.User, error) {
+			return model.User{Email: "test@example.com", Password: "password"}, nil
+		},
+	}
+	userService := service.UserService{Repo: mockRepo}
+
+	err := userService.ChangePassword(model.ChangePasswordDTO{NewPassword: "new-password"}, 1, context.Background())
+
+	assert.EqualError(t, err, "old and new password are required")
+}
+
+func TestUpdateUser_WritesOnlyTheChangedColumns(t *testing.T) {
+	mockRepo := &MockRepo{
+		FindUserByIdFn: func(id uint64, ctx context.Context) (model.User, error) {
+			return model.User{Email: "test@example.com", TokenVersion: 1}, nil
+		},
+	}
+	userService := service.UserService{Repo: mockRepo}
+
+	_, err := userService.SuspendUser(1, true, context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"suspended"}}, mockRepo.UpdatedColumns)
+}
+
+func TestEmailVerification_PolicyAndResendLimit(t *testing.T) {
+	t.Setenv("UNVERIFIED_ACCOUNT_POLICY", "restricted")
+	hash, _ := util.NewArgon2idHasher().Hash("password")
+	user := model.User{Email: "test@example.com", Name: "Test", Password: hash, Role: model.GUEST}
+	user.ID = 1
 	mockRepo := &MockRepo{
-		CheckCredentialsFn: func(email, password string, ctx context.Context) (model.User, error) {
-			return model.User{
-				Email: "test@example.com",
-				Password: "password",
-				Role:  model.HOST,
-			}, nil
+		CreateUserFn: func(created model.User, ctx context.Context) (model.User, error) {
+			created.ID = 1
+			return created, nil
 		},
 	}
+	mockRepo.addPasswordUser(user)
+	mockMailer := &MockMailer{}
+	userService := service.UserService{Repo: mockRepo, Mailer: mockMailer}
+
+	_, err := userService.CreateUser(model.User{Email: "test@example.com", Name: "Test", Password: "s3cure-passw0rd", Address: "Bulevar oslobodjenja 1", Role: model.GUEST, Verified: true}, context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, mockMailer.Messages, 1)
+
+	t.Setenv("VERIFICATION_RESEND_EMAIL_LIMIT", "1")
+	clientInfo := model.ClientInfo{IP: "203.0.113.7"}
+	assert.NoError(t, userService.ResendVerification("test@example.com", clientInfo, context.Background()))
+	assert.Never(t, func() bool { return mockMailer.Sent() > 1 }, 200*time.Millisecond, 10*time.Millisecond)
+
+	var tooManyAttempts *service.TooManyAttemptsError
+	assert.ErrorAs(t, userService.ResendVerification("test@example.com", clientInfo, context.Background()), &tooManyAttempts)
+
+	loginResponse, err := userService.Login(model.Credentials{Email: "test@example.com", Password: "password"}, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+
+	_, err = userService.AuthenticateUser(loginResponse.Token, model.GUEST, true, context.Background())
+	assert.ErrorIs(t, err, service.ErrEmailNotVerified)
+
+	t.Setenv("UNVERIFIED_ACCOUNT_POLICY", "deny")
+	_, err = userService.Login(model.Credentials{Email: "test@example.com", Password: "password"}, model.ClientInfo{}, context.Background())
+	assert.ErrorIs(t, err, service.ErrEmailNotVerified)
+
+	link := regexp.MustCompile(`token=(\S+)`).FindStringSubmatch(mockMailer.Messages[0].Body)
+	assert.Len(t, link, 2)
+	token, _ := url.QueryUnescape(link[1])
+
+	assert.Error(t, userService.VerifyEmail(loginResponse.Token, context.Background()))
+	assert.NoError(t, userService.VerifyEmail(token, context.Background()))
+	assert.Equal(t, []string{"test@example.com"}, mockRepo.VerifiedEmails)
+}
+
+func TestEditUser_EmailChangeNeedsConfirmationAndCanBeReverted(t *testing.T) {
+	user := model.User{Email: "old@example.com", Username: "test", Role: model.GUEST, Verified: true}
+	user.ID = 1
+	mockRepo := &MockRepo{}
+	mockRepo.FindUserByEmailFn = func(email string, ctx context.Context) (model.User, error) {
+		if email != user.Email {
+			return model.User{}, errors.New("user does not exist")
+		}
+		return user, nil
+	}
+	mockRepo.FindUserByIdFn = func(id uint64, ctx context.Context) (model.User, error) {
+		user.TokenVersion = mockRepo.TokenVersion
+		return user, nil
+	}
+	mockRepo.UpdateUserFn = func(updated model.User, ctx context.Context) (model.User, error) {
+		user = updated
+		return user, nil
+	}
+	mockMailer := &MockMailer{}
+	userService := service.UserService{Repo: mockRepo, Mailer: mockMailer}
+
+	_, err := userService.EditUser(model.UserDTO{Email: "not an email", Username: "test"}, 1, context.Background())
+	assert.EqualError(t, err, "email format is not valid")
+
+	edited, err := userService.EditUser(model.UserDTO{Email: "new@example.com", Username: "test"}, 1, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "old@example.com", edited.Email)
+	assert.Equal(t, "new@example.com", edited.PendingEmail)
+	assert.Len(t, mockMailer.Messages, 2)
+	assert.Equal(t, "new@example.com", mockMailer.Messages[0].To)
+	assert.Equal(t, "old@example.com", mockMailer.Messages[1].To)
+
+	tokenPattern := regexp.MustCompile(`token=(\S+)`)
+	confirmToken, _ := url.QueryUnescape(tokenPattern.FindStringSubmatch(mockMailer.Messages[0].Body)[1])
+	revertToken, _ := url.QueryUnescape(tokenPattern.FindStringSubmatch(mockMailer.Messages[1].Body)[1])
+
+	_, err = userService.ConfirmEmailChange(revertToken, context.Background())
+	assert.Error(t, err)
+
+	confirmed, err := userService.ConfirmEmailChange(confirmToken, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "new@example.com", confirmed.Email)
+	assert.Empty(t, confirmed.PendingEmail)
+
+	_, err = userService.ConfirmEmailChange(confirmToken, context.Background())
+	assert.Error(t, err)
+
+	reverted, err := userService.RevertEmailChange(revertToken, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "old@example.com", reverted.Email)
+	assert.Equal(t, uint(1), mockRepo.TokenVersion)
+}
+
+func TestCreateUser_PasswordPolicyViolations(t *testing.T) {
+	corpusDir := t.TempDir()
+	// SHA-1 of "Winter2024!" is FCB8F40140297C7D1E3464C53E1F9A8BC4DDBEDF
+	os.WriteFile(filepath.Join(corpusDir, "FCB8F.txt"), []byte("00000000000000000000000000000000001:3\r\n40140297C7D1E3464C53E1F9A8BC4DDBEDF:52\r\n"), 0600)
+	corpusFile := filepath.Join(t.TempDir(), "breached.txt")
+	os.WriteFile(corpusFile, []byte("0000000000000000000000000000000000000001:3\n7C4A8D09CA3762AF61E59520943DC26494F8941B:24230577\n"+
+		"FCB8F00000000000000000000000000000000000:1\nFCB8F40140297C7D1E3464C53E1F9A8BC4DDBEDF:52\nFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF:2\n"), 0600)
+
+	t.Setenv("PASSWORD_REQUIRED_CLASSES", "lower,upper,digit,symbol")
+	for _, corpusPath := range []string{corpusDir, corpusFile} {
+		t.Setenv("PASSWORD_BREACHED_PATH", corpusPath)
+		userService := service.UserService{Repo: &MockRepo{}, Mailer: &MockMailer{}, PasswordPolicy: util.NewPasswordPolicy()}
+
+		_, err := userService.CreateUser(model.User{Email: "jovana@example.com", Username: "makulica", Password: "jovana"}, context.Background())
+		var validationErr *service.ValidationError
+		assert.True(t, errors.As(err, &validationErr))
+
+		codes := []string{}
+		for _, fieldError := range validationErr.Errors {
+			assert.Equal(t, "password", fieldError.Field)
+			codes = append(codes, fieldError.Code)
+		}
+		assert.Equal(t, []string{"too_short", "missing_upper", "missing_digit", "missing_symbol", "contains_personal_info"}, codes)
+
+		_, err = userService.CreateUser(model.User{Email: "jovana@example.com", Username: "makulica", Password: "Winter2024!"}, context.Background())
+		assert.True(t, errors.As(err, &validationErr))
+		assert.Equal(t, "breached", validationErr.Errors[0].Code)
+
+		_, err = userService.CreateUser(model.User{Email: "jovana@example.com", Username: "makulica", Password: strings.Repeat("Ab1!", 40)}, context.Background())
+		assert.True(t, errors.As(err, &validationErr))
+		assert.Equal(t, "too_long", validationErr.Errors[0].Code)
+	}
+}
+
+func TestLogin_ExpiredPasswordRequiresChangeAndBlocksReuse(t *testing.T) {
+	t.Setenv("PASSWORD_EXPIRY_DAYS", "90")
+	t.Setenv("PASSWORD_HISTORY_SIZE", "3")
+	hash, _ := util.NewArgon2idHasher().Hash("Passw0rd-one")
+	user := model.User{Email: "host@example.com", Password: hash, Role: model.HOST, Verified: true}
+	user.ID = 1
+	user.CreatedAt = time.Now().Add(-100 * 24 * time.Hour)
+	mockRepo := &MockRepo{}
+	mockRepo.addPasswordUser(user)
+	userService := service.UserService{Repo: mockRepo}
+	changePassword := func(oldPassword string, newPassword string) error {
+		return userService.ChangePassword(model.ChangePasswordDTO{OldPassword: oldPassword, NewPassword: newPassword}, 1, context.Background())
+	}
+
+	loginResponse, err := userService.Login(model.Credentials{Email: user.Email, Password: "Passw0rd-one"}, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, model.LOGIN_PASSWORD_CHANGE_REQUIRED, loginResponse.Status)
+	assert.Empty(t, loginResponse.RefreshToken)
+
+	_, err = userService.AuthenticateUser(loginResponse.Token, model.HOST, false, context.Background())
+	assert.Error(t, err)
+	authenticated, err := userService.AuthenticatePasswordChange(loginResponse.Token, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, uint(1), authenticated.ID)
+
+	var validationErr *service.ValidationError
+	assert.True(t, errors.As(changePassword("Passw0rd-one", "Passw0rd-one"), &validationErr))
+	assert.Equal(t, "reused", validationErr.Errors[0].Code)
+
+	assert.NoError(t, changePassword("Passw0rd-one", "Passw0rd-two"))
+	assert.NoError(t, changePassword("Passw0rd-two", "Passw0rd-three"))
+	assert.True(t, errors.As(changePassword("Passw0rd-three", "Passw0rd-one"), &validationErr))
+	assert.NoError(t, changePassword("Passw0rd-three", "Passw0rd-four"))
+	assert.NoError(t, changePassword("Passw0rd-four", "Passw0rd-one"))
+
+	_, err = userService.AuthenticatePasswordChange(loginResponse.Token, context.Background())
+	assert.Error(t, err)
+
+	loginResponse, err = userService.Login(model.Credentials{Email: user.Email, Password: "Passw0rd-one"}, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, model.LOGIN_SUCCESS, loginResponse.Status)
+}
+
+func TestOAuth_AuthorizationCodeWithPKCE(t *testing.T) {
+	hash, _ := util.NewArgon2idHasher().Hash("password")
+	mockRepo := &MockRepo{}
+	mockRepo.addPasswordUser(model.User{Email: "test@example.com", Password: hash, Role: model.GUEST, Verified: true})
+	userService := service.UserService{Repo: mockRepo}
+
+	client, err := userService.RegisterOAuthClient(model.RegisterOAuthClientRequest{Name: "Partner app",
+		RedirectURIs: []string{"https://partner.example.com/callback"}, Scopes: []string{"openid", "email"}}, context.Background())
+	assert.NoError(t, err)
+	assert.NotEmpty(t, client.ClientSecret)
+
+	codeVerifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	request := model.AuthorizationRequest{ResponseType: "code", ClientId: client.ClientId, RedirectURI: "https://partner.example.com/callback",
+		Scope: "openid email", State: "xyz", Nonce: "n-0S6_WzA2Mj", CodeChallenge: "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", CodeChallengeMethod: "S256"}
+
+	_, err = userService.ValidateAuthorizationRequest(model.AuthorizationRequest{ClientId: client.ClientId, RedirectURI: "https://evil.example.com/callback"}, context.Background())
+	assert.Equal(t, service.ErrInvalidRedirect, err)
+
+	redirectURL, err := userService.Authorize(request, model.Credentials{Email: "test@example.com", Password: "password"}, "", model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+	redirect, _ := url.Parse(redirectURL)
+	assert.Equal(t, "xyz", redirect.Query().Get("state"))
+	code := redirect.Query().Get("code")
+
+	tokenRequest := model.TokenRequest{GrantType: "authorization_code", Code: code, RedirectURI: request.RedirectURI,
+		CodeVerifier: "wrong-verifier-wrong-verifier-wrong-verifier", ClientId: client.ClientId, ClientSecret: client.ClientSecret}
+	_, err = userService.Token(tokenRequest, model.ClientInfo{}, context.Background())
+	assert.EqualError(t, err, "invalid_grant: code verifier does not match the challenge")
+
+	tokenRequest.CodeVerifier = codeVerifier
+	tokenResponse, err := userService.Token(tokenRequest, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "openid email", tokenResponse.Scope)
+
+	idTokenClaims := model.IdTokenClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(tokenResponse.IdToken, &idTokenClaims)
+	assert.NoError(t, err)
+	assert.Equal(t, client.ClientId, idTokenClaims.Audience)
+	assert.Equal(t, request.Nonce, idTokenClaims.Nonce)
+	assert.NotZero(t, idTokenClaims.AuthTime)
+
+	userInfo, err := userService.UserInfo(tokenResponse.AccessToken, context.Background())
+	assert.NoError(t, err)
+	assert.True(t, *userInfo.EmailVerified)
+	assert.Empty(t, userInfo.Name)
+	assert.Empty(t, userInfo.PreferredUsername)
+
+	_, err = userService.AuthenticateUser(tokenResponse.AccessToken, "", false, context.Background())
+	assert.Error(t, err)
+
+	_, err = userService.Token(tokenRequest, model.ClientInfo{}, context.Background())
+	assert.EqualError(t, err, "invalid_grant: invalid authorization code")
+	_, err = userService.UserInfo(tokenResponse.AccessToken, context.Background())
+	assert.EqualError(t, err, "session has been revoked")
+}
+
+func TestIntrospect_DescribesActiveTokensToConfidentialClients(t *testing.T) {
+	hash, _ := util.NewArgon2idHasher().Hash("password")
+	user := model.User{Email: "guest@example.com", Password: hash, Role: model.GUEST, Verified: true}
+	user.ID = 7
+	mockRepo := &MockRepo{}
+	mockRepo.addPasswordUser(user)
+	userService := service.UserService{Repo: mockRepo}
+
+	client, err := userService.RegisterOAuthClient(model.RegisterOAuthClientRequest{Name: "Reservation service", Service: true,
+		Scopes: []string{"reservations:read"}}, context.Background())
+	assert.NoError(t, err)
+	partner, err := userService.RegisterOAuthClient(model.RegisterOAuthClientRequest{Name: "Partner app",
+		RedirectURIs: []string{"https://partner.example.com/callback"}, Scopes: []string{"openid"}}, context.Background())
+	assert.NoError(t, err)
+
+	loginResponse, err := userService.Login(model.Credentials{Email: user.Email, Password: "password"}, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+
+	introspection, err := userService.Introspect(model.IntrospectionRequest{Token: loginResponse.Token, ClientId: partner.ClientId, ClientSecret: partner.ClientSecret}, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, model.IntrospectionResponse{Active: false}, introspection)
+
+	_, err = userService.Introspect(model.IntrospectionRequest{Token: loginResponse.Token, ClientId: client.ClientId, ClientSecret: "wrong"}, context.Background())
+	assert.EqualError(t, err, "invalid_client: client authentication failed")
+
+	introspection, err = userService.Introspect(model.IntrospectionRequest{Token: loginResponse.Token, ClientId: client.ClientId, ClientSecret: client.ClientSecret}, context.Background())
+	assert.NoError(t, err)
+	assert.True(t, introspection.Active)
+	assert.Equal(t, "7", introspection.Sub)
+	assert.Equal(t, model.GUEST, introspection.Role)
+	assert.Equal(t, uint(1), introspection.SessionId)
+	assert.NotZero(t, introspection.Exp)
+
+	authorised, err := userService.AuthoriseRole(loginResponse.Token, model.GUEST, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, authorised.ID)
+	_, err = userService.AuthoriseRole(loginResponse.Token, model.HOST, context.Background())
+	assert.EqualError(t, err, "user does not have said role")
+
+	assert.NoError(t, userService.Logout(loginResponse.Token, loginResponse.RefreshToken, context.Background()))
+	introspection, err = userService.Introspect(model.IntrospectionRequest{Token: loginResponse.Token, ClientId: client.ClientId, ClientSecret: client.ClientSecret}, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, model.IntrospectionResponse{Active: false}, introspection)
+}
+
+func TestClientCredentials_ServiceTokenIsIntrospectableButNotAUserToken(t *testing.T) {
+	mockRepo := &MockRepo{}
+	userService := service.UserService{Repo: mockRepo}
+
+	_, err := userService.RegisterOAuthClient(model.RegisterOAuthClientRequest{Name: "Reservation service", Service: true,
+		RedirectURIs: []string{"https://reservations.example.com/callback"}, Scopes: []string{"reservations:read"}}, context.Background())
+	assert.EqualError(t, err, "service clients are confidential and have no redirect uris")
+
+	client, err := userService.RegisterOAuthClient(model.RegisterOAuthClientRequest{Name: "Reservation service", Service: true,
+		Scopes: []string{"accommodations:delete", "reservations:read"}}, context.Background())
+	assert.NoError(t, err)
+	assert.NotEmpty(t, client.ClientSecret)
+
+	pinned, err := userService.RegisterOAuthClient(model.RegisterOAuthClientRequest{Name: "Accommodation service", Service: true,
+		Scopes: []string{"reservations:read"}, CertificateThumbprint: "thumbprint"}, context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, pinned.ClientSecret)
+
+	_, err = userService.Token(model.TokenRequest{GrantType: "authorization_code", ClientId: client.ClientId, ClientSecret: client.ClientSecret}, model.ClientInfo{}, context.Background())
+	assert.EqualError(t, err, "unauthorized_client: the client is not allowed to use this grant type")
+	_, err = userService.Token(model.TokenRequest{GrantType: "client_credentials", ClientId: client.ClientId, ClientSecret: client.ClientSecret,
+		Scope: "users:delete"}, model.ClientInfo{}, context.Background())
+	assert.EqualError(t, err, "invalid_scope: the client may not request these scopes")
+	_, err = userService.Token(model.TokenRequest{GrantType: "client_credentials", ClientId: pinned.ClientId,
+		ClientCertificateThumbprint: "other"}, model.ClientInfo{}, context.Background())
+	assert.EqualError(t, err, "invalid_client: client certificate does not match")
+
+	tokenResponse, err := userService.Token(model.TokenRequest{GrantType: "client_credentials", ClientId: client.ClientId, ClientSecret: client.ClientSecret,
+		Scope: "reservations:read"}, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, tokenResponse.RefreshToken)
+	assert.Equal(t, "reservations:read", tokenResponse.Scope)
+
+	introspection, err := userService.Introspect(model.IntrospectionRequest{Token: tokenResponse.AccessToken, ClientId: pinned.ClientId,
+		ClientCertificateThumbprint: "thumbprint"}, context.Background())
+	assert.NoError(t, err)
+	assert.True(t, introspection.Active)
+	assert.Equal(t, client.ClientId, introspection.Sub)
+	assert.Equal(t, "reservations:read", introspection.Scope)
+
+	_, err = userService.AuthoriseRole(tokenResponse.AccessToken, model.GUEST, context.Background())
+	assert.EqualError(t, err, "token is not active")
+	_, err = userService.UserInfo(tokenResponse.AccessToken, context.Background())
+	assert.Error(t, err)
+}
+
+func TestPermissions_TokensCarryThePermissionsOfTheRole(t *testing.T) {
+	hash, _ := util.NewArgon2idHasher().Hash("password")
+	user := model.User{Email: "support@example.com", Password: hash, Role: model.SUPPORT, Verified: true}
+	user.ID = 3
+	mockRepo := &MockRepo{
+		Roles: []model.Role{
+			{Name: model.SUPPORT, Permissions: []model.Permission{{Name: model.PERMISSION_USER_READ_ANY}, {Name: model.PERMISSION_USER_UNLOCK}}},
+			{Name: model.ADMIN, Permissions: []model.Permission{{Name: model.PERMISSION_USER_SUSPEND}, {Name: model.PERMISSION_USER_UNLOCK}}},
+		},
+		UserRoles: map[uint][]model.UserRole{3: {model.SUPPORT}},
+	}
+	mockRepo.addPasswordUser(user)
+	userService := service.UserService{Repo: mockRepo}
+
+	_, err := userService.CreateUser(model.User{Email: "admin@example.com", Password: "s3cure-passw0rd", Role: model.ADMIN}, context.Background())
+	assert.EqualError(t, err, "role must be GUEST or HOST")
+
+	loginResponse, err := userService.Login(model.Credentials{Email: user.Email, Password: "password"}, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+
+	_, err = userService.AuthorisePermissions(loginResponse.Token, []string{model.PERMISSION_USER_READ_ANY, model.PERMISSION_USER_UNLOCK}, context.Background())
+	assert.NoError(t, err)
+	_, err = userService.AuthorisePermissions(loginResponse.Token, []string{model.PERMISSION_USER_SUSPEND}, context.Background())
+	assert.Equal(t, service.ErrPermissionDenied, err)
+
+	_, err = userService.AddRole(3, "OWNER", context.Background())
+	assert.EqualError(t, err, "role does not exist")
+	_, err = userService.AddRole(3, model.ADMIN, context.Background())
+	assert.NoError(t, err)
+
+	switched, err := userService.SwitchRole(loginResponse.Token, model.ADMIN, context.Background())
+	assert.NoError(t, err)
+	_, err = userService.AuthorisePermissions(switched.Token, []string{model.PERMISSION_USER_SUSPEND}, context.Background())
+	assert.NoError(t, err)
+
+	assert.NoError(t, userService.RemoveRole(3, model.ADMIN, context.Background()))
+	_, err = userService.AuthorisePermissions(switched.Token, []string{model.PERMISSION_USER_UNLOCK}, context.Background())
+	assert.EqualError(t, err, "Unauthorised")
+}
+
+func TestSwitchRole_HostTravelsAsGuest(t *testing.T) {
+	hash, _ := util.NewArgon2idHasher().Hash("password")
+	user := model.User{Email: "host@example.com", Password: hash, Role: model.HOST, Verified: true, ReservationRequestNotification: true}
+	user.ID = 5
+	mockRepo := &MockRepo{
+		Roles:     []model.Role{{Name: model.GUEST}, {Name: model.HOST}},
+		UserRoles: map[uint][]model.UserRole{5: {model.HOST}},
+	}
+	mockRepo.addPasswordUser(user)
+	userService := service.UserService{Repo: mockRepo}
+
+	loginResponse, err := userService.Login(model.Credentials{Email: user.Email, Password: "password"}, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+
+	_, err = userService.AddOwnRole(5, model.ADMIN, context.Background())
+	assert.EqualError(t, err, "only the GUEST role can be added to your own account")
+	added, err := userService.AddOwnRole(5, model.GUEST, context.Background())
+	assert.NoError(t, err)
+	assert.True(t, added.ReservationStatusChangedNotification)
+	assert.True(t, added.ReservationRequestNotification)
+	_, err = userService.AddOwnRole(5, model.GUEST, context.Background())
+	assert.EqualError(t, err, "user already has this role")
+
+	_, err = userService.AuthenticateUser(loginResponse.Token, model.GUEST, true, context.Background())
+	assert.EqualError(t, err, "user does not have said role")
+
+	switched, err := userService.SwitchRole(loginResponse.Token, model.GUEST, context.Background())
+	assert.NoError(t, err)
+	_, err = userService.AuthenticateUser(switched.Token, model.GUEST, true, context.Background())
+	assert.NoError(t, err)
+	_, err = userService.AuthenticateUser(switched.Token, model.HOST, true, context.Background())
+	assert.EqualError(t, err, "user does not have said role")
+	_, err = userService.AuthenticateUser(loginResponse.Token, model.HOST, true, context.Background())
+	assert.Error(t, err)
+
+	refreshed, err := userService.RefreshToken(loginResponse.RefreshToken, context.Background())
+	assert.NoError(t, err)
+	_, err = userService.AuthenticateUser(refreshed.Token, model.GUEST, true, context.Background())
+	assert.NoError(t, err)
+
+	_, err = userService.SwitchRole(refreshed.Token, model.SUPPORT, context.Background())
+	assert.EqualError(t, err, "you do not have this role")
+}
+
+func TestHostOnboarding_GuestBecomesHostAndEventIsDelivered(t *testing.T) {
+	user := model.User{Email: "guest@example.com", Username: "guest", Name: "Ana", Surname: "Anic", Role: model.GUEST, ReservationStatusChangedNotification: true}
+	user.ID = 7
+	mockRepo := &MockRepo{
+		Roles:     []model.Role{{Name: model.GUEST}, {Name: model.HOST}},
+		UserRoles: map[uint][]model.UserRole{7: {model.GUEST}},
+	}
+	mockRepo.FindUserByIdFn = func(id uint64, ctx context.Context) (model.User, error) {
+		for _, phone := range mockRepo.VerifiedPhones {
+			user.PhoneVerified = user.PhoneVerified || phone == user.Phone
+		}
+		return user, nil
+	}
+	mockRepo.UpdateUserFn = func(updated model.User, ctx context.Context) (model.User, error) {
+		user = updated
+		return user, nil
+	}
+	mockSMS := &MockSMS{}
+	userService := service.UserService{Repo: mockRepo, SMS: mockSMS}
+
+	_, err := userService.UpdateHostProfile(7, model.HostProfileRequest{}, context.Background())
+	assert.EqualError(t, err, "host onboarding is not in progress")
+
+	onboarding, err := userService.StartHostOnboarding(7, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, model.HOST_ONBOARDING_IN_PROGRESS, onboarding.State)
+	assert.Equal(t, []string{model.HOST_REQUIREMENT_PROFILE, model.HOST_REQUIREMENT_TERMS, model.HOST_REQUIREMENT_EMAIL_VERIFIED, model.HOST_REQUIREMENT_PHONE_VERIFIED}, onboarding.Missing)
+
+	_, err = userService.UpdateHostProfile(7, model.HostProfileRequest{Name: "Ana", Surname: "Anic", Address: "Bulevar 1", Phone: "0641234567"}, context.Background())
+	assert.Error(t, err)
+	_, err = userService.UpdateHostProfile(7, model.HostProfileRequest{Name: "Ana", Surname: "Anic", Address: "Bulevar 1", Phone: "+381 64 123-4567"}, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "+381641234567", user.Phone)
+
+	_, err = userService.AcceptHostTerms(7, "2000-01", context.Background())
+	assert.EqualError(t, err, "the host terms have changed, accept the current version")
+	_, err = userService.AcceptHostTerms(7, service.HostTermsVersion(), context.Background())
+	assert.NoError(t, err)
+
+	assert.NoError(t, userService.SendPhoneCode(7, context.Background()))
+	assert.EqualError(t, userService.SendPhoneCode(7, context.Background()), "wait a minute before asking for another code")
+	assert.Len(t, mockSMS.Messages, 1)
+	assert.Equal(t, "+381641234567", mockSMS.Messages[0].To)
+	code := regexp.MustCompile(`\b\d{6}\b`).FindString(mockSMS.Messages[0].Body)
+
+	_, err = userService.VerifyPhone(7, "not-the-code", context.Background())
+	assert.EqualError(t, err, "invalid or expired code")
+	onboarding, err = userService.VerifyPhone(7, code, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{model.HOST_REQUIREMENT_EMAIL_VERIFIED}, onboarding.Missing)
+
+	_, err = userService.CompleteHostOnboarding(7, context.Background())
+	assert.EqualError(t, err, "host onboarding is missing EMAIL_VERIFIED")
+	assert.Empty(t, mockRepo.OutboxEvents)
+
+	user.Verified = true
+	host, err := userService.CompleteHostOnboarding(7, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, model.HOST_ONBOARDING_COMPLETED, host.HostOnboarding)
+	assert.True(t, host.ReservationRequestNotification)
+	assert.True(t, host.SelfReviewNotification)
+	assert.Equal(t, []model.UserRole{model.GUEST, model.HOST}, mockRepo.UserRoles[7])
+	_, err = userService.CompleteHostOnboarding(7, context.Background())
+	assert.EqualError(t, err, "host onboarding is not in progress")
+
+	assert.Len(t, mockRepo.OutboxEvents, 1)
+	assert.Equal(t, model.EVENT_HOST_ONBOARDED, mockRepo.OutboxEvents[0].Type)
+
+	var received []model.EventEnvelope
+	accommodationService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/accomodation/events", r.URL.Path)
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "Bearer "))
+		var event model.EventEnvelope
+		json.NewDecoder(r.Body).Decode(&event)
+		received = append(received, event)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer accommodationService.Close()
+	t.Setenv("ACCOMMODATION_SERVICE_PATH", accommodationService.URL)
+
+	delivered, err := userService.DeliverOutboxEvents(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, delivered)
+	assert.Len(t, received, 1)
+	assert.Equal(t, mockRepo.OutboxEvents[0].ID, received[0].Id)
+	var data model.HostOnboardedEvent
+	assert.NoError(t, json.Unmarshal(received[0].Data, &data))
+	assert.Equal(t, uint(7), data.UserId)
+	assert.Equal(t, "+381641234567", data.Phone)
+
+	delivered, err = userService.DeliverOutboxEvents(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+}
+
+func TestListUsers_PagesWithCursorAndValidatesFilters(t *testing.T) {
+	mockRepo := &MockRepo{
+		Roles:     []model.Role{{Name: model.GUEST}, {Name: model.HOST}},
+		UserRoles: map[uint][]model.UserRole{1: {model.HOST, model.GUEST}},
+	}
+	for i := 1; i <= 5; i++ {
+		user := model.User{Email: fmt.Sprintf("user%d@example.com", i), Role: model.HOST, Verified: i != 3}
+		user.ID = uint(i)
+		user.CreatedAt = time.Date(2024, 1, i, 12, 0, 0, 0, time.UTC)
+		mockRepo.Users = append(mockRepo.Users, user)
+	}
+	userService := service.UserService{Repo: mockRepo}
+
+	page, err := userService.ListUsers(model.UserListRequest{Role: "HOST", Verified: "true", CreatedTo: "2024-01-31", Search: " user ", Limit: "2"}, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []uint{5, 4}, []uint{page.Users[0].Id, page.Users[1].Id})
+	assert.NotEmpty(t, page.NextCursor)
+	query := mockRepo.UserQueries[0]
+	assert.Equal(t, model.HOST, query.Role)
+	assert.True(t, *query.Verified)
+	assert.Nil(t, query.Suspended)
+	assert.Equal(t, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), *query.CreatedTo)
+	assert.Equal(t, "user", query.Search)
+	assert.Equal(t, "created_at", query.SortField)
+	assert.True(t, query.Descending)
+
+	page, err = userService.ListUsers(model.UserListRequest{Verified: "true", Limit: "2", Cursor: page.NextCursor}, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []uint{2, 1}, []uint{page.Users[0].Id, page.Users[1].Id})
+	assert.Equal(t, []model.UserRole{model.HOST, model.GUEST}, page.Users[1].Roles)
+	assert.Equal(t, time.Date(2024, 1, 4, 12, 0, 0, 0, time.UTC), mockRepo.UserQueries[1].AfterValue)
+	assert.Empty(t, page.NextCursor)
+
+	_, err = userService.ListUsers(model.UserListRequest{Sort: "email", Cursor: page.NextCursor + "x"}, context.Background())
+	var validationErr *service.ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+
+	_, err = userService.ListUsers(model.UserListRequest{Role: "OWNER", Verified: "yes", Search: "ab", Sort: "password", Limit: "1000"}, context.Background())
+	assert.ErrorAs(t, err, &validationErr)
+	fields := []string{}
+	for _, fieldError := range validationErr.Errors {
+		fields = append(fields, fieldError.Field)
+	}
+	assert.Equal(t, []string{"role", "verified", "q", "sort", "limit"}, fields)
+}
+
+func TestClientIP_ForwardedForOnlyFromTrustedProxies(t *testing.T) {
+	assert.Equal(t, "203.0.113.9", util.ClientIP("203.0.113.9:4000", []string{"198.51.100.1"}))
+
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.1")
+	assert.Equal(t, "198.51.100.7", util.ClientIP("10.0.0.2:4000", []string{"1.1.1.1, 198.51.100.7", "192.0.2.1"}))
+	assert.Equal(t, "198.51.100.7", util.ClientIP("10.0.0.2:4000", []string{"not-an-ip, 198.51.100.7"}))
+	assert.Equal(t, "10.0.0.2", util.ClientIP("10.0.0.2:4000", nil))
+	assert.Equal(t, "203.0.113.9", util.ClientIP("203.0.113.9:4000", []string{"198.51.100.1"}))
+}
+
+func TestFederatedLogin_ProvisionsGuestFromMockIssuer(t *testing.T) {
+	signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	var issuer, nonce, codeChallenge string
+	subject, email, emailVerified := "upstream-1", "guest@example.com", true
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(model.OpenIDConfiguration{Issuer: issuer, AuthorizationEndpoint: issuer + "/authorize",
+			TokenEndpoint: issuer + "/token", JwksURI: issuer + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(model.JSONWebKeySet{Keys: []model.JSONWebKey{{Kty: "RSA", Kid: "mock-key", Alg: "RS256", Use: "sig",
+			N: base64.RawURLEncoding.EncodeToString(signingKey.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(signingKey.E)).Bytes())}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != "upstream-code" || r.PostFormValue("client_secret") != "mock-secret" ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != codeChallenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(model.OAuthErrorResponse{Error: "invalid_grant"})
+			return
+		}
+		idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"iss": issuer, "aud": []string{"windbnb"}, "sub": subject,
+			"email": email, "email_verified": emailVerified, "given_name": "Ana", "family_name": "Anic", "nonce": nonce,
+			"iat": time.Now().Unix(), "exp": time.Now().Add(time.Minute).Unix()})
+		idToken.Header["kid"] = "mock-key"
+		signed, _ := idToken.SignedString(signingKey)
+		json.NewEncoder(w).Encode(model.OAuthTokenResponse{AccessToken: "upstream-access", TokenType: "Bearer", IdToken: signed})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	issuer = server.URL
+
+	t.Setenv("FEDERATED_PROVIDERS", "mock")
+	t.Setenv("FEDERATED_MOCK_ISSUER", issuer)
+	t.Setenv("FEDERATED_MOCK_CLIENT_ID", "windbnb")
+	t.Setenv("FEDERATED_MOCK_CLIENT_SECRET", "mock-secret")
+
+	var users []model.User
+	mockRepo := &MockRepo{
+		FindUserByEmailFn: func(email string, ctx context.Context) (model.User, error) {
+			for _, user := range users {
+				if user.Email == email {
+					return user, nil
+				}
+			}
+			return model.User{}, errors.New("user does not exist")
+		},
+		CreateUserFn: func(user model.User, ctx context.Context) (model.User, error) {
+			user.ID = uint(len(users) + 1)
+			users = append(users, user)
+			return user, nil
+		},
+		FindUserByIdFn: func(id uint64, ctx context.Context) (model.User, error) {
+			return users[id-1], nil
+		},
+	}
+	userService := service.UserService{Repo: mockRepo, Mailer: &MockMailer{}}
+
+	startFederatedLogin := func() string {
+		startResponse, err := userService.StartFederatedLogin("mock", context.Background())
+		assert.NoError(t, err)
+		authorizationURL, _ := url.Parse(startResponse.AuthorizationURL)
+		assert.Equal(t, issuer+"/authorize", authorizationURL.Scheme+"://"+authorizationURL.Host+authorizationURL.Path)
+		nonce = authorizationURL.Query().Get("nonce")
+		codeChallenge = authorizationURL.Query().Get("code_challenge")
+		return authorizationURL.Query().Get("state")
+	}
+
+	state := startFederatedLogin()
+	loginResponse, err := userService.CompleteFederatedLogin(state, "upstream-code", model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+	assert.NotEmpty(t, loginResponse.Token)
+	assert.Len(t, users, 1)
+	assert.Equal(t, model.GUEST, users[0].Role)
+	assert.True(t, users[0].Verified)
+	assert.Equal(t, "Ana", users[0].Name)
+
+	_, err = userService.CompleteFederatedLogin(state, "upstream-code", model.ClientInfo{}, context.Background())
+	assert.EqualError(t, err, "invalid or expired login attempt")
+
+	state = startFederatedLogin()
+	_, err = userService.CompleteFederatedLogin(state, "upstream-code", model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, users, 1)
+
+	assert.Len(t, mockRepo.UserIdentities, 2)
+	assert.Equal(t, "mock", mockRepo.UserIdentities[0].Provider)
+	assert.Equal(t, model.MAGIC_LINK_IDENTITY, mockRepo.UserIdentities[1].Provider)
+
+	subject, emailVerified = "upstream-2", false
+	state = startFederatedLogin()
+	_, err = userService.CompleteFederatedLogin(state, "upstream-code", model.ClientInfo{}, context.Background())
+	assert.EqualError(t, err, "the identity provider has not verified this email address")
+
+	state = startFederatedLogin()
+	nonce = "replayed-nonce"
+	_, err = userService.CompleteFederatedLogin(state, "upstream-code", model.ClientInfo{}, context.Background())
+	assert.EqualError(t, err, "id token nonce does not match")
+
+	// An unverified account registered with somebody else's email loses its
+	// password and its tokens when the owner of the email signs in.
+	users = append(users, model.User{Email: "victim@example.com", Role: model.GUEST})
+	users[1].ID = 2
+	mockRepo.CreateUserIdentity(model.UserIdentity{UserId: 2, Provider: model.PASSWORD_IDENTITY, Subject: "victim@example.com"}, context.Background())
+
+	subject, email, emailVerified = "upstream-3", "victim@example.com", true
+	state = startFederatedLogin()
+	_, err = userService.CompleteFederatedLogin(state, "upstream-code", model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+	providers := []string{}
+	for _, identity := range mockRepo.FindUserIdentities(2, context.Background()) {
+		providers = append(providers, identity.Provider)
+	}
+	assert.Equal(t, []string{"mock"}, providers)
+	assert.Equal(t, uint(1), mockRepo.TokenVersion)
+	assert.Contains(t, mockRepo.VerifiedEmails, "victim@example.com")
+}
+
+func TestIdentities_LinkAndUnlink(t *testing.T) {
+	hash, _ := util.NewArgon2idHasher().Hash("s3cure-passw0rd")
+	user := model.User{Email: "Guest@Example.com", Password: hash, Role: model.GUEST, Verified: true}
+	user.ID = 1
+	mockRepo := &MockRepo{
+		FindUserByIdFn: func(id uint64, ctx context.Context) (model.User, error) {
+			return user, nil
+		},
+		UpdateUserFn: func(savedUser model.User, ctx context.Context) (model.User, error) {
+			user = savedUser
+			return user, nil
+		},
+		UserIdentities: []model.UserIdentity{
+			{Model: gorm.Model{ID: 1}, UserId: 1, Provider: model.PASSWORD_IDENTITY, Subject: "guest@example.com"},
+			{Model: gorm.Model{ID: 2}, UserId: 1, Provider: "google", Subject: "google-subject"},
+		},
+	}
+	userService := service.UserService{Repo: mockRepo}
+
+	loginResponse, err := userService.Login(model.Credentials{Email: "guest@example.com", Password: "s3cure-passw0rd"}, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, userService.ListIdentities(1, context.Background()), 2)
+
+	_, err = userService.StartIdentityLink(1, loginResponse.Token, "github", "wrong-passw0rd", context.Background())
+	assert.EqualError(t, err, "re-authentication failed")
+
+	assert.NoError(t, userService.UnlinkIdentity(1, 1, context.Background()))
+	_, err = userService.Login(model.Credentials{Email: "guest@example.com", Password: "s3cure-passw0rd"}, model.ClientInfo{}, context.Background())
+	assert.EqualError(t, err, "bad credentials")
+
+	err = userService.UnlinkIdentity(1, 2, context.Background())
+	assert.EqualError(t, err, "cannot remove the last way to sign in")
+
+	identity, err := userService.LinkPasswordIdentity(1, loginResponse.Token, "n3w-passw0rd", context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, model.PASSWORD_IDENTITY, identity.Provider)
+
+	_, err = userService.LinkPasswordIdentity(1, loginResponse.Token, "n3w-passw0rd", context.Background())
+	assert.EqualError(t, err, "a password is already linked, change it instead")
+
+	_, err = userService.Login(model.Credentials{Email: "GUEST@example.com", Password: "n3w-passw0rd"}, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+}
+
+func TestMagicLink_SingleUseAndRateLimited(t *testing.T) {
+	t.Setenv("MAGIC_LINK_EMAIL_LIMIT", "2")
+	user := model.User{Email: "guest@example.com", Role: model.GUEST}
+	user.ID = 1
+	mockRepo := &MockRepo{
+		UserIdentities: []model.UserIdentity{
+			{Model: gorm.Model{ID: 1}, UserId: 1, Provider: model.MAGIC_LINK_IDENTITY, Subject: "guest@example.com"},
+		},
+	}
+	mockRepo.FindUserByIdFn = func(id uint64, ctx context.Context) (model.User, error) {
+		user.Verified = len(mockRepo.VerifiedEmails) > 0
+		return user, nil
+	}
+	mockMailer := &MockMailer{}
+	userService := service.UserService{Repo: mockRepo, Mailer: mockMailer}
+	clientInfo := model.ClientInfo{IP: "203.0.113.7"}
+
+	assert.NoError(t, userService.RequestMagicLink("unknown@example.com", clientInfo, context.Background()))
+	assert.Empty(t, mockMailer.Messages)
+
+	assert.NoError(t, userService.RequestMagicLink("Guest@Example.com", clientInfo, context.Background()))
+	assert.Len(t, mockMailer.Messages, 1)
+
+	link := regexp.MustCompile(`token=(\S+)`).FindStringSubmatch(mockMailer.Messages[0].Body)
+	assert.Len(t, link, 2)
+	token, _ := url.QueryUnescape(link[1])
+
+	loginResponse, err := userService.ConsumeMagicLink(token, clientInfo, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{user.Email}, mockRepo.VerifiedEmails)
+	_, err = userService.AuthenticateUser(loginResponse.Token, model.GUEST, true, context.Background())
+	assert.NoError(t, err)
+
+	_, err = userService.ConsumeMagicLink(token, clientInfo, context.Background())
+	assert.EqualError(t, err, "invalid or expired sign in link")
+
+	assert.NoError(t, userService.RequestMagicLink("guest@example.com", clientInfo, context.Background()))
+	var tooManyAttempts *service.TooManyAttemptsError
+	assert.ErrorAs(t, userService.RequestMagicLink("guest@example.com", clientInfo, context.Background()), &tooManyAttempts)
+	assert.Len(t, mockMailer.Messages, 2)
+
+	_, err = userService.Login(model.Credentials{Email: user.Email, Password: "anything"}, clientInfo, context.Background())
+	assert.EqualError(t, err, "bad credentials")
+}
 
-	userService := service.UserService{
-		Repo: mockRepo,
-	}
+func TestStepUp_RequiresRecentAuthentication(t *testing.T) {
+	hash, _ := util.NewArgon2idHasher().Hash("s3cure-passw0rd")
+	user := model.User{Email: "host@example.com", Password: hash, Role: model.HOST, Verified: true}
+	user.ID = 1
+	mockRepo := &MockRepo{}
+	mockRepo.addPasswordUser(user)
+	userService := service.UserService{Repo: mockRepo}
 
-	credentials := model.Credentials{
-		Email:    "test@example.com",
-		Password: "password",
-	}
-	token, err := userService.Login(credentials, context.Background())
+	loginResponse, err := userService.Login(model.Credentials{Email: user.Email, Password: "s3cure-passw0rd"}, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, userService.RequireStepUp(loginResponse.Token, service.STEP_UP_DELETE_ACCOUNT, context.Background()))
 
-	assert.NotEmpty(t, token)
+	// An hour later the refreshed token still carries the original auth_time.
+	mockRepo.Sessions[0].CreatedAt = time.Now().Add(-time.Hour)
+	refreshed, err := userService.RefreshToken(loginResponse.RefreshToken, context.Background())
 	assert.NoError(t, err)
-}
 
-func TestLogin_InvalidCredentials(t *testing.T) {
-	mockRepo := &MockRepo{
-		CheckCredentialsFn: func(email, password string, ctx context.Context) (model.User, error) {
-			return model.User{}, errors.New("invalid credentials")
-		},
-	}
+	var stepUpRequired *service.StepUpRequiredError
+	assert.ErrorAs(t, userService.RequireStepUp(refreshed.Token, service.STEP_UP_DELETE_ACCOUNT, context.Background()), &stepUpRequired)
+	assert.Equal(t, 5*time.Minute, stepUpRequired.MaxAge)
 
-	userService := service.UserService{
-		Repo: mockRepo,
-	}
+	_, err = userService.StepUp(refreshed.Token, model.StepUpRequest{Password: "wrong-passw0rd"}, model.ClientInfo{}, context.Background())
+	assert.EqualError(t, err, "re-authentication failed")
 
-	credentials := model.Credentials{
-		Email:    "test@example.com",
-		Password: "password",
-	}
-	token, err := userService.Login(credentials, context.Background())
+	elevated, err := userService.StepUp(refreshed.Token, model.StepUpRequest{Password: "s3cure-passw0rd"}, model.ClientInfo{}, context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, elevated.RefreshToken)
+	assert.NoError(t, userService.RequireStepUp(elevated.Token, service.STEP_UP_DELETE_ACCOUNT, context.Background()))
 
-	assert.Empty(t, token)
-	assert.EqualError(t, err, "bad credentials")
+	_, err = userService.AuthenticateUser(elevated.Token, model.HOST, true, context.Background())
+	assert.NoError(t, err)
 }
 
 func TestCreateUser_InvalidEmailFormat(t *testing.T) {
@@ -124,6 +1368,9 @@ func TestCreateUser_ErrorSavingUser(t *testing.T) {
 
 	user := model.User{
 		Email: "test@example.com",
+		Password: "s3cure-passw0rd",
+		Address: "Bulevar oslobodjenja 1",
+		Role: model.HOST,
 		ReservationRequestNotification:true, 
 		ReservationCanceledNotification:true, 
 		SelfReviewNotification:true, 
@@ -136,6 +1383,14 @@ func TestCreateUser_ErrorSavingUser(t *testing.T) {
 	assert.EqualError(t, err, "error while trying to save user")
 }
 
+func TestCreateUser_RequiresAddress(t *testing.T) {
+	userService := service.UserService{Repo: &MockRepo{}}
+
+	_, err := userService.CreateUser(model.User{Email: "test@example.com", Password: "s3cure-passw0rd", Address: " ", Role: model.GUEST}, context.Background())
+
+	assert.EqualError(t, err, "address is required")
+}
+
 func TestCreateUser_Successful(t *testing.T) {
 	mockRepo := &MockRepo{
 		CreateUserFn: func(user model.User, ctx context.Context) (model.User, error) {
@@ -145,10 +1400,14 @@ func TestCreateUser_Successful(t *testing.T) {
 
 	userService := service.UserService{
 		Repo: mockRepo,
+		Mailer: &MockMailer{},
 	}
 
 	user := model.User{
 		Email: "test@example.com",
+		Password: "s3cure-passw0rd",
+		Address: "Bulevar oslobodjenja 1",
+		Role: model.HOST,
 		ReservationRequestNotification:true, 
 		ReservationCanceledNotification:true, 
 		SelfReviewNotification:true, 
@@ -157,30 +1416,668 @@ func TestCreateUser_Successful(t *testing.T) {
 
 	createdUser, err := userService.CreateUser(user, context.Background())
 
-	assert.Equal(t, user, createdUser)
 	assert.NoError(t, err)
+	assert.Equal(t, user.Email, createdUser.Email)
+	assert.Equal(t, util.Argon2idAlgorithm, util.HashAlgorithm(createdUser.Password))
 }
 
 
 type MockRepo struct {
 	repository.Repository
-	CheckCredentialsFn func(email, password string, ctx context.Context) (model.User, error)
+	FindUserByEmailFn func(email string, ctx context.Context) (model.User, error)
 	CreateUserFn func(user model.User, ctx context.Context) (model.User, error)
+	UpdateUserFn func(user model.User, ctx context.Context) (model.User, error)
+	UpdatedColumns [][]string
+	FindUserByIdFn func(id uint64, ctx context.Context) (model.User, error)
+	RefreshTokens []model.RefreshToken
+	RevokedTokens []model.RevokedToken
+	TokenVersion uint
+	Sessions []model.Session
+	RecoveryCodes []model.RecoveryCode
+	LoginThrottles map[string]model.LoginThrottle
+	PasswordResetTokens []model.PasswordResetToken
+	VerificationSentAt *time.Time
+	VerifiedEmails []string
+	EmailChanges []model.EmailChange
+	PasswordHistory []model.PasswordHistory
+	OAuthClients []model.OAuthClient
+	AuthorizationCodes []model.AuthorizationCode
+	FederatedLoginStates []model.FederatedLoginState
+	UserIdentities []model.UserIdentity
+	Roles []model.Role
+	UserRoles map[uint][]model.UserRole
+	PhoneVerifications []model.PhoneVerification
+	VerifiedPhones []string
+	OutboxEvents []model.OutboxEvent
+	Users []model.User
+	UserQueries []model.UserQuery
+}
+
+// addPasswordUser stores user with the password identity CreateUser links to
+// it. The lookups by id and email answer with the stored user unless the test
+// sets its own.
+func (m *MockRepo) addPasswordUser(user model.User) {
+	m.Users = append(m.Users, user)
+	m.UserIdentities = append(m.UserIdentities, model.EmailIdentity(model.PASSWORD_IDENTITY, user))
+}
+
+func (m *MockRepo) FindUserByIdentity(provider string, subject string, ctx context.Context) (model.User, model.UserIdentity, error) {
+	for _, identity := range m.UserIdentities {
+		if identity.Provider == provider && identity.Subject == subject {
+			user, err := m.FindUserById(uint64(identity.UserId), ctx)
+			return user, identity, err
+		}
+	}
+	return model.User{}, model.UserIdentity{}, errors.New("user does not exist")
+}
+
+func (m *MockRepo) FindUserIdentities(userId uint, ctx context.Context) []model.UserIdentity {
+	identities := []model.UserIdentity{}
+	for _, identity := range m.UserIdentities {
+		if identity.UserId == userId {
+			identities = append(identities, identity)
+		}
+	}
+	return identities
+}
+
+func (m *MockRepo) CreateUserIdentity(identity model.UserIdentity, ctx context.Context) (model.UserIdentity, error) {
+	identity.ID = uint(len(m.UserIdentities) + 1)
+	m.UserIdentities = append(m.UserIdentities, identity)
+	return identity, nil
+}
+
+func (m *MockRepo) TouchUserIdentity(id uint, lastUsedAt time.Time, ctx context.Context) error {
+	return nil
+}
+
+func (m *MockRepo) UpdateUserIdentity(userId uint, provider string, subject string, email string, ctx context.Context) error {
+	for i := range m.UserIdentities {
+		if m.UserIdentities[i].UserId == userId && m.UserIdentities[i].Provider == provider {
+			m.UserIdentities[i].Subject, m.UserIdentities[i].Email = subject, email
+		}
+	}
+	return nil
+}
+
+func (m *MockRepo) DeleteUserIdentity(userId uint, identityId uint, ctx context.Context) (bool, error) {
+	if len(m.FindUserIdentities(userId, ctx)) <= 1 {
+		return false, nil
+	}
+	for i, identity := range m.UserIdentities {
+		if identity.ID == identityId && identity.UserId == userId {
+			m.UserIdentities = append(m.UserIdentities[:i], m.UserIdentities[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MockRepo) CreateFederatedLoginState(state model.FederatedLoginState, ctx context.Context) (model.FederatedLoginState, error) {
+	state.ID = uint(len(m.FederatedLoginStates) + 1)
+	m.FederatedLoginStates = append(m.FederatedLoginStates, state)
+	return state, nil
+}
+
+func (m *MockRepo) FindFederatedLoginStateByHash(stateHash string, ctx context.Context) (model.FederatedLoginState, error) {
+	for _, state := range m.FederatedLoginStates {
+		if state.StateHash == stateHash && state.DeletedAt == nil && time.Now().Before(state.ExpiresAt) {
+			return state, nil
+		}
+	}
+	return model.FederatedLoginState{}, errors.New("federated login state does not exist")
+}
+
+func (m *MockRepo) DeleteFederatedLoginState(id uint, ctx context.Context) (bool, error) {
+	state := &m.FederatedLoginStates[id-1]
+	if state.DeletedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	state.DeletedAt = &now
+	return true, nil
+}
+
+func (m *MockRepo) CreateOAuthClient(client model.OAuthClient, ctx context.Context) (model.OAuthClient, error) {
+	client.ID = uint(len(m.OAuthClients) + 1)
+	m.OAuthClients = append(m.OAuthClients, client)
+	return client, nil
+}
+
+func (m *MockRepo) FindOAuthClient(clientId string, ctx context.Context) (model.OAuthClient, error) {
+	for _, client := range m.OAuthClients {
+		if client.ClientId == clientId {
+			return client, nil
+		}
+	}
+	return model.OAuthClient{}, errors.New("client does not exist")
+}
+
+func (m *MockRepo) FindRole(name model.UserRole, ctx context.Context) (model.Role, error) {
+	for _, role := range m.Roles {
+		if role.Name == name {
+			return role, nil
+		}
+	}
+	return model.Role{}, errors.New("role does not exist")
+}
+
+func (m *MockRepo) FindRoles(ctx context.Context) []model.Role {
+	return m.Roles
+}
+
+func (m *MockRepo) FindUserRoles(userId uint, ctx context.Context) []model.UserRole {
+	return m.UserRoles[userId]
+}
+
+func (m *MockRepo) AddUserRole(user model.User, role model.UserRole, ctx context.Context) (model.User, error) {
+	if m.UserRoles == nil {
+		m.UserRoles = map[uint][]model.UserRole{}
+	}
+	m.UserRoles[user.ID] = append(m.UserRoles[user.ID], role)
+	return m.UpdateUser(user, nil, ctx)
+}
+
+func (m *MockRepo) RemoveUserRole(userId uint, role model.UserRole, ctx context.Context) (bool, error) {
+	remaining := []model.UserRole{}
+	for _, heldRole := range m.UserRoles[userId] {
+		if heldRole != role {
+			remaining = append(remaining, heldRole)
+		}
+	}
+	if len(remaining) == 0 {
+		return false, nil
+	}
+	m.UserRoles[userId] = remaining
+	if user, _ := m.FindUserById(uint64(userId), ctx); user.Role == role {
+		user.Role = remaining[0]
+		m.UpdateUser(user, nil, ctx)
+	}
+	return true, nil
+}
+
+func (m *MockRepo) UpdateSessionRole(sessionId uint, role model.UserRole, ctx context.Context) error {
+	m.Sessions[sessionId-1].Role = role
+	return nil
+}
+
+func (m *MockRepo) CreateAuthorizationCode(code model.AuthorizationCode, ctx context.Context) (model.AuthorizationCode, error) {
+	code.ID = uint(len(m.AuthorizationCodes) + 1)
+	m.AuthorizationCodes = append(m.AuthorizationCodes, code)
+	return code, nil
+}
+
+func (m *MockRepo) FindAuthorizationCodeByHash(codeHash string, ctx context.Context) (model.AuthorizationCode, error) {
+	for _, code := range m.AuthorizationCodes {
+		if code.CodeHash == codeHash {
+			return code, nil
+		}
+	}
+	return model.AuthorizationCode{}, errors.New("authorization code does not exist")
+}
+
+func (m *MockRepo) MarkAuthorizationCodeUsed(id uint, sessionId uint, ctx context.Context) (bool, error) {
+	code := &m.AuthorizationCodes[id-1]
+	if code.UsedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	code.UsedAt = &now
+	code.SessionId = sessionId
+	return true, nil
+}
+
+func (m *MockRepo) AddPasswordHistory(userId uint, passwordHash string, keep int, ctx context.Context) error {
+	m.PasswordHistory = append([]model.PasswordHistory{{UserId: userId, PasswordHash: passwordHash}}, m.PasswordHistory...)
+	if len(m.PasswordHistory) > keep {
+		m.PasswordHistory = m.PasswordHistory[:keep]
+	}
+	return nil
+}
+
+func (m *MockRepo) FindPasswordHistory(userId uint, limit int, ctx context.Context) []model.PasswordHistory {
+	if len(m.PasswordHistory) > limit {
+		return m.PasswordHistory[:limit]
+	}
+	return m.PasswordHistory
+}
+
+func (m *MockRepo) FindUserByUsername(username string, ctx context.Context) model.User {
+	return model.User{}
+}
+
+func (m *MockRepo) CreateEmailChange(emailChange model.EmailChange, ctx context.Context) (model.EmailChange, error) {
+	emailChange.ID = uint(len(m.EmailChanges) + 1)
+	m.EmailChanges = append(m.EmailChanges, emailChange)
+	return emailChange, nil
+}
+
+func (m *MockRepo) FindEmailChangeByConfirmHash(tokenHash string, ctx context.Context) (model.EmailChange, error) {
+	for _, emailChange := range m.EmailChanges {
+		if emailChange.ConfirmTokenHash == tokenHash {
+			return emailChange, nil
+		}
+	}
+	return model.EmailChange{}, errors.New("email change does not exist")
+}
+
+func (m *MockRepo) FindEmailChangeByRevertHash(tokenHash string, ctx context.Context) (model.EmailChange, error) {
+	for _, emailChange := range m.EmailChanges {
+		if emailChange.RevertTokenHash == tokenHash {
+			return emailChange, nil
+		}
+	}
+	return model.EmailChange{}, errors.New("email change does not exist")
+}
+
+func (m *MockRepo) MarkEmailChangeConfirmed(id uint, ctx context.Context) (bool, error) {
+	emailChange := &m.EmailChanges[id-1]
+	if emailChange.ConfirmedAt != nil || emailChange.RevertedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	emailChange.ConfirmedAt = &now
+	return true, nil
+}
+
+func (m *MockRepo) MarkEmailChangeReverted(id uint, ctx context.Context) (bool, error) {
+	emailChange := &m.EmailChanges[id-1]
+	if emailChange.RevertedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	emailChange.RevertedAt = &now
+	return true, nil
+}
+
+func (m *MockRepo) ReserveVerificationEmail(userId uint, sentBefore time.Time, ctx context.Context) (bool, error) {
+	if m.VerificationSentAt != nil && !m.VerificationSentAt.Before(sentBefore) {
+		return false, nil
+	}
+	now := time.Now()
+	m.VerificationSentAt = &now
+	return true, nil
+}
+
+func (m *MockRepo) MarkUserVerified(userId uint, email string, ctx context.Context) error {
+	m.VerifiedEmails = append(m.VerifiedEmails, email)
+	return nil
+}
+
+type MockMailer struct {
+	Messages []mailer.Message
+	mutex    sync.Mutex
+}
+
+func (m *MockMailer) Send(message mailer.Message) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Messages = append(m.Messages, message)
+	return nil
+}
+
+// Sent counts the messages, also those sent in the background.
+func (m *MockMailer) Sent() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.Messages)
+}
+
+// FindUsers pages Users newest first, ids grow with the creation time.
+func (m *MockRepo) FindUsers(query model.UserQuery, ctx context.Context) ([]model.User, error) {
+	m.UserQueries = append(m.UserQueries, query)
+	users := []model.User{}
+	for i := len(m.Users) - 1; i >= 0; i-- {
+		user := m.Users[i]
+		if (query.AfterId == 0 || user.ID < query.AfterId) && (query.Verified == nil || user.Verified == *query.Verified) && len(users) < query.Limit {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (m *MockRepo) FindRolesOfUsers(userIds []uint, ctx context.Context) map[uint][]model.UserRole {
+	return m.UserRoles
+}
+
+type MockSMS struct {
+	Messages []sms.Message
+}
+
+func (m *MockSMS) Send(message sms.Message) error {
+	m.Messages = append(m.Messages, message)
+	return nil
+}
+
+func (m *MockRepo) CreatePhoneVerification(verification model.PhoneVerification, ctx context.Context) (model.PhoneVerification, error) {
+	verification.ID = uint(len(m.PhoneVerifications) + 1)
+	verification.CreatedAt = time.Now()
+	m.PhoneVerifications = append(m.PhoneVerifications, verification)
+	return verification, nil
+}
+
+func (m *MockRepo) FindPhoneVerification(userId uint, ctx context.Context) (model.PhoneVerification, error) {
+	for i := len(m.PhoneVerifications) - 1; i >= 0; i-- {
+		if m.PhoneVerifications[i].UserId == userId {
+			return m.PhoneVerifications[i], nil
+		}
+	}
+	return model.PhoneVerification{}, errors.New("phone verification does not exist")
+}
+
+func (m *MockRepo) RecordPhoneVerificationAttempt(id uint, maxAttempts int, ctx context.Context) (bool, error) {
+	verification := &m.PhoneVerifications[id-1]
+	if verification.UsedAt != nil || verification.Attempts >= maxAttempts {
+		return false, nil
+	}
+	verification.Attempts++
+	return true, nil
+}
+
+func (m *MockRepo) MarkPhoneVerified(verification model.PhoneVerification, ctx context.Context) (bool, error) {
+	if m.PhoneVerifications[verification.ID-1].UsedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	m.PhoneVerifications[verification.ID-1].UsedAt = &now
+	m.VerifiedPhones = append(m.VerifiedPhones, verification.Phone)
+	return true, nil
+}
+
+func (m *MockRepo) CompleteHostOnboarding(user model.User, event model.OutboxEvent, ctx context.Context) (model.User, error) {
+	event.ID = uint(len(m.OutboxEvents) + 1)
+	event.CreatedAt = time.Now()
+	m.OutboxEvents = append(m.OutboxEvents, event)
+	return m.AddUserRole(user, model.HOST, ctx)
+}
+
+func (m *MockRepo) FindPendingOutboxEvents(limit int, ctx context.Context) []model.OutboxEvent {
+	pending := []model.OutboxEvent{}
+	for _, event := range m.OutboxEvents {
+		if event.DeliveredAt == nil && len(pending) < limit {
+			pending = append(pending, event)
+		}
+	}
+	return pending
+}
+
+func (m *MockRepo) MarkOutboxEventDelivered(id uint, ctx context.Context) error {
+	now := time.Now()
+	m.OutboxEvents[id-1].DeliveredAt = &now
+	m.OutboxEvents[id-1].Attempts++
+	return nil
+}
+
+func (m *MockRepo) RecordOutboxEventAttempt(id uint, ctx context.Context) error {
+	m.OutboxEvents[id-1].Attempts++
+	return nil
+}
+
+func (m *MockRepo) CreatePasswordResetToken(resetToken model.PasswordResetToken, ctx context.Context) (model.PasswordResetToken, error) {
+	resetToken.ID = uint(len(m.PasswordResetTokens) + 1)
+	m.PasswordResetTokens = append(m.PasswordResetTokens, resetToken)
+	return resetToken, nil
+}
+
+func (m *MockRepo) FindPasswordResetTokenByHash(tokenHash string, ctx context.Context) (model.PasswordResetToken, error) {
+	for _, resetToken := range m.PasswordResetTokens {
+		if resetToken.TokenHash == tokenHash {
+			return resetToken, nil
+		}
+	}
+	return model.PasswordResetToken{}, errors.New("password reset token does not exist")
+}
+
+func (m *MockRepo) MarkPasswordResetTokenUsed(id uint, ctx context.Context) (bool, error) {
+	resetToken := &m.PasswordResetTokens[id-1]
+	if resetToken.UsedAt != nil || resetToken.ExpiresAt.Before(time.Now()) {
+		return false, nil
+	}
+	now := time.Now()
+	resetToken.UsedAt = &now
+	return true, nil
+}
+
+func (m *MockRepo) InvalidatePasswordResetTokens(userId uint, ctx context.Context) error {
+	now := time.Now()
+	for i := range m.PasswordResetTokens {
+		if m.PasswordResetTokens[i].UserId == userId && m.PasswordResetTokens[i].UsedAt == nil {
+			m.PasswordResetTokens[i].UsedAt = &now
+		}
+	}
+	return nil
+}
+
+func (m *MockRepo) FindLoginThrottle(throttleKey string, ctx context.Context) model.LoginThrottle {
+	return m.LoginThrottles[throttleKey]
+}
+
+func (m *MockRepo) RecordLoginFailure(throttleKey string, window time.Duration, ctx context.Context) (model.LoginThrottle, error) {
+	if m.LoginThrottles == nil {
+		m.LoginThrottles = map[string]model.LoginThrottle{}
+	}
+	loginThrottle := m.LoginThrottles[throttleKey]
+	if loginThrottle.ID == 0 {
+		loginThrottle.ID = uint(len(m.LoginThrottles) + 1)
+		loginThrottle.ThrottleKey = throttleKey
+	}
+	loginThrottle.Failures++
+	loginThrottle.LastFailureAt = time.Now()
+	m.LoginThrottles[throttleKey] = loginThrottle
+	return loginThrottle, nil
+}
+
+func (m *MockRepo) LockLoginThrottle(throttleKey string, lockedUntil time.Time, ctx context.Context) error {
+	loginThrottle := m.LoginThrottles[throttleKey]
+	loginThrottle.LockedUntil = &lockedUntil
+	m.LoginThrottles[throttleKey] = loginThrottle
+	return nil
+}
+
+func (m *MockRepo) DeleteLoginThrottle(throttleKey string, ctx context.Context) error {
+	delete(m.LoginThrottles, throttleKey)
+	return nil
+}
+
+func (m *MockRepo) UpdateTotpLastStep(userId uint, step int64, ctx context.Context) (bool, error) {
+	user, _ := m.FindUserById(uint64(userId), ctx)
+	if user.TotpLastStep >= step {
+		return false, nil
+	}
+	user.TotpLastStep = step
+	m.UpdateUser(user, nil, ctx)
+	return true, nil
+}
+
+func (m *MockRepo) ReplaceRecoveryCodes(userId uint, recoveryCodes []model.RecoveryCode, ctx context.Context) error {
+	m.RecoveryCodes = nil
+	for _, recoveryCode := range recoveryCodes {
+		recoveryCode.ID = uint(len(m.RecoveryCodes) + 1)
+		m.RecoveryCodes = append(m.RecoveryCodes, recoveryCode)
+	}
+	return nil
 }
 
-func (m *MockRepo) CheckCredentials(email, password string, ctx context.Context) (model.User, error) {
-	return m.CheckCredentialsFn(email, password, ctx)
+func (m *MockRepo) FindUnusedRecoveryCodes(userId uint, ctx context.Context) []model.RecoveryCode {
+	recoveryCodes := []model.RecoveryCode{}
+	for _, recoveryCode := range m.RecoveryCodes {
+		if recoveryCode.UsedAt == nil {
+			recoveryCodes = append(recoveryCodes, recoveryCode)
+		}
+	}
+	return recoveryCodes
+}
+
+func (m *MockRepo) MarkRecoveryCodeUsed(id uint, ctx context.Context) (bool, error) {
+	if m.RecoveryCodes[id-1].UsedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	m.RecoveryCodes[id-1].UsedAt = &now
+	return true, nil
+}
+
+func (m *MockRepo) CreateSession(session model.Session, ctx context.Context) (model.Session, error) {
+	session.ID = uint(len(m.Sessions) + 1)
+	session.CreatedAt = time.Now()
+	m.Sessions = append(m.Sessions, session)
+	return session, nil
+}
+
+func (m *MockRepo) FindSessionById(id uint, ctx context.Context) (model.Session, error) {
+	if id == 0 || int(id) > len(m.Sessions) {
+		return model.Session{}, errors.New("session does not exist")
+	}
+	return m.Sessions[id-1], nil
+}
+
+func (m *MockRepo) FindActiveSessionsByUser(userId uint, ctx context.Context) []model.Session {
+	sessions := []model.Session{}
+	for _, session := range m.Sessions {
+		if session.UserId == userId && session.RevokedAt == nil {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+func (m *MockRepo) TouchSession(id uint, lastSeenAt time.Time, ctx context.Context) error {
+	m.Sessions[id-1].LastSeenAt = lastSeenAt
+	return nil
+}
+
+func (m *MockRepo) RevokeSession(id uint, ctx context.Context) error {
+	now := time.Now()
+	m.Sessions[id-1].RevokedAt = &now
+	for i := range m.RefreshTokens {
+		if m.RefreshTokens[i].SessionId == id && m.RefreshTokens[i].RevokedAt == nil {
+			m.RefreshTokens[i].RevokedAt = &now
+		}
+	}
+	return nil
+}
+
+func (m *MockRepo) RevokeSessionsForUser(userId uint, ctx context.Context) error {
+	now := time.Now()
+	for i := range m.Sessions {
+		if m.Sessions[i].UserId == userId && m.Sessions[i].RevokedAt == nil {
+			m.Sessions[i].RevokedAt = &now
+		}
+	}
+	return nil
+}
+
+func (m *MockRepo) IncrementTokenVersion(userId uint, ctx context.Context) error {
+	m.TokenVersion++
+	return nil
+}
+
+func (m *MockRepo) RevokeRefreshTokensForUser(userId uint, ctx context.Context) error {
+	now := time.Now()
+	for i := range m.RefreshTokens {
+		if m.RefreshTokens[i].UserId == userId && m.RefreshTokens[i].RevokedAt == nil {
+			m.RefreshTokens[i].RevokedAt = &now
+		}
+	}
+	return nil
+}
+
+func (m *MockRepo) CreateRevokedToken(revokedToken model.RevokedToken, ctx context.Context) error {
+	revokedToken.ID = uint(len(m.RevokedTokens) + 1)
+	m.RevokedTokens = append(m.RevokedTokens, revokedToken)
+	return nil
+}
+
+func (m *MockRepo) FindRevokedToken(jti string, ctx context.Context) (model.RevokedToken, error) {
+	for _, revokedToken := range m.RevokedTokens {
+		if revokedToken.Jti == jti {
+			return revokedToken, nil
+		}
+	}
+	return model.RevokedToken{}, nil
+}
+
+func (m *MockRepo) CreateRefreshToken(refreshToken model.RefreshToken, ctx context.Context) (model.RefreshToken, error) {
+	refreshToken.ID = uint(len(m.RefreshTokens) + 1)
+	m.RefreshTokens = append(m.RefreshTokens, refreshToken)
+	return refreshToken, nil
+}
+
+func (m *MockRepo) FindRefreshTokenByHash(tokenHash string, ctx context.Context) (model.RefreshToken, error) {
+	for _, refreshToken := range m.RefreshTokens {
+		if refreshToken.TokenHash == tokenHash {
+			return refreshToken, nil
+		}
+	}
+	return model.RefreshToken{}, errors.New("refresh token does not exist")
+}
+
+func (m *MockRepo) MarkRefreshTokenRotated(id uint, ctx context.Context) (bool, error) {
+	refreshToken := &m.RefreshTokens[id-1]
+	if refreshToken.RotatedAt != nil || refreshToken.RevokedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	refreshToken.RotatedAt = &now
+	return true, nil
+}
+
+func (m *MockRepo) RevokeRefreshTokenFamily(familyId string, ctx context.Context) error {
+	now := time.Now()
+	for i := range m.RefreshTokens {
+		if m.RefreshTokens[i].FamilyId == familyId && m.RefreshTokens[i].RevokedAt == nil {
+			m.RefreshTokens[i].RevokedAt = &now
+		}
+	}
+	return nil
 }
 
-func (m *MockRepo) CreateUser(user model.User, ctx context.Context) (model.User, error) {
-	return m.CreateUserFn(user, ctx)
+func (m *MockRepo) FindUserByEmail(email string, ctx context.Context) (model.User, error) {
+	if m.FindUserByEmailFn != nil {
+		return m.FindUserByEmailFn(email, ctx)
+	}
+	for _, user := range m.Users {
+		if model.IdentitySubject(user.Email) == model.IdentitySubject(email) {
+			return user, nil
+		}
+	}
+	return model.User{}, errors.New("user does not exist")
+}
+
+func (m *MockRepo) CreateUser(user model.User, identities []model.UserIdentity, ctx context.Context) (model.User, error) {
+	createdUser, err := m.CreateUserFn(user, ctx)
+	if err == nil {
+		for _, identity := range identities {
+			identity.UserId = createdUser.ID
+			m.CreateUserIdentity(identity, ctx)
+		}
+	}
+	return createdUser, err
 }
 
 func (m *MockRepo) FindUserById(id uint64, ctx context.Context) (model.User, error) {
-	return model.User{}, nil
+	if m.FindUserByIdFn != nil {
+		return m.FindUserByIdFn(id, ctx)
+	}
+	for _, user := range m.Users {
+		if uint64(user.ID) == id {
+			user.TokenVersion = m.TokenVersion
+			return user, nil
+		}
+	}
+	return model.User{TokenVersion: m.TokenVersion, Verified: true}, nil
 }
 
-func (m *MockRepo) SaveUser(user model.User, ctx context.Context) (model.User, error) {
+func (m *MockRepo) UpdateUser(user model.User, columns []string, ctx context.Context) (model.User, error) {
+	m.UpdatedColumns = append(m.UpdatedColumns, columns)
+	if m.UpdateUserFn != nil {
+		return m.UpdateUserFn(user, ctx)
+	}
+	for i := range m.Users {
+		if m.Users[i].ID == user.ID {
+			m.Users[i] = user
+		}
+	}
 	return user, nil
 }
 
@@ -190,3 +2087,19 @@ func (m *MockRepo) SaveUserDeletionEvent(userId uint64, ctx context.Context) {
 func (m *MockRepo) DeleteUser(userId uint64, ctx context.Context) error {
 	return nil
 }
+
+func TestUserDTO_KeepsAccountStateToTheAccount(t *testing.T) {
+	user := model.User{Email: "guest@example.com", Suspended: true, TotpEnabled: true, Verified: true, PendingEmail: "new@example.com",
+		Phone: "+381641234567", PhoneVerified: true}
+
+	public, _ := json.Marshal(user.ToDTO())
+	for _, field := range []string{"suspended", "twoFactorEnabled", "verified", "pendingEmail", "phone", "phoneVerified"} {
+		assert.NotContains(t, string(public), `"`+field+`"`)
+	}
+
+	account := user.ToAccountDTO()
+	assert.True(t, account.Suspended)
+	assert.True(t, account.TwoFactorEnabled)
+	assert.Equal(t, "new@example.com", account.PendingEmail)
+	assert.Equal(t, "+381641234567", account.Phone)
+}
@@ -0,0 +1,149 @@
+package util
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const breachedPrefixLength = 5
+
+// BreachedPasswords looks passwords up in an offline copy of a breached
+// password corpus in the k-anonymity range format: the upper case SHA-1 of a
+// password is split into a 5 character prefix and a 35 character suffix, and
+// every range lists "SUFFIX:COUNT" lines.
+//
+// Path is either a directory holding one <PREFIX>.txt file per range, as
+// written by the range downloader, or a single file of "HASH:COUNT" lines
+// with the full hash, sorted by hash like the published combined corpus.
+// Neither is loaded into memory, every lookup reads one range or a few lines.
+type BreachedPasswords struct {
+	Path string
+}
+
+func NewBreachedPasswords(path string) *BreachedPasswords {
+	return &BreachedPasswords{Path: path}
+}
+
+// Count returns how often the password appears in the corpus.
+func (breached *BreachedPasswords) Count(password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:breachedPrefixLength], hash[breachedPrefixLength:]
+
+	info, err := os.Stat(breached.Path)
+	if err != nil {
+		return 0, err
+	}
+
+	if info.IsDir() {
+		return breached.countInRangeFile(prefix, suffix)
+	}
+
+	return breached.countInSortedFile(hash, info.Size())
+}
+
+func (breached *BreachedPasswords) countInRangeFile(prefix string, suffix string) (int, error) {
+	file, err := os.Open(filepath.Join(breached.Path, prefix+".txt"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineSuffix, count := parseBreachedLine(scanner.Text())
+		if lineSuffix == suffix {
+			return count, nil
+		}
+	}
+
+	return 0, scanner.Err()
+}
+
+// countInSortedFile binary searches the combined file for the first line
+// whose hash is not below the hash of the password.
+func (breached *BreachedPasswords) countInSortedFile(hash string, size int64) (int, error) {
+	file, err := os.Open(breached.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	low, high := int64(0), size
+	for low < high {
+		middle := low + (high-low)/2
+		line, next, err := breachedLineFrom(file, middle, size)
+		if err != nil {
+			return 0, err
+		}
+
+		lineHash, _ := parseBreachedLine(line)
+		if line == "" || lineHash >= hash {
+			high = middle
+		} else {
+			low = next
+		}
+	}
+
+	line, _, err := breachedLineFrom(file, low, size)
+	if err != nil {
+		return 0, err
+	}
+
+	lineHash, count := parseBreachedLine(line)
+	if line == "" || lineHash != hash {
+		return 0, nil
+	}
+
+	return count, nil
+}
+
+// breachedLineFrom reads the first line that starts at or after offset, and
+// returns it with the offset of the line after it. The line is empty at the
+// end of the file.
+func breachedLineFrom(file *os.File, offset int64, size int64) (string, int64, error) {
+	start := offset
+	if offset > 0 {
+		start = offset - 1
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(file, start, size-start))
+	if offset > 0 {
+		skipped, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return "", size, nil
+		}
+		if err != nil {
+			return "", size, err
+		}
+		start += int64(len(skipped))
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", size, err
+	}
+
+	return strings.TrimSpace(line), start + int64(len(line)), nil
+}
+
+// parseBreachedLine reads "HASH:COUNT", a missing count counts as one.
+func parseBreachedLine(line string) (string, int) {
+	hash, countText, _ := strings.Cut(strings.TrimSpace(line), ":")
+
+	count, err := strconv.Atoi(countText)
+	if err != nil || count < 1 {
+		count = 1
+	}
+
+	return strings.ToUpper(hash), count
+}
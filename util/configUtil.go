@@ -0,0 +1,37 @@
+package util
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// DurationFromEnv parses a duration such as "15m" from the environment,
+// falling back to the default when it is missing or malformed.
+func DurationFromEnv(key string, fallback time.Duration) time.Duration {
+	value, valueFound := os.LookupEnv(key)
+	if !valueFound {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return fallback
+	}
+
+	return duration
+}
+
+func IntFromEnv(key string, fallback int) int {
+	value, valueFound := os.LookupEnv(key)
+	if !valueFound {
+		return fallback
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback
+	}
+
+	return number
+}
@@ -12,8 +12,30 @@ import (
 
 var (
 	users = []model.User{
-		{Email: "host@email.com", Username: "ivica98", Password: "host", Name: "Ivica", Surname: "Roganovic", Address: "Maksima Gorkog 17a, Novi Sad", Role: model.HOST},
-		{Email: "guest@email.com", Username: "makulica", Password: "guest", Name: "Jovana", Surname: "Mustur", Address: "Dr Svetislava Kasapinovica 22, Novi Sad",Role: model.GUEST},
+		{Email: "host@email.com", Username: "ivica98", Password: "host", Name: "Ivica", Surname: "Roganovic", Address: "Maksima Gorkog 17a, Novi Sad", Role: model.HOST, Verified: true},
+		{Email: "guest@email.com", Username: "makulica", Password: "guest", Name: "Jovana", Surname: "Mustur", Address: "Dr Svetislava Kasapinovica 22, Novi Sad",Role: model.GUEST, Verified: true},
+	}
+
+	permissions = []model.Permission{
+		{Name: model.PERMISSION_USER_READ_ANY, Description: "Read the account of any user"},
+		{Name: model.PERMISSION_USER_SUSPEND, Description: "Suspend and unsuspend accounts"},
+		{Name: model.PERMISSION_USER_UNLOCK, Description: "Lift login lockouts"},
+		{Name: model.PERMISSION_USER_ASSIGN_ROLE, Description: "Change the role of a user"},
+		{Name: model.PERMISSION_OAUTH_CLIENT_MANAGE, Description: "Register and delete OAuth clients"},
+		{Name: model.PERMISSION_SIGNING_KEY_MANAGE, Description: "Rotate and retire token signing keys"},
+	}
+
+	roles = []struct {
+		role        model.Role
+		permissions []string
+	}{
+		{model.Role{Name: model.GUEST, Description: "Books accommodations"}, nil},
+		{model.Role{Name: model.HOST, Description: "Rents out accommodations"}, nil},
+		{model.Role{Name: model.SUPPORT, Description: "Helps users with their accounts"},
+			[]string{model.PERMISSION_USER_READ_ANY, model.PERMISSION_USER_UNLOCK}},
+		{model.Role{Name: model.ADMIN, Description: "Manages the service"},
+			[]string{model.PERMISSION_USER_READ_ANY, model.PERMISSION_USER_SUSPEND, model.PERMISSION_USER_UNLOCK, model.PERMISSION_USER_ASSIGN_ROLE,
+				model.PERMISSION_OAUTH_CLIENT_MANAGE, model.PERMISSION_SIGNING_KEY_MANAGE}},
 	}
 )
 
@@ -43,11 +65,92 @@ func ConnectToDatabase() *gorm.DB {
 
 	db.DropTable("users")
 	db.DropTable("user_deletion_events")
+	db.DropTable("refresh_tokens")
+	db.DropTable("revoked_tokens")
+	db.DropTable("sessions")
+	db.DropTable("recovery_codes")
+	db.DropTable("login_throttles")
+	db.DropTable("password_reset_tokens")
+	db.DropTable("email_changes")
+	db.DropTable("password_histories")
+	db.DropTable("oauth_clients")
+	db.DropTable("authorization_codes")
+	db.DropTable("federated_login_states")
+	db.DropTable("user_identities")
+	db.DropTable("role_assignments")
+	db.DropTable("role_permissions")
+	db.DropTable("roles")
+	db.DropTable("permissions")
+	db.DropTable("phone_verifications")
+	db.DropTable("outbox_events")
 	db.AutoMigrate(&model.User{})
 	db.AutoMigrate(&model.UserDeletionEvent{})
+	db.AutoMigrate(&model.RefreshToken{})
+	db.AutoMigrate(&model.RevokedToken{})
+	db.AutoMigrate(&model.Session{})
+	db.AutoMigrate(&model.RecoveryCode{})
+	db.AutoMigrate(&model.LoginThrottle{})
+	db.AutoMigrate(&model.PasswordResetToken{})
+	db.AutoMigrate(&model.EmailChange{})
+	db.AutoMigrate(&model.PasswordHistory{})
+	db.AutoMigrate(&model.OAuthClient{})
+	db.AutoMigrate(&model.AuthorizationCode{})
+	db.AutoMigrate(&model.FederatedLoginState{})
+	db.AutoMigrate(&model.UserIdentity{})
+	db.AutoMigrate(&model.Role{})
+	db.AutoMigrate(&model.Permission{})
+	db.AutoMigrate(&model.RoleAssignment{})
+	db.AutoMigrate(&model.PhoneVerification{})
+	db.AutoMigrate(&model.OutboxEvent{})
+
+	// The admin user listing sorts by created_at and id, email and username
+	// sort on their unique indexes. Substring search on names, usernames and
+	// emails needs trigram indexes.
+	db.Model(&model.User{}).AddIndex("idx_users_created_at_id", "created_at", "id")
+	db.Model(&model.RoleAssignment{}).AddIndex("idx_role_assignments_role", "role")
+	db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm")
+	for _, column := range []string{"name", "surname", "username", "email"} {
+		db.Exec("CREATE INDEX IF NOT EXISTS idx_users_" + column + "_trgm ON users USING gin (" + column + " gin_trgm_ops)")
+	}
+
+	permissionsByName := map[string]model.Permission{}
+	for _, permission := range permissions {
+		db.Create(&permission)
+		permissionsByName[permission.Name] = permission
+	}
+	for _, seed := range roles {
+		role := seed.role
+		for _, name := range seed.permissions {
+			role.Permissions = append(role.Permissions, permissionsByName[name])
+		}
+		db.Create(&role)
+	}
+
+	// An admin is only seeded for local development, with a password that is
+	// generated on every start and logged once.
+	seedUsers := users
+	if os.Getenv("SEED_DEV_ADMIN") == "true" {
+		adminPassword, err := GenerateOpaqueToken()
+		if err != nil {
+			log.Fatal(err)
+		}
+		seedUsers = append(seedUsers, model.User{Email: "admin@email.com", Username: "admin", Password: adminPassword, Name: "Admin", Surname: "Windbnb", Role: model.ADMIN, Verified: true})
+		log.Println("SEED_DEV_ADMIN is set, seeded admin@email.com with password " + adminPassword)
+	}
 
-	for _, user := range users {
+	hasher := NewPasswordHasher()
+	for _, user := range seedUsers {
+		hash, err := hasher.Hash(user.Password)
+		if err != nil {
+			log.Fatal(err)
+		}
+		user.Password = hash
 		db.Create(&user)
+		for _, provider := range model.EmailIdentityProviders {
+			identity := model.EmailIdentity(provider, user)
+			db.Create(&identity)
+		}
+		db.Create(&model.RoleAssignment{UserId: user.ID, Role: user.Role})
 	}
 
 	return db
@@ -0,0 +1,200 @@
+package util
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	Argon2idAlgorithm = "argon2id"
+	BcryptAlgorithm   = "bcrypt"
+)
+
+// PasswordHasher hashes passwords into self-describing strings that carry
+// the algorithm and its parameters, so that stored hashes can be verified
+// after the configured algorithm or its cost changes.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password string, encodedHash string) (bool, error)
+	NeedsRehash(encodedHash string) bool
+}
+
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+func NewArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{Memory: 64 * 1024, Iterations: 3, Parallelism: 2, SaltLength: 16, KeyLength: 32}
+}
+
+// Hash encodes the password in the PHC string format, e.g.
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func (hasher *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, hasher.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, hasher.Iterations, hasher.Memory, hasher.Parallelism, hasher.KeyLength)
+
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", Argon2idAlgorithm, argon2.Version, hasher.Memory, hasher.Iterations, hasher.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (hasher *Argon2idHasher) Verify(password string, encodedHash string) (bool, error) {
+	params, salt, key, err := decodeArgon2idHash(encodedHash)
+	if err != nil {
+		return false, err
+	}
+
+	otherKey := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
+
+func (hasher *Argon2idHasher) NeedsRehash(encodedHash string) bool {
+	params, salt, key, err := decodeArgon2idHash(encodedHash)
+	if err != nil {
+		return true
+	}
+
+	return params.Memory != hasher.Memory || params.Iterations != hasher.Iterations || params.Parallelism != hasher.Parallelism ||
+		uint32(len(salt)) != hasher.SaltLength || uint32(len(key)) != hasher.KeyLength
+}
+
+func decodeArgon2idHash(encodedHash string) (*Argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 6 || parts[1] != Argon2idAlgorithm {
+		return nil, nil, nil, errors.New("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, nil, nil, err
+	}
+	if version != argon2.Version {
+		return nil, nil, nil, errors.New("incompatible argon2 version")
+	}
+
+	params := &Argon2idHasher{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return nil, nil, nil, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return params, salt, key, nil
+}
+
+type BcryptHasher struct {
+	Cost int
+}
+
+func NewBcryptHasher() *BcryptHasher {
+	return &BcryptHasher{Cost: 12}
+}
+
+// Hash returns the standard modular crypt format, e.g. $2a$12$<salt+hash>,
+// which already records the cost.
+func (hasher *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), hasher.Cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func (hasher *BcryptHasher) Verify(password string, encodedHash string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encodedHash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (hasher *BcryptHasher) NeedsRehash(encodedHash string) bool {
+	cost, err := bcrypt.Cost([]byte(encodedHash))
+	return err != nil || cost != hasher.Cost
+}
+
+// NewPasswordHasher returns the hasher configured through PASSWORD_HASH_ALGORITHM
+// (argon2id by default, or bcrypt).
+func NewPasswordHasher() PasswordHasher {
+	algorithm, algorithmFound := os.LookupEnv("PASSWORD_HASH_ALGORITHM")
+	if !algorithmFound {
+		algorithm = Argon2idAlgorithm
+	}
+
+	if algorithm == BcryptAlgorithm {
+		hasher := NewBcryptHasher()
+		if cost, err := strconv.Atoi(os.Getenv("BCRYPT_COST")); err == nil {
+			hasher.Cost = cost
+		}
+		return hasher
+	}
+
+	return NewArgon2idHasher()
+}
+
+// HashAlgorithm reports which algorithm produced the stored hash. Values that
+// are not in a recognised format are legacy plaintext passwords.
+func HashAlgorithm(encodedHash string) string {
+	if strings.HasPrefix(encodedHash, "$"+Argon2idAlgorithm+"$") {
+		return Argon2idAlgorithm
+	}
+
+	if _, err := bcrypt.Cost([]byte(encodedHash)); err == nil {
+		return BcryptAlgorithm
+	}
+
+	return ""
+}
+
+// VerifyPassword checks the password against a stored hash produced by any
+// supported algorithm, or against a legacy plaintext value. needsRehash is
+// set when the stored value is not in the format the given hasher would
+// produce today.
+func VerifyPassword(hasher PasswordHasher, password string, encodedHash string) (valid bool, needsRehash bool) {
+	var verifier PasswordHasher
+	switch HashAlgorithm(encodedHash) {
+	case Argon2idAlgorithm:
+		verifier = NewArgon2idHasher()
+	case BcryptAlgorithm:
+		verifier = NewBcryptHasher()
+	default:
+		if encodedHash == "" {
+			return false, false
+		}
+		return subtle.ConstantTimeCompare([]byte(password), []byte(encodedHash)) == 1, true
+	}
+
+	valid, err := verifier.Verify(password, encodedHash)
+	if err != nil || !valid {
+		return false, false
+	}
+
+	return true, hasher.NeedsRehash(encodedHash)
+}
@@ -0,0 +1,160 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/windbnb/user-service/model"
+)
+
+// Character classes a password policy can require.
+const (
+	LowercaseClass = "lower"
+	UppercaseClass = "upper"
+	LetterClass    = "letter"
+	DigitClass     = "digit"
+	SymbolClass    = "symbol"
+)
+
+// bcrypt ignores everything after the first 72 bytes of a password.
+const bcryptMaxPasswordLength = 72
+
+type PasswordPolicy struct {
+	MinLength          int
+	MaxLength          int
+	RequiredClasses    []string
+	ForbidPersonalInfo bool
+	Breached           *BreachedPasswords
+	// BreachedThreshold is how many breaches make a password unacceptable.
+	BreachedThreshold int
+}
+
+// NewPasswordPolicy reads the policy from the environment:
+// PASSWORD_MIN_LENGTH, PASSWORD_MAX_LENGTH, PASSWORD_REQUIRED_CLASSES (a comma
+// separated list of lower, upper, letter, digit and symbol),
+// PASSWORD_FORBID_PERSONAL_INFO, PASSWORD_BREACHED_PATH and
+// PASSWORD_BREACHED_THRESHOLD. The breached check is off without a path.
+func NewPasswordPolicy() *PasswordPolicy {
+	policy := &PasswordPolicy{
+		MinLength:          IntFromEnv("PASSWORD_MIN_LENGTH", 8),
+		MaxLength:          IntFromEnv("PASSWORD_MAX_LENGTH", 128),
+		RequiredClasses:    []string{LetterClass, DigitClass},
+		ForbidPersonalInfo: true,
+		BreachedThreshold:  IntFromEnv("PASSWORD_BREACHED_THRESHOLD", 1),
+	}
+
+	if classes, classesFound := os.LookupEnv("PASSWORD_REQUIRED_CLASSES"); classesFound {
+		policy.RequiredClasses = nil
+		for _, class := range strings.Split(classes, ",") {
+			if class = strings.ToLower(strings.TrimSpace(class)); class != "" {
+				policy.RequiredClasses = append(policy.RequiredClasses, class)
+			}
+		}
+	}
+
+	if forbid, forbidFound := os.LookupEnv("PASSWORD_FORBID_PERSONAL_INFO"); forbidFound {
+		policy.ForbidPersonalInfo = strings.ToLower(forbid) != "false"
+	}
+
+	if path, pathFound := os.LookupEnv("PASSWORD_BREACHED_PATH"); pathFound && path != "" {
+		policy.Breached = NewBreachedPasswords(path)
+	}
+
+	algorithm, _ := os.LookupEnv("PASSWORD_HASH_ALGORITHM")
+	if strings.ToLower(algorithm) == BcryptAlgorithm && (policy.MaxLength <= 0 || policy.MaxLength > bcryptMaxPasswordLength) {
+		policy.MaxLength = bcryptMaxPasswordLength
+	}
+
+	return policy
+}
+
+// Validate returns every rule the password breaks for the given field. email
+// and username are only used by the personal information rule.
+func (policy *PasswordPolicy) Validate(field string, password string, email string, username string) []model.FieldError {
+	if password == "" {
+		return []model.FieldError{{Field: field, Code: "required", Message: "password is required"}}
+	}
+
+	var fieldErrors []model.FieldError
+	addError := func(code string, message string) {
+		fieldErrors = append(fieldErrors, model.FieldError{Field: field, Code: code, Message: message})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < policy.MinLength {
+		addError("too_short", fmt.Sprintf("password must be at least %d characters long", policy.MinLength))
+	}
+
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		addError("too_long", fmt.Sprintf("password must be at most %d characters long", policy.MaxLength))
+	}
+
+	for _, class := range policy.RequiredClasses {
+		if !containsClass(password, class) {
+			addError("missing_"+class, fmt.Sprintf("password must contain at least one %s character", class))
+		}
+	}
+
+	if policy.ForbidPersonalInfo && containsPersonalInfo(password, email, username) {
+		addError("contains_personal_info", "password must not contain your email or username")
+	}
+
+	if policy.Breached != nil && policy.BreachedThreshold > 0 {
+		// An unreadable corpus must not block every registration, the other
+		// rules still apply.
+		if count, err := policy.Breached.Count(password); err == nil && count >= policy.BreachedThreshold {
+			addError("breached", "password appeared in a data breach, choose another one")
+		}
+	}
+
+	return fieldErrors
+}
+
+func containsClass(password string, class string) bool {
+	for _, r := range password {
+		switch class {
+		case LowercaseClass:
+			if unicode.IsLower(r) {
+				return true
+			}
+		case UppercaseClass:
+			if unicode.IsUpper(r) {
+				return true
+			}
+		case LetterClass:
+			if unicode.IsLetter(r) {
+				return true
+			}
+		case DigitClass:
+			if unicode.IsDigit(r) {
+				return true
+			}
+		case SymbolClass:
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+
+	return false
+}
+
+// containsPersonalInfo ignores fragments shorter than three characters,
+// they would reject too many unrelated passwords.
+func containsPersonalInfo(password string, email string, username string) bool {
+	password = strings.ToLower(password)
+	localPart, _, _ := strings.Cut(strings.ToLower(email), "@")
+
+	for _, fragment := range []string{localPart, strings.ToLower(username)} {
+		if len(fragment) >= 3 && strings.Contains(password, fragment) {
+			return true
+		}
+	}
+
+	return false
+}
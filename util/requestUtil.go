@@ -1,8 +1,10 @@
 package util
 
 import (
+	"net"
 	"net/url"
 	"os"
+	"strings"
 
 	roundrobin "github.com/hlts2/round-robin"
 )
@@ -28,3 +30,104 @@ func GetAccommodationServicePathRoundRobin() (roundrobin.RoundRobin, error) {
 		&url.URL{Host: accommodationServicePath},
 	)
 }
+
+// DeviceFromUserAgent derives a short, human readable device label such as
+// "Chrome on Android" from a User-Agent header.
+func DeviceFromUserAgent(userAgent string) string {
+	platform := "Unknown device"
+	for _, candidate := range []struct{ token, name string }{
+		{"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Android", "Android"}, {"Windows", "Windows"},
+		{"Macintosh", "Mac"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, candidate.token) {
+			platform = candidate.name
+			break
+		}
+	}
+
+	browser := ""
+	for _, candidate := range []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+	} {
+		if strings.Contains(userAgent, candidate.token) {
+			browser = candidate.name
+			break
+		}
+	}
+
+	if browser == "" {
+		return platform
+	}
+
+	return browser + " on " + platform
+}
+
+// trustedProxies parses TRUSTED_PROXIES, a comma separated list of the IPs
+// or CIDR ranges of the proxies in front of the service, such as the
+// gateway. Nothing is trusted when it is not set.
+func trustedProxies() []*net.IPNet {
+	proxies := []*net.IPNet{}
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			proxies = append(proxies, network)
+		}
+	}
+
+	return proxies
+}
+
+func isTrustedProxy(proxies []*net.IPNet, address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientIP is the address of the caller. X-Forwarded-For is only read when
+// the request comes from a trusted proxy, and then from the right, skipping
+// trusted proxies: entries left of them were written by the client and can
+// be anything.
+func ClientIP(remoteAddr string, forwardedFor []string) string {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+
+	proxies := trustedProxies()
+	if !isTrustedProxy(proxies, ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(forwardedFor, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(proxies, hop) {
+			break
+		}
+	}
+
+	return ip
+}